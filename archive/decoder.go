@@ -0,0 +1,118 @@
+package archive
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/parser"
+	"github.com/soulmachine/coinsignal/pojo"
+)
+
+// Decoder converts the lines archived by a producer.
+type Decoder struct {
+	// Decode returns the pojo of line, an error if it is corrupt
+	Decode func(line []byte) (interface{}, error)
+	// Time returns when line was produced
+	Time func(line []byte) (time.Time, error)
+}
+
+// Producers are named after the file they write, the topics saved by
+// cmd/record with : replaced by .
+var DECODERS = map[string]Decoder{
+	"cmc.global_metrics": {decodeCmcGlobalMetrics, cmcGlobalMetricsTime},
+	"cmc.prices":         {decodeCmcPrice, cmcPriceTime},
+	"eth.block_header":   {decodeBlockHeader, blockHeaderTime},
+	"gasnow.gas_price":   {decodeGasPrice, gasPriceTime},
+}
+
+var RECORDED_DECODER = Decoder{decodeRecordedMessage, recordedMessageTime}
+
+// DecoderOf returns the decoder of producer, if known.
+func DecoderOf(producer string) (Decoder, bool) {
+	if decoder, ok := DECODERS[producer]; ok {
+		return decoder, true
+	}
+	if strings.HasPrefix(producer, strings.ReplaceAll(config.REDIS_TOPIC_PREFIX, ":", ".")) {
+		return RECORDED_DECODER, true
+	}
+	return Decoder{}, false
+}
+
+func decodeCmcPrice(line []byte) (interface{}, error) {
+	return parser.ParseCmcPrice(line)
+}
+
+func decodeCmcGlobalMetrics(line []byte) (interface{}, error) {
+	flattened, err := parser.ParseCmcGlobalMetrics(line)
+	if err != nil {
+		return nil, err
+	}
+	metrics := &pojo.GlobalMetrics{}
+	return metrics, json.Unmarshal([]byte(flattened), metrics)
+}
+
+func decodeGasPrice(line []byte) (interface{}, error) {
+	return parser.ParseGasPrice(line)
+}
+
+func decodeBlockHeader(line []byte) (interface{}, error) {
+	header := &pojo.BlockHeader{}
+	return header, json.Unmarshal(line, header)
+}
+
+func decodeRecordedMessage(line []byte) (interface{}, error) {
+	msg := &pojo.RecordedMessage{}
+	return msg, json.Unmarshal(line, msg)
+}
+
+// milliseconds, either a number or a string
+func unixMilli(line []byte, keys ...string) (time.Time, error) {
+	value, _, _, err := jsonparser.Get(line, keys...)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ms, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
+
+func cmcPriceTime(line []byte) (time.Time, error) {
+	if t, err := unixMilli(line, "d", "t"); err == nil {
+		return t, nil
+	}
+	return unixMilli(line, "t")
+}
+
+func cmcGlobalMetricsTime(line []byte) (time.Time, error) {
+	last_updated, err := jsonparser.GetString(line, "data", "last_updated")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, last_updated)
+}
+
+func gasPriceTime(line []byte) (time.Time, error) {
+	return unixMilli(line, "data", "timestamp")
+}
+
+func blockHeaderTime(line []byte) (time.Time, error) {
+	value, _, _, err := jsonparser.Get(line, "timestamp")
+	if err != nil {
+		return time.Time{}, err
+	}
+	seconds, err := strconv.ParseInt(string(value), 0, 64) // hex in raw headers
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func recordedMessageTime(line []byte) (time.Time, error) {
+	return unixMilli(line, "received_at")
+}
@@ -0,0 +1,259 @@
+// Package archive reads back the segments rolled by the crawlers, from a
+// directory or an S3 prefix, as records decoded into pojo types.
+package archive
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"time"
+
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+// At most this many skipped lines are kept in a Report
+const MAX_REPORTED_LINES = 100
+
+// Record is a line of a segment.
+type Record struct {
+	Producer string
+	Host     string
+	Time     time.Time   // when produced, or as the previous line if unknown
+	Line     []byte      // as archived, without the newline
+	Value    interface{} // the pojo decoded, such as *pojo.CurrencyPrice
+}
+
+// SkippedLine is a line which is partial or failed to decode, Line is 0
+// if the rest of the segment is unreadable.
+type SkippedLine struct {
+	Segment string
+	Line    int
+	Err     error
+}
+
+func (skipped SkippedLine) String() string {
+	if skipped.Line == 0 {
+		return fmt.Sprintf("%s: %v", skipped.Segment, skipped.Err)
+	}
+	return fmt.Sprintf("%s:%d: %v", skipped.Segment, skipped.Line, skipped.Err)
+}
+
+// Report counts what a Reader read so far.
+type Report struct {
+	Segments   int
+	Records    int
+	Skipped    int
+	Lines      []SkippedLine // the first MAX_REPORTED_LINES skipped
+	Mismatched []SkippedLine // segments read whole which differ from their manifest, Line is 0
+}
+
+// stream reads the segments of one host in order.
+type stream struct {
+	host     string
+	segments []utils.Segment
+	segment  utils.Segment
+	file     io.ReadCloser
+	reader   *bufio.Reader
+	manifest *utils.SegmentManifest // nil if none
+	hash     hash.Hash              // of what was read from file
+	line     int
+	last     time.Time
+	head     *Record
+}
+
+// Reader iterates the records of a producer between from and to, in time
+// order, merging the segments of every host.
+type Reader struct {
+	source   Source
+	producer string
+	decoder  Decoder
+	from     time.Time
+	to       time.Time
+	streams  []*stream
+	report   Report
+}
+
+// NewReader lists the segments of producer in source which may contain
+// records between from and to, to excluded.
+func NewReader(ctx context.Context, source Source, producer string, from, to time.Time) (*Reader, error) {
+	decoder, ok := DecoderOf(producer)
+	if !ok {
+		return nil, fmt.Errorf("unknown producer %s", producer)
+	}
+	all, err := source.List(ctx, producer)
+	if err != nil {
+		return nil, err
+	}
+	by_host := make(map[string][]utils.Segment)
+	hosts := make([]string, 0)
+	for _, segment := range all {
+		if _, ok := by_host[segment.Host]; !ok {
+			hosts = append(hosts, segment.Host)
+		}
+		by_host[segment.Host] = append(by_host[segment.Host], segment)
+	}
+	reader := &Reader{source: source, producer: producer, decoder: decoder, from: from, to: to}
+	for _, host := range hosts {
+		segments := utils.SelectSegments(by_host[host], from, to)
+		if len(segments) > 0 {
+			reader.streams = append(reader.streams, &stream{host: host, segments: segments})
+		}
+	}
+	return reader, nil
+}
+
+// Next returns the next record, or nil at the end.
+func (reader *Reader) Next(ctx context.Context) (*Record, error) {
+	for {
+		var earliest *stream
+		for _, s := range reader.streams {
+			if s.head == nil {
+				head, err := reader.read(ctx, s)
+				if err != nil {
+					return nil, err
+				}
+				s.head = head
+			}
+			if s.head != nil && (earliest == nil || s.head.Time.Before(earliest.head.Time)) {
+				earliest = s
+			}
+		}
+		if earliest == nil {
+			return nil, nil
+		}
+		record := earliest.head
+		earliest.head = nil
+		if record.Time.Before(reader.from) || !record.Time.Before(reader.to) {
+			continue
+		}
+		reader.report.Records++
+		return record, nil
+	}
+}
+
+// read returns the next record of s, or nil at its end.
+func (reader *Reader) read(ctx context.Context, s *stream) (*Record, error) {
+	for {
+		if s.reader == nil {
+			if len(s.segments) == 0 {
+				return nil, nil
+			}
+			s.segment = s.segments[0]
+			s.segments = s.segments[1:]
+			file, err := reader.source.Open(ctx, s.segment)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				reader.skip(s, 0, err)
+				continue
+			}
+			manifest, err := reader.source.Manifest(ctx, s.segment)
+			if err != nil {
+				if ctx.Err() != nil {
+					file.Close()
+					return nil, ctx.Err()
+				}
+				reader.mismatch(s, fmt.Errorf("unreadable manifest: %w", err))
+			}
+			reader.report.Segments++
+			s.file = file
+			s.manifest = manifest
+			s.hash = sha256.New()
+			s.reader = bufio.NewReaderSize(io.TeeReader(file, s.hash), 64*1024)
+			s.line = 0
+			// lines without a timestamp are ordered as if written when rolled
+			s.last = s.segment.Time
+		}
+
+		line, err := s.reader.ReadBytes('\n')
+		if err != nil {
+			if len(line) > 0 {
+				// cut by a crash, or a truncated compressed segment
+				reader.skip(s, s.line+1, errors.New("partial line"))
+			}
+			if err != io.EOF {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				reader.skip(s, 0, err)
+			} else {
+				reader.verify(s)
+			}
+			s.close()
+			continue
+		}
+		s.line++
+		line = line[:len(line)-1]
+		if len(line) == 0 {
+			continue
+		}
+		value, err := reader.decoder.Decode(line)
+		if err != nil {
+			reader.skip(s, s.line, err)
+			continue
+		}
+		at, err := reader.decoder.Time(line)
+		if err != nil {
+			at = s.last
+		}
+		s.last = at
+		return &Record{reader.producer, s.host, at, line, value}, nil
+	}
+}
+
+func (reader *Reader) skip(s *stream, line int, err error) {
+	reader.report.Skipped++
+	if len(reader.report.Lines) < MAX_REPORTED_LINES {
+		reader.report.Lines = append(reader.report.Lines, SkippedLine{s.segment.Path, line, err})
+	}
+}
+
+// verify compares the segment s read to the end with its manifest.
+func (reader *Reader) verify(s *stream) {
+	if s.manifest == nil {
+		return
+	}
+	if int64(s.line) != s.manifest.Lines {
+		reader.mismatch(s, fmt.Errorf("%d lines, %d in the manifest", s.line, s.manifest.Lines))
+		return
+	}
+	if sum := hex.EncodeToString(s.hash.Sum(nil)); sum != s.manifest.SHA256 {
+		reader.mismatch(s, fmt.Errorf("SHA-256 %s, %s in the manifest", sum, s.manifest.SHA256))
+	}
+}
+
+func (reader *Reader) mismatch(s *stream, err error) {
+	reader.report.Mismatched = append(reader.report.Mismatched, SkippedLine{s.segment.Path, 0, err})
+}
+
+// Report returns what was read so far.
+func (reader *Reader) Report() Report {
+	return reader.report
+}
+
+// Close closes the segments being read, and logs the lines skipped if any.
+func (reader *Reader) Close() {
+	for _, s := range reader.streams {
+		s.close()
+	}
+	if reader.report.Skipped > 0 {
+		log.Printf("Skipped %d lines of %s, first at %s\n", reader.report.Skipped, reader.producer, reader.report.Lines[0])
+	}
+	for _, mismatched := range reader.report.Mismatched {
+		log.Printf("Segment differs from its manifest, %s\n", mismatched)
+	}
+}
+
+func (s *stream) close() {
+	if s.reader != nil {
+		s.file.Close()
+		s.reader = nil
+	}
+}
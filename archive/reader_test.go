@@ -0,0 +1,198 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/testutil"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+var base = time.Date(2021, 10, 18, 6, 0, 0, 0, time.UTC)
+
+func price(currency string, p float64, at time.Time) string {
+	return `{"d":{"cr":{"id":1,"p":` + strconv.FormatFloat(p, 'f', -1, 64) + `,"c":"` + currency + `"},"t":"` + strconv.FormatInt(at.UnixMilli(), 10) + `"},"s":"0"}`
+}
+
+func gzipped(content string) []byte {
+	buf := bytes.Buffer{}
+	writer := gzip.NewWriter(&buf)
+	writer.Write([]byte(content))
+	writer.Close()
+	return buf.Bytes()
+}
+
+// manifest of a segment with content
+func manifest(segment, content string) []byte {
+	sum := sha256.Sum256([]byte(content))
+	bytes, _ := json.Marshal(utils.SegmentManifest{Segment: segment, Name: "cmc.prices", Lines: int64(strings.Count(content, "\n")), Bytes: int64(len(content)), SHA256: hex.EncodeToString(sum[:])})
+	return bytes
+}
+
+// segments of cmc.prices by key, from two hosts, found through the index of
+// their directory
+func segments() map[string][]byte {
+	host1 := price("BTC", 61000, base.Add(time.Minute)) + "\n" +
+		"not json\n" +
+		price("BTC", 61001, base.Add(5*time.Minute)) + "\n"
+	host2 := price("ETH", 3800, base.Add(3*time.Minute)) + "\n" +
+		price("ETH", 3801, base.Add(20*time.Minute)) + "\n"
+	return map[string][]byte{
+		"cmc.prices/2021/10/18/cmc.prices.host1.202110180615.json.gz": gzipped(host1),
+		// altered after it was rolled
+		"cmc.prices/2021/10/18/cmc.prices.host1.202110180615.manifest": manifest("cmc.prices.host1.202110180615", strings.Replace(host1, "not json", "not JSON", 1)),
+		"cmc.prices/2021/10/18/cmc.prices.host2.202110180615.json.gz":  gzipped(host2),
+		"cmc.prices/2021/10/18/cmc.prices.host2.202110180615.manifest": manifest("cmc.prices.host2.202110180615", host2),
+		// cut by a crash
+		"cmc.prices/2021/10/18/cmc.prices.host1.202110180630.json": []byte(
+			price("BTC", 61002, base.Add(16*time.Minute)) + "\n" +
+				price("BTC", 61003, base.Add(17*time.Minute))[:20]),
+		// truncated
+		"cmc.prices/2021/10/18/cmc.prices.host2.202110180630.json.gz": gzipped(
+			price("ETH", 3802, base.Add(25*time.Minute)) + "\n")[:30],
+		// outside of the range
+		"cmc.prices/2021/10/18/cmc.prices.host1.202110180700.json":             []byte(price("BTC", 62000, base.Add(50*time.Minute)) + "\n"),
+		"gasnow.gas_price/2021/10/18/gasnow.gas_price.host1.202110180615.json": []byte(testutil.GASNOW_GAS_PRICE + "\n"),
+		// missing from the index, such as a segment rolled without a manifest
+		"cmc.prices/2021/10/18/cmc.prices.host3.202110180615.json": []byte(price("BTC", 1, base.Add(time.Minute)) + "\n"),
+		"cmc.prices/2021/10/18/" + utils.INDEX_FILENAME: []byte(index(
+			"cmc.prices.host1.202110180615", "cmc.prices.host2.202110180615", "cmc.prices.host1.202110180630",
+			"cmc.prices.host2.202110180630", "cmc.prices.host1.202110180700", "cmc.prices.host1.202110180645")),
+	}
+}
+
+// index listing segments, whether they still exist or not
+func index(segments ...string) string {
+	lines := ""
+	for _, segment := range segments {
+		bytes, _ := json.Marshal(utils.SegmentManifest{Segment: segment, Name: "cmc.prices"})
+		lines += string(bytes) + "\n"
+	}
+	return lines
+}
+
+func readAll(t *testing.T, source Source) ([]*Record, Report) {
+	t.Helper()
+	ctx := context.Background()
+	reader, err := NewReader(ctx, source, "cmc.prices", base, base.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	records := make([]*Record, 0)
+	for {
+		record, err := reader.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record == nil {
+			return records, reader.Report()
+		}
+		records = append(records, record)
+	}
+}
+
+func checkRecords(t *testing.T, records []*Record, report Report) {
+	t.Helper()
+	expected := []pojo.CurrencyPrice{{Currency: "BTC", Price: 61000}, {Currency: "ETH", Price: 3800}, {Currency: "BTC", Price: 61001}, {Currency: "BTC", Price: 61002}, {Currency: "ETH", Price: 3801}}
+	if len(records) != len(expected) {
+		t.Fatalf("read %d records", len(records))
+	}
+	for i, record := range records {
+		if value := *record.Value.(*pojo.CurrencyPrice); value != expected[i] {
+			t.Errorf("record %d is %v, expected %v", i, value, expected[i])
+		}
+		if i > 0 && record.Time.Before(records[i-1].Time) {
+			t.Errorf("record %d is out of order", i)
+		}
+	}
+	if records[1].Host != "host2" || !records[1].Time.Equal(base.Add(3*time.Minute)) {
+		t.Errorf("unexpected record %+v", records[1])
+	}
+
+	if report.Segments != 4 || report.Records != 5 || report.Skipped != 4 || len(report.Lines) != 4 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if len(report.Mismatched) != 1 || !strings.Contains(report.Mismatched[0].String(), "cmc.prices.host1.202110180615.json.gz: SHA-256") {
+		t.Errorf("unexpected mismatches %v", report.Mismatched)
+	}
+	skipped := make([]string, 0)
+	for _, line := range report.Lines {
+		skipped = append(skipped, line.String())
+	}
+	for i, expected := range []string{
+		"cmc.prices.host1.202110180615.json.gz:2: ",
+		"cmc.prices.host1.202110180630.json:2: partial line",
+		"cmc.prices.host2.202110180630.json.gz:1: partial line",
+		"cmc.prices.host2.202110180630.json.gz: unexpected EOF",
+	} {
+		if !strings.Contains(skipped[i], expected) {
+			t.Errorf("skipped %q, expected %q", skipped[i], expected)
+		}
+	}
+}
+
+func TestDirSource(t *testing.T) {
+	dir := t.TempDir()
+	for key, data := range segments() {
+		file_path := filepath.Join(dir, filepath.FromSlash(key))
+		os.MkdirAll(filepath.Dir(file_path), 0755)
+		if err := os.WriteFile(file_path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, report := readAll(t, NewDirSource(dir))
+	checkRecords(t, records, report)
+
+	if _, err := NewReader(context.Background(), NewDirSource(dir), "unknown", base, base.Add(time.Hour)); err == nil {
+		t.Error("an unknown producer should be an error")
+	}
+}
+
+func TestS3Source(t *testing.T) {
+	s3 := testutil.NewS3Server(t)
+	for key, data := range segments() {
+		s3.PutObject("bucket", "archive/"+key, data)
+	}
+	s3.PutObject("bucket", "other/cmc.prices/2021/10/18/cmc.prices.host3.202110180615.json", []byte(price("BTC", 1, base)+"\n"))
+	source, err := NewS3Source(s3.URL, "key", "secret", "us-east-1", "s3://bucket/archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, report := readAll(t, source)
+	checkRecords(t, records, report)
+}
+
+func TestDecoderOf(t *testing.T) {
+	decoder, ok := DecoderOf("carbonbot.misc.currency_price_channel")
+	if !ok {
+		t.Fatal("recorded topics should be decoded")
+	}
+	value, err := decoder.Decode([]byte(`{"channel":"carbonbot:misc:currency_price_channel","received_at":1634533200000,"msg":{"currency":"BTC","price":61000}}`))
+	if err != nil || value.(*pojo.RecordedMessage).Channel != "carbonbot:misc:currency_price_channel" {
+		t.Errorf("unexpected value %v, %v", value, err)
+	}
+	if at, err := decoder.Time([]byte(`{"received_at":1634533200000}`)); err != nil || at.UnixMilli() != 1634533200000 {
+		t.Errorf("unexpected time %v, %v", at, err)
+	}
+
+	decoder, _ = DecoderOf("gasnow.gas_price")
+	value, err = decoder.Decode([]byte(testutil.GASNOW_GAS_PRICE))
+	if err != nil || value.(*pojo.GasPriceMsg).Rapid == 0 {
+		t.Errorf("unexpected value %v, %v", value, err)
+	}
+	if _, ok := DecoderOf("trade.binance"); ok {
+		t.Error("unexpected decoder")
+	}
+}
@@ -0,0 +1,158 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/soulmachine/coinsignal/upload"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+// Source lists and opens the segments of a producer, wherever they were
+// uploaded.
+type Source interface {
+	// List returns the segments of producer with their Path, in any order,
+	// found through the index of their directory if it has one
+	List(ctx context.Context, producer string) ([]utils.Segment, error)
+	// Open returns the content of segment, decompressed
+	Open(ctx context.Context, segment utils.Segment) (io.ReadCloser, error)
+	// Manifest returns the manifest of segment, nil if it has none, such as
+	// segments rolled by earlier versions
+	Manifest(ctx context.Context, segment utils.Segment) (*utils.SegmentManifest, error)
+}
+
+// DirSource reads segments under a local or NFS directory, recursively,
+// such as DATA_DIR or the DEST_DIR of the uploader.
+type DirSource struct {
+	dir string
+}
+
+func NewDirSource(dir string) *DirSource {
+	return &DirSource{dir}
+}
+
+func (source *DirSource) List(ctx context.Context, producer string) ([]utils.Segment, error) {
+	// all of them, the Reader selects its range
+	return utils.ListSegments(source.dir, producer, time.Time{}, time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func (source *DirSource) Open(ctx context.Context, segment utils.Segment) (io.ReadCloser, error) {
+	return utils.OpenSegment(segment.Path)
+}
+
+func (source *DirSource) Manifest(ctx context.Context, segment utils.Segment) (*utils.SegmentManifest, error) {
+	manifest, err := utils.ReadManifest(utils.ManifestPath(segment.Path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return manifest, err
+}
+
+// S3Source reads segments under a prefix of AWS S3 or MinIO, Path is the
+// object key.
+type S3Source struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Source connects to endpoint like upload.NewS3Destination, dir_url is
+// the bucket and an optional prefix, such as s3://bucket/path.
+func NewS3Source(endpoint, access_key, secret_key, region, dir_url string) (*S3Source, error) {
+	bucket, prefix, err := upload.ParseDirURL(dir_url)
+	if err != nil {
+		return nil, err
+	}
+	client, err := upload.NewS3Client(endpoint, access_key, secret_key, region)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Source{client, bucket, prefix}, nil
+}
+
+// List finds segments through the index of their directory like
+// utils.ListSegments, from a single listing of the objects.
+func (source *S3Source) List(ctx context.Context, producer string) ([]utils.Segment, error) {
+	keys := make(map[string]bool)
+	indexed := make(map[string]bool) // directories with an index
+	for object := range source.client.ListObjects(ctx, source.bucket, minio.ListObjectsOptions{Prefix: source.prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		keys[object.Key] = true
+		if path.Base(object.Key) == utils.INDEX_FILENAME {
+			indexed[path.Dir(object.Key)] = true
+		}
+	}
+
+	segments := make([]utils.Segment, 0)
+	add := func(key string) {
+		segment, ok := utils.ParseSegmentName(path.Base(key))
+		if ok && segment.Name == producer {
+			segment.Path = key
+			segments = append(segments, segment)
+		}
+	}
+	for key := range keys {
+		if !indexed[path.Dir(key)] {
+			add(key)
+		}
+	}
+	for dir := range indexed {
+		manifests, err := source.index(ctx, path.Join(dir, utils.INDEX_FILENAME))
+		if err != nil {
+			return nil, err
+		}
+		for _, manifest := range manifests {
+			for _, suffix := range []string{".json.gz", ".json.zst", ".json"} {
+				if key := path.Join(dir, manifest.Segment+suffix); keys[key] {
+					add(key)
+					break
+				}
+			}
+		}
+	}
+	return segments, nil
+}
+
+func (source *S3Source) index(ctx context.Context, key string) ([]utils.SegmentManifest, error) {
+	object, err := source.client.GetObject(ctx, source.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	manifests, corrupt, err := utils.ParseIndex(object)
+	if corrupt > 0 {
+		log.Printf("Skipped %d corrupt lines of %s\n", corrupt, key)
+	}
+	return manifests, err
+}
+
+func (source *S3Source) Open(ctx context.Context, segment utils.Segment) (io.ReadCloser, error) {
+	object, err := source.client.GetObject(ctx, source.bucket, segment.Path, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return utils.DecompressSegment(object, segment.Path)
+}
+
+func (source *S3Source) Manifest(ctx context.Context, segment utils.Segment) (*utils.SegmentManifest, error) {
+	object, err := source.client.GetObject(ctx, source.bucket, utils.ManifestPath(segment.Path), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	bytes, err := io.ReadAll(object)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return utils.ParseManifest(bytes)
+}
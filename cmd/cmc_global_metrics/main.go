@@ -2,97 +2,93 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/buger/jsonparser"
 	"github.com/soulmachine/coinsignal/config"
-	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/parser"
+	"github.com/soulmachine/coinsignal/sink"
 	"github.com/soulmachine/coinsignal/utils"
 )
 
-func fetch_cmc_global_metrics(rf *utils.RollingFile) string {
-	url := "https://pro-api.coinmarketcap.com/v1/global-metrics/quotes/latest"
+const CMC_GLOBAL_METRICS_URL = "https://pro-api.coinmarketcap.com/v1/global-metrics/quotes/latest"
+
+type options struct {
+	api_url  string
+	api_key  string
+	interval time.Duration
+}
+
+func fetch_cmc_global_metrics(router *sink.Router, opts options) (string, error) {
 	client := &http.Client{Timeout: 10 * time.Second}
-	req, _ := http.NewRequest("GET", url, nil)
+	req, _ := http.NewRequest("GET", opts.api_url, nil)
 
-	cmc_api_key := os.Getenv("CMC_API_KEY")
-	req.Header.Set("X-CMC_PRO_API_KEY", cmc_api_key)
+	req.Header.Set("X-CMC_PRO_API_KEY", opts.api_key)
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 	defer resp.Body.Close()
 
 	body, _ := ioutil.ReadAll(resp.Body)
-	if rf != nil {
-		rf.Write(string(body) + "\n")
+	// archive every response, errors such as 429 included
+	router.Write("cmc.global_metrics", string(body))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("CoinMarketCap returned %d: %s", resp.StatusCode, string(body))
 	}
-	data, _, _, _ := jsonparser.Get(body, "data")
-
-	usd, _, _, _ := jsonparser.Get(data, "quote", "USD")
-	data = jsonparser.Delete(data, "quote")
-	last_updated, _, _, _ := jsonparser.Get(data, "last_updated")
-	data = jsonparser.Delete(data, "last_updated")
-
-	jsonparser.ObjectEach(usd, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
-		data, _ = jsonparser.Set(data, value, string(key))
-		return nil
-	})
+	return parser.ParseCmcGlobalMetrics(body)
+}
 
-	last_updated = []byte("\"" + string(last_updated) + "\"")
-	data, _ = jsonparser.Set(data, last_updated, "last_updated") // TODO: workaround jsonparser/issues/218
+// run crawls global metrics every opts.interval until ctx is cancelled, a
+// failed crawl is logged and retried at the next tick.
+func run(ctx context.Context, router *sink.Router, opts options) error {
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
 
-	return string(data)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			metrics, err := fetch_cmc_global_metrics(router, opts)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			router.Write(config.REDIS_TOPIC_CMC_GLOBAL_METRICS, metrics)
+		}
+	}
 }
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	if len(os.Getenv("CMC_API_KEY")) == 0 {
+	cmc_api_key := os.Getenv("CMC_API_KEY")
+	if len(cmc_api_key) == 0 {
 		log.Fatal("The CMC_API_KEY environment variable is empty")
 	}
 
-	data_dir := os.Getenv("DATA_DIR")
-	redis_url := os.Getenv("REDIS_URL")
-	if len(data_dir) == 0 && len(redis_url) == 0 {
-		log.Fatal("Both DATA_DIR and REDIS_URL are empty")
-	}
-
-	var rf *utils.RollingFile
-	if len(data_dir) == 0 {
-		log.Println("The DATA_DIR environment variable is empty")
-		rf = nil
-	} else {
-		rf = utils.NewRollingFile(data_dir, "cmc.global_metrics")
-	}
-
-	var publisher *pubsub.Publisher
-	if len(redis_url) == 0 {
-		publisher = nil
-		log.Println("The REDIS_URL environment variable is empty")
-	} else {
-		utils.WaitRedis(ctx, redis_url)
-		publisher = pubsub.NewPublisher(ctx, redis_url)
-	}
-
-	ticker := time.NewTicker(10 * time.Minute) // crawl every 10 minutes
-	defer ticker.Stop()
-
-	for range ticker.C {
-		metrics := fetch_cmc_global_metrics(rf)
-		if publisher != nil {
-			publisher.Publish(config.REDIS_TOPIC_CMC_GLOBAL_METRICS, string(metrics))
-		}
-	}
-
-	if rf != nil {
-		rf.Close()
+	router, err := sink.NewRouterFromEnv(ctx, "cmc_global_metrics")
+	if err != nil {
+		log.Fatal(err)
 	}
-	if publisher != nil {
-		publisher.Close()
+	defer router.Close()
+	// 6 lines an hour, roll hourly
+	router.SetFileOptions("cmc.global_metrics", utils.RollingFileOptions{Interval: time.Hour})
+
+	err = run(ctx, router, options{
+		api_url:  CMC_GLOBAL_METRICS_URL,
+		api_key:  cmc_api_key,
+		interval: 10 * time.Minute, // crawl every 10 minutes
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 }
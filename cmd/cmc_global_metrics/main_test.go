@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/sink"
+	"github.com/soulmachine/coinsignal/testutil"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+func TestRun(t *testing.T) {
+	_, redis_url := testutil.NewRedis(t)
+	data_dir := t.TempDir()
+	t.Setenv("DATA_DIR", data_dir)
+	cmc := testutil.NewCMCServer(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router, err := sink.NewRouterFromEnv(ctx, "cmc_global_metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := testutil.Collect(t, redis_url, config.REDIS_TOPIC_CMC_GLOBAL_METRICS)
+
+	done := make(chan error)
+	go func() {
+		done <- run(ctx, router, options{
+			api_url:  cmc.URL + "/v1/global-metrics/quotes/latest",
+			api_key:  "test",
+			interval: 10 * time.Millisecond,
+		})
+	}()
+
+	payload, _, _, err := jsonparser.Get([]byte(testutil.Receive(t, msgs, 5*time.Second)), "payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the USD quote is flattened into the metrics
+	total_market_cap, _ := jsonparser.GetFloat(payload, "total_market_cap")
+	if total_market_cap != 2500000000000.5 {
+		t.Errorf("total_market_cap is %v", total_market_cap)
+	}
+	btc_dominance, _ := jsonparser.GetFloat(payload, "btc_dominance")
+	if btc_dominance != 44.5 {
+		t.Errorf("btc_dominance is %v", btc_dominance)
+	}
+	last_updated, _ := jsonparser.GetString(payload, "last_updated")
+	if last_updated != "2021-10-18T05:00:00.000Z" {
+		t.Errorf("last_updated is %v", last_updated)
+	}
+	if _, _, _, err := jsonparser.Get(payload, "quote"); err == nil {
+		t.Error("quote should be removed")
+	}
+
+	testutil.Eventually(t, 5*time.Second, func() bool {
+		bytes, _ := ioutil.ReadFile(utils.ActivePath(data_dir, "cmc.global_metrics"))
+		return strings.HasPrefix(string(bytes), testutil.CMC_GLOBAL_METRICS+"\n")
+	})
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A rate limited crawl is archived and retried at the next tick.
+func TestRunRateLimited(t *testing.T) {
+	_, redis_url := testutil.NewRedis(t)
+	data_dir := t.TempDir()
+	t.Setenv("DATA_DIR", data_dir)
+	const RATE_LIMITED = `{"status":{"error_code":1008,"error_message":"You've exceeded your API Key's HTTP request rate limit."}}`
+	requests := int32(0)
+	cmc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, RATE_LIMITED)
+			return
+		}
+		fmt.Fprint(w, testutil.CMC_GLOBAL_METRICS)
+	}))
+	defer cmc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router, err := sink.NewRouterFromEnv(ctx, "cmc_global_metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := testutil.Collect(t, redis_url, config.REDIS_TOPIC_CMC_GLOBAL_METRICS)
+
+	done := make(chan error)
+	go func() {
+		done <- run(ctx, router, options{
+			api_url:  cmc.URL,
+			api_key:  "test",
+			interval: 10 * time.Millisecond,
+		})
+	}()
+	testutil.Receive(t, msgs, 5*time.Second)
+	testutil.Eventually(t, 5*time.Second, func() bool {
+		bytes, _ := ioutil.ReadFile(utils.ActivePath(data_dir, "cmc.global_metrics"))
+		return strings.HasPrefix(string(bytes), RATE_LIMITED+"\n"+testutil.CMC_GLOBAL_METRICS+"\n")
+	})
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunWithoutApiKey(t *testing.T) {
+	_, redis_url := testutil.NewRedis(t)
+	cmc := testutil.NewCMCServer(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router, err := sink.NewRouterFromEnv(ctx, "cmc_global_metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := testutil.Collect(t, redis_url, config.REDIS_TOPIC_CMC_GLOBAL_METRICS)
+
+	done := make(chan error)
+	go func() {
+		done <- run(ctx, router, options{
+			api_url:  cmc.URL + "/v1/global-metrics/quotes/latest",
+			interval: 10 * time.Millisecond,
+		})
+	}()
+	// rejected crawls are logged, nothing is published
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case msg := <-msgs:
+		t.Errorf("unexpected message %s", msg)
+	default:
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"os/signal"
 	"strconv"
 	"strings"
@@ -17,72 +16,92 @@ import (
 	"github.com/buger/jsonparser"
 	"github.com/gorilla/websocket"
 	"github.com/soulmachine/coinsignal/config"
-	"github.com/soulmachine/coinsignal/pojo"
-	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/parser"
+	"github.com/soulmachine/coinsignal/sink"
 	"github.com/soulmachine/coinsignal/utils"
 )
 
+const CMC_LISTING_URL = "https://api.coinmarketcap.com/data-api/v3/cryptocurrency/listing"
+const CMC_STREAM_URL = "wss://stream.coinmarketcap.com/price/latest"
+
+type options struct {
+	listing_url string
+	stream_url  string
+	limit       int
+}
+
 type currencyId struct {
 	Id       int64
 	Currency string
 }
 
 // CoinMarketCap top cryptocurrencies
-func fetch_cmc_top(limit int) []currencyId {
-	url := fmt.Sprintf("https://api.coinmarketcap.com/data-api/v3/cryptocurrency/listing?start=1&limit=%v&sortBy=market_cap&sortType=desc&convert=USD&cryptoType=all&tagType=all&audited=false", limit)
+func fetch_cmc_top(listing_url string, limit int) ([]currencyId, error) {
+	url := fmt.Sprintf("%s?start=1&limit=%v&sortBy=market_cap&sortType=desc&convert=USD&cryptoType=all&tagType=all&audited=false", listing_url, limit)
 	client := &http.Client{Timeout: 10 * time.Second}
 	req, _ := http.NewRequest("GET", url, nil)
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	body, _ := ioutil.ReadAll(resp.Body)
 
 	arr := make([]currencyId, 0)
-	jsonparser.ArrayEach(body, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-		id, err := jsonparser.GetInt(value, "id")
-		if err != nil {
-			panic(err)
+	_, err = jsonparser.ArrayEach(body, func(value []byte, dataType jsonparser.ValueType, offset int, _ error) {
+		id, e := jsonparser.GetInt(value, "id")
+		if e != nil {
+			err = e
+			return
 		}
-		symbol, err := jsonparser.GetString(value, "symbol")
-		if err != nil {
-			panic(err)
+		symbol, e := jsonparser.GetString(value, "symbol")
+		if e != nil {
+			err = e
+			return
 		}
 		arr = append(arr, currencyId{Id: id, Currency: symbol})
 	}, "data", "cryptoCurrencyList")
-	return arr
+	return arr, err
 }
 
-func subscribe_ids(ids []int64, stopCh <-chan struct{}, outCh chan<- []byte) {
-	client, _, err := websocket.DefaultDialer.Dial("wss://stream.coinmarketcap.com/price/latest", nil)
+func subscribe_ids(stream_url string, ids []int64, stopCh <-chan struct{}, outCh chan<- []byte) error {
+	client, _, err := websocket.DefaultDialer.Dial(stream_url, nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	command := fmt.Sprintf("{\"method\":\"subscribe\",\"id\":\"price\",\"data\":{\"cryptoIds\":%s,\"index\":null}}", strings.Join(strings.Split(fmt.Sprint(ids), " "), ","))
 	// command := "{\"method\":\"subscribe\",\"id\":\"price\",\"data\":{\"cryptoIds\":[1],\"index\":null}}"
 	err = client.WriteMessage(websocket.TextMessage, []byte(command))
 	if err != nil {
-		log.Fatalln("Subscription failed: ", err)
+		client.Close()
+		return fmt.Errorf("Subscription failed: %v", err)
 	}
 
+	go func() {
+		<-stopCh
+		client.Close()
+	}()
 	go func() {
 		for {
+			_, json_bytes, err := client.ReadMessage()
+			if err != nil {
+				select {
+				case <-stopCh:
+					return
+				default:
+					panic(err)
+				}
+			}
 			select {
+			case outCh <- json_bytes:
 			case <-stopCh:
-				client.Close()
 				return
-			default:
-				_, json_bytes, err := client.ReadMessage()
-				if err != nil {
-					panic(err)
-				}
-				outCh <- json_bytes
 			}
 		}
 	}()
+	return nil
 }
 
 func min(a, b int) int {
@@ -93,41 +112,18 @@ func min(a, b int) int {
 	}
 }
 
-func main() {
-	ctx := context.Background()
-
-	data_dir := os.Getenv("DATA_DIR")
-	redis_url := os.Getenv("REDIS_URL")
-	if len(data_dir) == 0 && len(redis_url) == 0 {
-		log.Fatal("Both DATA_DIR and REDIS_URL are empty")
-	}
-
-	var rf *utils.RollingFile
-	if len(data_dir) == 0 {
-		log.Println("The DATA_DIR environment variable is empty")
-		rf = nil
-	} else {
-		rf = utils.NewRollingFile(data_dir, "cmc.prices")
-	}
-
-	var publisher *pubsub.Publisher
-	if len(redis_url) == 0 {
-		publisher = nil
-		log.Println("The REDIS_URL environment variable is empty")
-	} else {
-		utils.WaitRedis(ctx, redis_url)
-		publisher = pubsub.NewPublisher(ctx, redis_url)
-	}
-
-	// catch Ctrl+C
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+// run streams prices of the top opts.limit currencies until ctx is cancelled.
+func run(ctx context.Context, router *sink.Router, opts options) error {
 	stopCh := make(chan struct{})
+	defer close(stopCh)
 
 	msgCh := make(chan []byte)
 
 	currencyMap := make(map[int64]string)
-	currencyIds := fetch_cmc_top(5000)
+	currencyIds, err := fetch_cmc_top(opts.listing_url, opts.limit)
+	if err != nil {
+		return err
+	}
 	for _, x := range currencyIds {
 		currencyMap[x.Id] = x.Currency
 	}
@@ -139,19 +135,17 @@ func main() {
 		for _, id := range chunk {
 			ids = append(ids, id.Id)
 		}
-		subscribe_ids(ids, stopCh, msgCh)
+		if err := subscribe_ids(opts.stream_url, ids, stopCh, msgCh); err != nil {
+			return err
+		}
 	}
 
 	for {
 		select {
-		case <-signals:
-			log.Println("Ctrl+C detected, exiting...")
-			close(stopCh)
-			time.Sleep(time.Second) // give some time for other goroutines to stop
-			return
+		case <-ctx.Done():
+			return nil
 		case json_bytes := <-msgCh:
 			idStr, _, _, _ := jsonparser.Get(json_bytes, "d", "cr", "id")
-			priceStr, _, _, _ := jsonparser.Get(json_bytes, "d", "cr", "p")
 
 			id, _ := strconv.ParseInt(string(idStr), 0, 64)
 			currency, ok := currencyMap[id]
@@ -162,23 +156,39 @@ func main() {
 
 			// Add currency
 			json_bytes, _ = jsonparser.Set(json_bytes, []byte("\""+currency+"\""), "d", "cr", "c")
-			if rf != nil {
-				rf.Write(string(json_bytes) + "\n")
-			}
-
-			price, _ := strconv.ParseFloat(string(priceStr), 64)
+			router.Write("cmc.prices", string(json_bytes))
 
-			currency_price := &pojo.CurrencyPrice{
-				Currency: currency,
-				Price:    price,
+			currency_price, err := parser.ParseCmcPrice(json_bytes)
+			if err != nil {
+				log.Println(err)
+				break
 			}
 			json_bytes, _ = json.Marshal(currency_price)
-			if publisher != nil {
-				publisher.Publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, string(json_bytes))
-			}
+			router.Write(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, string(json_bytes))
 		}
 	}
+}
 
-	// rf.Close()
-	// publisher.Close()
+func main() {
+	// catch Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	router, err := sink.NewRouterFromEnv(ctx, "cmc_price_crawler")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer router.Close()
+	// thousands of prices per second, cap the size of segments too
+	router.SetFileOptions("cmc.prices", utils.RollingFileOptions{Interval: 15 * time.Minute, MaxBytes: 256 * 1024 * 1024})
+
+	err = run(ctx, router, options{
+		listing_url: CMC_LISTING_URL,
+		stream_url:  CMC_STREAM_URL,
+		limit:       5000,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Ctrl+C detected, exiting...")
 }
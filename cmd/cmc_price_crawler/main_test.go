@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/sink"
+	"github.com/soulmachine/coinsignal/testutil"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+func TestRun(t *testing.T) {
+	_, redis_url := testutil.NewRedis(t)
+	data_dir := t.TempDir()
+	t.Setenv("DATA_DIR", data_dir)
+	cmc := testutil.NewCMCServer(t, map[int64]string{1: "BTC", 1027: "ETH"})
+	// 52 is not in the listing and must be ignored
+	stream_url := testutil.NewCMCStreamServer(t, map[int64]float64{1: 61000.5, 1027: 3800.25, 52: 1.1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router, err := sink.NewRouterFromEnv(ctx, "cmc_price_crawler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := testutil.Collect(t, redis_url, config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL)
+
+	done := make(chan error)
+	go func() {
+		done <- run(ctx, router, options{
+			listing_url: cmc.URL + "/data-api/v3/cryptocurrency/listing",
+			stream_url:  stream_url,
+			limit:       10,
+		})
+	}()
+
+	prices := make(map[string]float64)
+	for i := 0; i < 2; i++ {
+		envelope := struct {
+			Payload pojo.CurrencyPrice `json:"payload"`
+		}{}
+		if err := json.Unmarshal([]byte(testutil.Receive(t, msgs, 5*time.Second)), &envelope); err != nil {
+			t.Fatal(err)
+		}
+		prices[envelope.Payload.Currency] = envelope.Payload.Price
+	}
+	if prices["BTC"] != 61000.5 || prices["ETH"] != 3800.25 {
+		t.Errorf("unexpected prices %v", prices)
+	}
+
+	// raw messages are archived with the currency added
+	testutil.Eventually(t, 5*time.Second, func() bool {
+		bytes, _ := ioutil.ReadFile(utils.ActivePath(data_dir, "cmc.prices"))
+		return strings.Count(string(bytes), "\n") == 2 && strings.Contains(string(bytes), `"c":"ETH"`)
+	})
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/buger/jsonparser"
@@ -17,84 +19,81 @@ import (
 	"github.com/soulmachine/coinsignal/config"
 	"github.com/soulmachine/coinsignal/pojo"
 	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/sink"
 	"github.com/soulmachine/coinsignal/utils"
 )
 
+const ETHERSCAN_API_URL = "https://api.etherscan.io/api"
+
+type options struct {
+	full_node_url     string
+	etherscan_url     string
+	etherscan_api_key string
+	retry_delay       time.Duration // Etherscan allows a few requests per second
+}
+
 // return ETH number
-func fetchBlockReward(blockNumber int64) float64 {
-	etherscan_api_key := os.Getenv("ETHERSCAN_API_KEY")
-	url := fmt.Sprintf("https://api.etherscan.io/api?module=block&action=getblockreward&blockno=%d&apikey=%s", blockNumber, etherscan_api_key)
+func fetchBlockReward(blockNumber int64, opts options) (float64, error) {
+	url := fmt.Sprintf("%s?module=block&action=getblockreward&blockno=%d&apikey=%s", opts.etherscan_url, blockNumber, opts.etherscan_api_key)
 
 	for i := 0; i < 3; i++ {
-		time.Sleep(5 * time.Second)
+		time.Sleep(opts.retry_delay)
 		resp, err := http.Get(url)
 		if err != nil {
-			log.Fatalln(err)
+			return 0, err
 		}
-		defer resp.Body.Close()
 		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 
 		message, _, _, _ := jsonparser.Get(body, "message")
 		blockRewardStr, _, _, _ := jsonparser.Get(body, "result", "blockReward")
 		if string(message) == "OK" {
 			blockReward, _ := strconv.ParseUint(string(blockRewardStr), 10, 64)
-			return float64(blockReward) / 1000000000000000000
+			return float64(blockReward) / 1000000000000000000, nil
 		}
 	}
 
-	return 2.25926 // default value, see https://bitinfocharts.com/ethereum/
+	return 2.25926, nil // default value, see https://bitinfocharts.com/ethereum/
 }
 
-func main() {
-	ctx := context.Background()
-
-	full_node_url := os.Getenv("FULL_NODE_URL")
-	if len(full_node_url) == 0 {
-		log.Fatal("The FULL_NODE_URL environment variable is empty")
-	}
-	if len(os.Getenv("ETHERSCAN_API_KEY")) == 0 {
-		log.Fatal("The ETHERSCAN_API_KEY environment variable is empty")
-	}
-
-	data_dir := os.Getenv("DATA_DIR")
-	var rf *utils.RollingFile
-	if len(data_dir) == 0 {
-		log.Println("The DATA_DIR environment variable is empty")
-		rf = nil
-	} else {
-		rf = utils.NewRollingFile(data_dir, "eth.block_header")
-	}
-
-	redis_url := os.Getenv("REDIS_URL")
-	if len(redis_url) == 0 {
-		log.Fatal("The REDIS_URL environment variable is empty")
-	}
-	utils.WaitRedis(ctx, redis_url)
-	rdb := utils.NewRedisClient(redis_url)
+// run publishes every new block header until ctx is cancelled.
+func run(ctx context.Context, router *sink.Router, redis_url string, opts options) error {
+	prices := make(chan pojo.CurrencyPrice)
+	subscriber := pubsub.NewTypedSubscriber(ctx, redis_url,
+		config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, pubsub.JSONCodec{},
+		func(currency_price pojo.CurrencyPrice) {
+			select {
+			case prices <- currency_price:
+			case <-ctx.Done():
+			}
+		},
+		nil, // log decode errors
+	)
+	subscriber.EnableSnapshot() // get the ETH price right away
+	go subscriber.Run()
+	defer subscriber.Close()
 
-	client, err := ethclient.Dial(full_node_url)
+	client, err := ethclient.Dial(opts.full_node_url)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer client.Close()
 
 	headers := make(chan *types.Header)
-	sub, err := client.SubscribeNewHead(context.Background(), headers)
+	sub, err := client.SubscribeNewHead(ctx, headers)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer sub.Unsubscribe()
 
-	publisher := pubsub.NewPublisher(ctx, redis_url)
-	pubsub := rdb.Subscribe(ctx,
-		config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL,
-	)
 	var ethPrice float64
 	for {
 		select {
+		case <-ctx.Done():
+			return nil
 		case err := <-sub.Err():
-			log.Fatal(err)
-		case msg := <-pubsub.Channel():
-			currency_price := pojo.CurrencyPrice{}
-			json.Unmarshal([]byte(msg.Payload), &currency_price)
+			return err
+		case currency_price := <-prices:
 			if currency_price.Currency == "ETH" {
 				ethPrice = currency_price.Price
 			}
@@ -103,7 +102,10 @@ func main() {
 
 			blockNumberBytes, _, _, _ := jsonparser.Get(json_bytes, "number")
 			blockNumber, _ := strconv.ParseInt(string(blockNumberBytes), 0, 64)
-			blockReward := fetchBlockReward(blockNumber)
+			blockReward, err := fetchBlockReward(blockNumber, opts)
+			if err != nil {
+				return err
+			}
 
 			blockRewardUSD := blockReward * ethPrice
 
@@ -123,14 +125,49 @@ func main() {
 			json_bytes, _ = jsonparser.Set(json_bytes, []byte(strconv.FormatInt(timestamp, 10)), "timestamp")
 
 			if ethPrice > 0.0 {
-				publisher.Publish(config.REDIS_TOPIC_ETH_BLOCK_HEADER, string(json_bytes))
-				if rf != nil {
-					rf.Write(string(json_bytes) + "\n")
-				}
+				router.Write(config.REDIS_TOPIC_ETH_BLOCK_HEADER, string(json_bytes))
+				router.Write("eth.block_header", string(json_bytes))
 			}
 		}
 	}
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	full_node_url := os.Getenv("FULL_NODE_URL")
+	if len(full_node_url) == 0 {
+		log.Fatal("The FULL_NODE_URL environment variable is empty")
+	}
+	etherscan_api_key := os.Getenv("ETHERSCAN_API_KEY")
+	if len(etherscan_api_key) == 0 {
+		log.Fatal("The ETHERSCAN_API_KEY environment variable is empty")
+	}
 
-	// publisher.Close()
-	// rf.Close()
+	redis_url := os.Getenv("REDIS_URL")
+	if len(redis_url) == 0 {
+		log.Fatal("The REDIS_URL environment variable is empty")
+	}
+	// prices come from Redis, so file-only mode makes no sense here
+	if err := utils.WaitRedis(ctx, redis_url, utils.DEFAULT_REDIS_WAIT_OPTIONS); err != nil {
+		log.Fatal(err)
+	}
+	router, err := sink.NewRouterFromEnv(ctx, "crawler_block_header")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer router.Close()
+	// a few blocks a minute, roll hourly
+	router.SetFileOptions("eth.block_header", utils.RollingFileOptions{Interval: time.Hour})
+
+	err = run(ctx, router, redis_url, options{
+		full_node_url:     full_node_url,
+		etherscan_url:     ETHERSCAN_API_URL,
+		etherscan_api_key: etherscan_api_key,
+		retry_delay:       5 * time.Second,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/sink"
+	"github.com/soulmachine/coinsignal/testutil"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+func TestRun(t *testing.T) {
+	_, redis_url := testutil.NewRedis(t)
+	data_dir := t.TempDir()
+	t.Setenv("DATA_DIR", data_dir)
+	etherscan := testutil.NewEtherscanServer(t, "2000000000000000000")
+	node := testutil.NewEthNode(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the ETH price is known before the crawler starts, through the snapshot
+	publisher := pubsub.NewPublisher(ctx, redis_url)
+	defer publisher.Close()
+	publisher.Publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"ETH","price":4000}`)
+
+	router, err := sink.NewRouterFromEnv(ctx, "crawler_block_header")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := testutil.Collect(t, redis_url, config.REDIS_TOPIC_ETH_BLOCK_HEADER)
+
+	done := make(chan error)
+	go func() {
+		done <- run(ctx, router, redis_url, options{
+			full_node_url:     node.URL,
+			etherscan_url:     etherscan.URL,
+			etherscan_api_key: "test",
+		})
+	}()
+	testutil.Eventually(t, 5*time.Second, func() bool { return node.Subscribers() > 0 })
+
+	// headers are dropped until the ETH price arrives, so keep sending
+	var msg string
+	for i := int64(13000000); len(msg) == 0; i++ {
+		node.NewHead(testutil.NewHeader(i))
+		select {
+		case msg = <-msgs:
+		case <-time.After(100 * time.Millisecond):
+		}
+		if i > 13000050 {
+			t.Fatal("No block header published")
+		}
+	}
+
+	envelope := struct {
+		Payload pojo.BlockHeader `json:"payload"`
+	}{}
+	if err := json.Unmarshal([]byte(msg), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	header := envelope.Payload
+	if header.Number < 13000000 || header.GasLimit != 30000000 || header.GasUsed != 15000000 || header.Timestamp != 1634533200 {
+		t.Errorf("unexpected header %+v", header)
+	}
+	if header.Reward != 2 || header.RewardUSD != 8000 {
+		t.Errorf("unexpected reward %v, %v", header.Reward, header.RewardUSD)
+	}
+
+	testutil.Eventually(t, 5*time.Second, func() bool {
+		bytes, _ := ioutil.ReadFile(utils.ActivePath(data_dir, "eth.block_header"))
+		return strings.Contains(string(bytes), `"reward_usd":8000`)
+	})
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,28 +6,21 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/buger/jsonparser"
 	"github.com/soulmachine/coinsignal/config"
-	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/parser"
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/sink"
 	"github.com/soulmachine/coinsignal/utils"
 )
 
-// price in Wei
-type GasPriceMsg struct {
-	Rapid     uint64  `json:"rapid"`
-	Fast      uint64  `json:"fast"`
-	Standard  uint64  `json:"standard"`
-	Slow      uint64  `json:"slow"`
-	Timestamp int64   `json:"timestamp"`
-	PriceUSD  float64 `json:"priceUSD"`
-}
+const GASNOW_URL = "https://etherchain.org/api/gasnow"
 
-func fetch_gas_price(rf *utils.RollingFile) *GasPriceMsg {
-	url := "https://etherchain.org/api/gasnow"
+func fetch_gas_price(router *sink.Router, url string) *pojo.GasPriceMsg {
 	client := &http.Client{Timeout: 10 * time.Second}
 	req, _ := http.NewRequest("GET", url, nil)
 
@@ -42,73 +35,51 @@ func fetch_gas_price(rf *utils.RollingFile) *GasPriceMsg {
 	if err != nil {
 		return nil
 	}
-	if rf != nil {
-		rf.Write(strings.TrimSpace(string(body)) + "\n")
-	}
-
-	data, _, _, err := jsonparser.Get(body, "data")
-	if err != nil {
-		log.Println(err)
-		return nil
-	}
+	router.Write("gasnow.gas_price", strings.TrimSpace(string(body)))
 
-	msg := GasPriceMsg{}
-	err = json.Unmarshal(data, &msg)
+	msg, err := parser.ParseGasPrice(body)
 	if err != nil {
 		log.Println(err)
 		return nil
-	} else {
-		return &msg
 	}
+	return msg
 }
 
-func main() {
-	ctx := context.Background()
-
-	data_dir := os.Getenv("DATA_DIR")
-	redis_url := os.Getenv("REDIS_URL")
-	if len(data_dir) == 0 && len(redis_url) == 0 {
-		log.Fatal("Both DATA_DIR and REDIS_URL are empty")
-	}
-
-	var rf *utils.RollingFile
-	if len(data_dir) == 0 {
-		log.Println("The DATA_DIR environment variable is empty")
-		rf = nil
-	} else {
-		rf = utils.NewRollingFile(data_dir, "gasnow.gas_price")
-	}
-
-	var publisher *pubsub.Publisher
-	if len(redis_url) == 0 {
-		publisher = nil
-		log.Println("The REDIS_URL environment variable is empty")
-	} else {
-		utils.WaitRedis(ctx, redis_url)
-		publisher = pubsub.NewPublisher(ctx, redis_url)
-	}
-
-	ticker := time.NewTicker(5 * time.Second) // check every 15 seconds
+// run polls url every interval until ctx is cancelled.
+func run(ctx context.Context, router *sink.Router, url string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		gas_price := fetch_gas_price(rf)
-		if gas_price != nil {
-			bytes, err := json.Marshal(gas_price)
-			if err != nil {
-				panic(err)
-			} else {
-				if publisher != nil {
-					publisher.Publish(config.REDIS_TOPIC_ETH_GAS_PRICE, string(bytes))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			gas_price := fetch_gas_price(router, url)
+			if gas_price != nil {
+				bytes, err := json.Marshal(gas_price)
+				if err != nil {
+					return err
 				}
+				router.Write(config.REDIS_TOPIC_ETH_GAS_PRICE, string(bytes))
 			}
 		}
 	}
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	if rf != nil {
-		rf.Close()
+	router, err := sink.NewRouterFromEnv(ctx, "crawler_gas_price")
+	if err != nil {
+		log.Fatal(err)
 	}
-	if publisher != nil {
-		publisher.Close()
+	defer router.Close()
+	// a tiny response every 5 seconds, roll hourly
+	router.SetFileOptions("gasnow.gas_price", utils.RollingFileOptions{Interval: time.Hour})
+
+	if err := run(ctx, router, GASNOW_URL, 5*time.Second); err != nil { // check every 5 seconds
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/sink"
+	"github.com/soulmachine/coinsignal/testutil"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+func TestRun(t *testing.T) {
+	_, redis_url := testutil.NewRedis(t)
+	data_dir := t.TempDir()
+	t.Setenv("DATA_DIR", data_dir)
+	gasnow := testutil.NewGasnowServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router, err := sink.NewRouterFromEnv(ctx, "crawler_gas_price")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := testutil.Collect(t, redis_url, config.REDIS_TOPIC_ETH_GAS_PRICE)
+
+	done := make(chan error)
+	go func() { done <- run(ctx, router, gasnow.URL, 10*time.Millisecond) }()
+
+	envelope := struct {
+		Payload pojo.GasPriceMsg `json:"payload"`
+	}{}
+	if err := json.Unmarshal([]byte(testutil.Receive(t, msgs, 5*time.Second)), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	expected := pojo.GasPriceMsg{Rapid: 60000000000, Fast: 50000000000, Standard: 40000000000, Slow: 30000000000, Timestamp: 1634533200000, PriceUSD: 3800.5}
+	if envelope.Payload != expected {
+		t.Errorf("got %+v, expected %+v", envelope.Payload, expected)
+	}
+
+	// the raw response is archived as is
+	testutil.Eventually(t, 5*time.Second, func() bool {
+		bytes, _ := ioutil.ReadFile(utils.ActivePath(data_dir, "gasnow.gas_price"))
+		return strings.HasPrefix(string(bytes), testutil.GASNOW_GAS_PRICE+"\n")
+	})
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,13 +5,16 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/buger/jsonparser"
+	"github.com/go-redis/redis/v8"
 	"github.com/soulmachine/coinsignal/config"
 	"github.com/soulmachine/coinsignal/pojo"
-	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/sink"
 	"github.com/soulmachine/coinsignal/utils"
 )
 
@@ -20,26 +23,31 @@ type MarkPriceRaw struct {
 	Price  string `json:"p"`
 }
 
-func main() {
-	ctx := context.Background()
-
-	redis_url := os.Getenv("REDIS_URL")
-	if len(redis_url) == 0 {
-		log.Fatal("The REDIS_URL environment variable is empty")
-	}
-	utils.WaitRedis(ctx, redis_url)
-
+// run converts Binance mark prices into currency prices until ctx is cancelled.
+func run(ctx context.Context, router *sink.Router, redis_url string) error {
 	rdb := utils.NewRedisClient(redis_url)
-	publisher := pubsub.NewPublisher(ctx, redis_url)
+	defer rdb.Close()
 
 	pubsub := rdb.Subscribe(ctx,
 		config.REDIS_TOPIC_FUNDING_RATE,
 	)
+	defer pubsub.Close()
 
 	// Consume messages.
-	for msg := range pubsub.Channel() {
+	ch := pubsub.Channel()
+	for {
+		var msg *redis.Message
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg = <-ch:
+		}
+
 		raw_msg := pojo.CarbonbotMessage{}
-		json.Unmarshal([]byte(msg.Payload), &raw_msg)
+		if err := json.Unmarshal([]byte(msg.Payload), &raw_msg); err != nil {
+			log.Println(err)
+			continue
+		}
 		if raw_msg.Exchange != "binance" {
 			continue
 		}
@@ -49,7 +57,7 @@ func main() {
 
 		var mark_prices_raw []MarkPriceRaw
 		if err := json.Unmarshal(data, &mark_prices_raw); err != nil {
-			panic(err)
+			return err
 		}
 
 		for _, mark_price_raw := range mark_prices_raw {
@@ -69,10 +77,30 @@ func main() {
 			}
 
 			json_bytes, _ := json.Marshal(currency_price)
-			publisher.Publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, string(json_bytes))
+			router.Write(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, string(json_bytes))
 		}
 	}
+}
 
-	pubsub.Close()
-	publisher.Close()
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	redis_url := os.Getenv("REDIS_URL")
+	if len(redis_url) == 0 {
+		log.Fatal("The REDIS_URL environment variable is empty")
+	}
+	if err := utils.WaitRedis(ctx, redis_url, utils.DEFAULT_REDIS_WAIT_OPTIONS); err != nil {
+		log.Fatal(err)
+	}
+
+	router, err := sink.NewRouterFromEnv(ctx, "mark_price")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer router.Close()
+
+	if err := run(ctx, router, redis_url); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/sink"
+	"github.com/soulmachine/coinsignal/testutil"
+)
+
+func TestRun(t *testing.T) {
+	server, redis_url := testutil.NewRedis(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router, err := sink.NewRouterFromEnv(ctx, "mark_price")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := testutil.Collect(t, redis_url, config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL)
+
+	done := make(chan error)
+	go func() { done <- run(ctx, router, redis_url) }()
+	testutil.WaitSubscribers(t, server, config.REDIS_TOPIC_FUNDING_RATE, 1)
+
+	okex, _ := json.Marshal(pojo.CarbonbotMessage{Exchange: "okex", Json: `{"data":[{"s":"BTCUSDT","p":"1"}]}`})
+	server.Publish(config.REDIS_TOPIC_FUNDING_RATE, string(okex))
+	binance, _ := json.Marshal(pojo.CarbonbotMessage{
+		Exchange:    "binance",
+		MarketType:  "linear_swap",
+		MessageType: "funding_rate",
+		Json:        `{"stream":"!markPrice@arr","data":[{"s":"BTCUSDT","p":"61000.5"},{"s":"ETHUSD_PERP","p":"3800.25"},{"s":"BTCUSDC","p":"61000"}]}`,
+	})
+	server.Publish(config.REDIS_TOPIC_FUNDING_RATE, string(binance))
+
+	expected := []pojo.CurrencyPrice{{Currency: "BTC", Price: 61000.5}, {Currency: "ETH", Price: 3800.25}}
+	for _, x := range expected {
+		envelope := struct {
+			Payload pojo.CurrencyPrice `json:"payload"`
+		}{}
+		if err := json.Unmarshal([]byte(testutil.Receive(t, msgs, 5*time.Second)), &envelope); err != nil {
+			t.Fatal(err)
+		}
+		if envelope.Payload != x {
+			t.Errorf("got %+v, expected %+v", envelope.Payload, x)
+		}
+	}
+	select {
+	case msg := <-msgs:
+		t.Errorf("unexpected message %s", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
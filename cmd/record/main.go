@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/sink"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+// Recorded by default
+const DEFAULT_RECORD_CHANNELS = config.REDIS_TOPIC_PREFIX + "*"
+
+// Consumer group of the recorder in stream mode
+const RECORD_CONSUMER_GROUP = "record"
+
+func isPattern(channel string) bool {
+	return strings.ContainsAny(channel, "*?[")
+}
+
+func recorded(channel, payload string) string {
+	msg := json.RawMessage(payload)
+	if !json.Valid(msg) {
+		msg, _ = json.Marshal(payload)
+	}
+	json_bytes, _ := json.Marshal(pojo.RecordedMessage{
+		Channel:    channel,
+		ReceivedAt: time.Now().UnixMilli(),
+		Msg:        msg,
+	})
+	return string(json_bytes)
+}
+
+// run records channels into output until ctx is cancelled, each channel is
+// written to the topic of the same name.
+func run(ctx context.Context, output sink.Sink, redis_url string, channels []string, mode string) error {
+	rdb := utils.NewRedisClient(redis_url)
+	defer rdb.Close()
+
+	if mode == config.REDIS_MODE_STREAM {
+		return runStream(ctx, output, rdb, channels)
+	}
+
+	exact := make([]string, 0)
+	patterns := make([]string, 0)
+	for _, channel := range channels {
+		if isPattern(channel) {
+			patterns = append(patterns, channel)
+		} else {
+			exact = append(exact, channel)
+		}
+	}
+	sub := rdb.Subscribe(ctx)
+	defer sub.Close()
+	if len(exact) > 0 {
+		if err := sub.Subscribe(ctx, exact...); err != nil {
+			return err
+		}
+	}
+	if len(patterns) > 0 {
+		if err := sub.PSubscribe(ctx, patterns...); err != nil {
+			return err
+		}
+	}
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-ch:
+			output.Write(msg.Channel, recorded(msg.Channel, msg.Payload))
+		}
+	}
+}
+
+// Streams can't be subscribed by pattern, so patterns are expanded to the
+// streams existing at startup.
+func expandStreams(ctx context.Context, rdb redis.UniversalClient, channels []string) ([]string, error) {
+	streams := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, channel := range channels {
+		if !isPattern(channel) {
+			if !seen[channel] {
+				seen[channel] = true
+				streams = append(streams, channel)
+			}
+			continue
+		}
+		iter := rdb.ScanType(ctx, 0, channel, 100, "stream").Iterator()
+		for iter.Next(ctx) {
+			if !seen[iter.Val()] {
+				seen[iter.Val()] = true
+				streams = append(streams, iter.Val())
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return streams, nil
+}
+
+func runStream(ctx context.Context, output sink.Sink, rdb redis.UniversalClient, channels []string) error {
+	streams, err := expandStreams(ctx, rdb, channels)
+	if err != nil {
+		return err
+	}
+	if len(streams) == 0 {
+		log.Printf("No stream matches %s\n", strings.Join(channels, ","))
+		<-ctx.Done()
+		return nil
+	}
+	for _, stream := range streams {
+		// Resume from the last acknowledged entry after a restart
+		err := rdb.XGroupCreateMkStream(ctx, stream, RECORD_CONSUMER_GROUP, "$").Err()
+		if err != nil && !strings.Contains(err.Error(), "BUSYGROUP") {
+			return err
+		}
+	}
+
+	consumer, _ := os.Hostname()
+	// "0" re-reads entries recorded but never acknowledged, ">" new ones
+	last_ids := make(map[string]string)
+	for _, stream := range streams {
+		last_ids[stream] = "0"
+	}
+	for ctx.Err() == nil {
+		args := make([]string, 0, 2*len(streams))
+		args = append(args, streams...)
+		for _, stream := range streams {
+			args = append(args, last_ids[stream])
+		}
+		result, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    RECORD_CONSUMER_GROUP,
+			Consumer: consumer,
+			Streams:  args,
+			Count:    1000,
+			Block:    5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			for _, stream := range streams {
+				last_ids[stream] = ">"
+			}
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Println(err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, stream := range result {
+			if last_ids[stream.Stream] != ">" && len(stream.Messages) == 0 {
+				last_ids[stream.Stream] = ">"
+			}
+			ids := make([]string, 0, len(stream.Messages))
+			for _, msg := range stream.Messages {
+				payload, _ := msg.Values[pubsub.STREAM_FIELD].(string)
+				output.Write(stream.Stream, recorded(stream.Stream, payload))
+				ids = append(ids, msg.ID)
+				if last_ids[stream.Stream] != ">" {
+					last_ids[stream.Stream] = msg.ID
+				}
+			}
+			if len(ids) > 0 {
+				if err := rdb.XAck(ctx, stream.Stream, RECORD_CONSUMER_GROUP, ids...).Err(); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	data_dir := os.Getenv("DATA_DIR")
+	if len(data_dir) == 0 {
+		log.Fatal("The DATA_DIR environment variable is empty")
+	}
+	redis_url := os.Getenv("REDIS_URL")
+	if len(redis_url) == 0 {
+		log.Fatal("The REDIS_URL environment variable is empty")
+	}
+	channels := strings.Split(DEFAULT_RECORD_CHANNELS, ",")
+	if env := os.Getenv("RECORD_CHANNELS"); len(env) > 0 {
+		channels = strings.Split(env, ",")
+	}
+
+	if err := utils.WaitRedis(ctx, redis_url, utils.DEFAULT_REDIS_WAIT_OPTIONS); err != nil {
+		log.Fatal(err)
+	}
+	output := sink.NewFileSink(data_dir)
+	defer output.Close()
+	if admin, err := sink.NewAdminServerFromEnv(data_dir, "record", output); err != nil {
+		log.Println(err)
+	} else {
+		defer admin.Close()
+	}
+
+	if err := run(ctx, output, redis_url, channels, pubsub.RedisMode()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/sink"
+	"github.com/soulmachine/coinsignal/testutil"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+func readRecorded(data_dir, file_name string) []pojo.RecordedMessage {
+	file, err := os.Open(utils.ActivePath(data_dir, file_name))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	msgs := make([]pojo.RecordedMessage, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		msg := pojo.RecordedMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err == nil {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+func TestRun(t *testing.T) {
+	server, redis_url := testutil.NewRedis(t)
+	data_dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- run(ctx, sink.NewFileSink(data_dir), redis_url, []string{DEFAULT_RECORD_CHANNELS, "other"}, config.REDIS_MODE_PUBSUB)
+	}()
+	testutil.Eventually(t, 5*time.Second, func() bool { return server.PubSubNumPat() == 1 })
+	testutil.WaitSubscribers(t, server, "other", 1)
+
+	publisher := pubsub.NewPublisherWithMode(ctx, redis_url, config.REDIS_MODE_PUBSUB)
+	defer publisher.Close()
+	started := time.Now().UnixMilli()
+	publisher.Publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"BTC","price":61000.5}`)
+	server.Publish("other", "not json")
+	server.Publish("ignored", "{}")
+
+	var prices []pojo.RecordedMessage
+	testutil.Eventually(t, 5*time.Second, func() bool {
+		prices = readRecorded(data_dir, "carbonbot.misc.currency_price_channel")
+		return len(prices) == 1
+	})
+	if prices[0].Channel != config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL || prices[0].ReceivedAt < started {
+		t.Errorf("unexpected %+v", prices[0])
+	}
+	// recorded with the envelope
+	envelope := pojo.Envelope{}
+	if err := json.Unmarshal(prices[0].Msg, &envelope); err != nil || string(envelope.Payload) != `{"currency":"BTC","price":61000.5}` {
+		t.Errorf("unexpected message %s", prices[0].Msg)
+	}
+
+	var others []pojo.RecordedMessage
+	testutil.Eventually(t, 5*time.Second, func() bool {
+		others = readRecorded(data_dir, "other")
+		return len(others) == 1
+	})
+	if string(others[0].Msg) != `"not json"` {
+		t.Errorf("unexpected message %s", others[0].Msg)
+	}
+	if _, err := os.Stat(utils.ActivePath(data_dir, "ignored")); err == nil {
+		t.Error("recorded a channel not subscribed")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunStream(t *testing.T) {
+	server, redis_url := testutil.NewRedis(t)
+	data_dir := t.TempDir()
+	// the stream must exist for the pattern to match it
+	server.XAdd(config.REDIS_TOPIC_ETH_GAS_PRICE, "*", []string{pubsub.STREAM_FIELD, "before"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- run(ctx, sink.NewFileSink(data_dir), redis_url, []string{DEFAULT_RECORD_CHANNELS}, config.REDIS_MODE_STREAM)
+	}()
+
+	rdb := utils.NewRedisClient(redis_url)
+	defer rdb.Close()
+	testutil.Eventually(t, 5*time.Second, func() bool {
+		groups, _ := rdb.XInfoGroups(ctx, config.REDIS_TOPIC_ETH_GAS_PRICE).Result()
+		return len(groups) == 1
+	})
+	rdb.XAdd(ctx, &redis.XAddArgs{Stream: config.REDIS_TOPIC_ETH_GAS_PRICE, Values: []string{pubsub.STREAM_FIELD, `{"fast":1}`}})
+
+	var msgs []pojo.RecordedMessage
+	testutil.Eventually(t, 10*time.Second, func() bool {
+		msgs = readRecorded(data_dir, "carbonbot.misc.eth_gas_price")
+		return len(msgs) == 1
+	})
+	if msgs[0].Channel != config.REDIS_TOPIC_ETH_GAS_PRICE || string(msgs[0].Msg) != `{"fast":1}` {
+		t.Errorf("unexpected %+v", msgs[0])
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/soulmachine/coinsignal/archive"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/parser"
+	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/sink"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+// The topic fed by an archive
+type topic struct {
+	name    string
+	convert func(record *archive.Record) (string, error) // to the published message
+}
+
+var topics = map[string]topic{
+	"cmc.global_metrics": {config.REDIS_TOPIC_CMC_GLOBAL_METRICS, func(record *archive.Record) (string, error) { return parser.ParseCmcGlobalMetrics(record.Line) }},
+	"cmc.prices":         {config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, marshal},
+	"eth.block_header":   {config.REDIS_TOPIC_ETH_BLOCK_HEADER, func(record *archive.Record) (string, error) { return string(record.Line), nil }},
+	"gasnow.gas_price":   {config.REDIS_TOPIC_ETH_GAS_PRICE, marshal},
+}
+
+func marshal(record *archive.Record) (string, error) {
+	json_bytes, err := json.Marshal(record.Value)
+	return string(json_bytes), err
+}
+
+type options struct {
+	dir   string
+	names []string
+	from  time.Time
+	to    time.Time
+	speed float64 // 1 for the original pacing, 0 for as fast as possible
+}
+
+type record struct {
+	at    time.Time
+	topic string
+	msg   string
+}
+
+// stream reads the records of one archive across its segments, in order.
+type stream struct {
+	topic  topic
+	reader *archive.Reader
+	head   *record
+}
+
+func newStream(ctx context.Context, dir, name string, from, to time.Time) (*stream, error) {
+	topic, ok := topics[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown archive %s", name)
+	}
+	reader, err := archive.NewReader(ctx, archive.NewDirSource(dir), name, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &stream{topic: topic, reader: reader}, nil
+}
+
+// next returns the next record, or nil at the end of the archive.
+func (s *stream) next(ctx context.Context) (*record, error) {
+	for {
+		r, err := s.reader.Next(ctx)
+		if err != nil || r == nil {
+			return nil, err
+		}
+		msg, err := s.topic.convert(r)
+		if err != nil {
+			log.Printf("Skipped a malformed line of %s: %v\n", s.topic.name, err)
+			continue
+		}
+		return &record{r.Time, s.topic.name, msg}, nil
+	}
+}
+
+func (s *stream) close() {
+	s.reader.Close()
+}
+
+// run republishes the archives in opts.dir, merged in time order.
+func run(ctx context.Context, output sink.Sink, opts options) (int, error) {
+	streams := make([]*stream, 0, len(opts.names))
+	defer func() {
+		for _, s := range streams {
+			s.close()
+		}
+	}()
+	for _, name := range opts.names {
+		s, err := newStream(ctx, opts.dir, name, opts.from, opts.to)
+		if err != nil {
+			return 0, err
+		}
+		streams = append(streams, s)
+	}
+
+	count := 0
+	var first time.Time
+	var started time.Time
+	for {
+		// pick the earliest head among all archives
+		var earliest *stream
+		for _, s := range streams {
+			if s.head == nil {
+				head, err := s.next(ctx)
+				if err != nil {
+					return count, err
+				}
+				s.head = head
+			}
+			if s.head != nil && (earliest == nil || s.head.at.Before(earliest.head.at)) {
+				earliest = s
+			}
+		}
+		if earliest == nil {
+			return count, nil
+		}
+		r := earliest.head
+		earliest.head = nil
+
+		if r.at.Before(opts.from) || !r.at.Before(opts.to) {
+			continue
+		}
+		if count == 0 {
+			first = r.at
+			started = time.Now()
+		}
+		if opts.speed > 0 {
+			due := started.Add(time.Duration(float64(r.at.Sub(first)) / opts.speed))
+			if delay := time.Until(due); delay > 0 {
+				select {
+				case <-ctx.Done():
+					return count, nil
+				case <-time.After(delay):
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return count, nil
+		default:
+		}
+		output.Write(r.topic, r.msg)
+		count++
+	}
+}
+
+// parseTime accepts RFC3339, or a local date with optional hours and minutes.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("invalid time " + s)
+}
+
+func archiveNames() []string {
+	names := make([]string, 0, len(topics))
+	for name := range topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newOutput publishes to Redis, batching if there is no pacing to keep.
+// Replayed messages are older than the live ones, so the snapshots are left
+// untouched.
+func newOutput(ctx context.Context, redis_url string, speed float64) sink.Sink {
+	publisher := pubsub.NewPublisher(ctx, redis_url)
+	publisher.DisableSnapshot()
+	if speed == 0 {
+		return sink.NewRedisSink(pubsub.NewBatchPublisher(publisher, sink.DEFAULT_BATCH_WINDOW, 1000))
+	}
+	return sink.NewRedisSink(publisher)
+}
+
+func main() {
+	dir := flag.String("dir", os.Getenv("DATA_DIR"), "directory of archives, searched recursively")
+	names := flag.String("archives", strings.Join(archiveNames(), ","), "comma-separated archives to replay")
+	from := flag.String("from", "", "start time, RFC3339 or local 2006-01-02T15:04 (default: the oldest archive)")
+	to := flag.String("to", "", "end time, exclusive (default: now)")
+	speed := flag.Float64("speed", 1, "speed-up of the original pacing, 0 for as fast as possible")
+	flag.Parse()
+
+	opts := options{dir: *dir, names: strings.Split(*names, ","), to: time.Now(), speed: *speed}
+	if len(opts.dir) == 0 {
+		log.Fatal("Either -dir or the DATA_DIR environment variable must be set")
+	}
+	if opts.speed < 0 {
+		log.Fatal("-speed must not be negative")
+	}
+	var err error
+	if len(*from) > 0 {
+		if opts.from, err = parseTime(*from); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(*to) > 0 {
+		if opts.to, err = parseTime(*to); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	redis_url := os.Getenv("REDIS_URL")
+	if len(redis_url) == 0 {
+		log.Fatal("The REDIS_URL environment variable is empty")
+	}
+	if err := utils.WaitRedis(ctx, redis_url, utils.DEFAULT_REDIS_WAIT_OPTIONS); err != nil {
+		log.Fatal(err)
+	}
+	output := newOutput(ctx, redis_url, opts.speed)
+	defer output.Close()
+
+	count, err := run(ctx, output, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Replayed %d messages\n", count)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/testutil"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+type written struct {
+	topic string
+	msg   string
+}
+
+type recordingSink struct {
+	mutex sync.Mutex
+	msgs  []written
+}
+
+func (sink *recordingSink) Write(topic, msg string) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.msgs = append(sink.msgs, written{topic, msg})
+}
+
+func (sink *recordingSink) Close() {}
+
+func writeSegment(t *testing.T, dir, name string, rolled time.Time, lines []string, compress bool) {
+	file_path := path.Join(dir, name+".myhost."+rolled.UTC().Format(utils.SEGMENT_TIME_LAYOUT)+".json")
+	content := []byte(strings.Join(lines, "\n") + "\n")
+	if !compress {
+		if err := os.WriteFile(file_path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	file, err := os.Create(file_path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := gzip.NewWriter(file)
+	writer.Write(content)
+	writer.Close()
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2021, 10, 18, 6, 0, 0, 0, time.Local)
+	writeSegment(t, dir, "cmc.prices", base.Add(15*time.Minute), []string{
+		`{"d":{"cr":{"id":1,"p":61000.5,"c":"BTC"},"t":"` + milli(base.Add(time.Minute)) + `"},"s":"0"}`,
+		`{"d":{"cr":{"id":1027,"p":3800.25,"c":"ETH"},"t":"` + milli(base.Add(3*time.Minute)) + `"},"s":"0"}`,
+	}, false)
+	// already compressed by the uploader
+	writeSegment(t, dir, "gasnow.gas_price", base.Add(15*time.Minute), []string{
+		strings.Replace(testutil.GASNOW_GAS_PRICE, "1634533200000", milli(base.Add(2*time.Minute)), 1),
+	}, true)
+	// outside of the range
+	writeSegment(t, dir, "cmc.prices", base.Add(45*time.Minute), []string{
+		`{"d":{"cr":{"id":1,"p":62000,"c":"BTC"},"t":"` + milli(base.Add(40*time.Minute)) + `"},"s":"0"}`,
+	}, false)
+
+	output := &recordingSink{}
+	count, err := run(context.Background(), output, options{
+		dir:   dir,
+		names: []string{"cmc.prices", "gasnow.gas_price"},
+		from:  base,
+		to:    base.Add(30 * time.Minute),
+		speed: 0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []written{
+		{config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"BTC","price":61000.5}`},
+		{config.REDIS_TOPIC_ETH_GAS_PRICE, `{"rapid":60000000000,"fast":50000000000,"standard":40000000000,"slow":30000000000,"timestamp":` + milli(base.Add(2*time.Minute)) + `,"priceUSD":3800.5}`},
+		{config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"ETH","price":3800.25}`},
+	}
+	if count != len(expected) || len(output.msgs) != len(expected) {
+		t.Fatalf("replayed %d messages: %v", count, output.msgs)
+	}
+	for i := range expected {
+		if output.msgs[i] != expected[i] {
+			t.Errorf("message %d is %v, expected %v", i, output.msgs[i], expected[i])
+		}
+	}
+}
+
+func TestRunPacing(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2021, 10, 18, 6, 0, 0, 0, time.Local)
+	writeSegment(t, dir, "eth.block_header", base.Add(15*time.Minute), []string{
+		`{"number":13440000,"timestamp":` + seconds(base) + `}`,
+		`{"number":13440001,"timestamp":` + seconds(base.Add(12*time.Second)) + `}`,
+	}, false)
+
+	opts := options{dir: dir, names: []string{"eth.block_header"}, to: base.Add(time.Hour), speed: 60}
+	started := time.Now()
+	count, err := run(context.Background(), &recordingSink{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 12 seconds at 60x
+	if elapsed := time.Since(started); count != 2 || elapsed < 200*time.Millisecond {
+		t.Errorf("replayed %d messages in %v", count, elapsed)
+	}
+
+	// cancelled while waiting for the second block
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	opts.speed = 1
+	count, err = run(ctx, &recordingSink{}, opts)
+	if err != nil || count != 1 {
+		t.Errorf("replayed %d messages, err %v", count, err)
+	}
+}
+
+// Replayed messages reach subscribers but leave the live snapshot unchanged.
+func TestReplaySnapshot(t *testing.T) {
+	_, redis_url := testutil.NewRedis(t)
+	t.Setenv("REDIS_MODE", config.REDIS_MODE_STREAM)
+	ctx := context.Background()
+	live := pubsub.NewPublisher(ctx, redis_url)
+	live.Publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"BTC","price":65000}`)
+	live.Close()
+	rdb := utils.NewRedisClient(redis_url)
+	defer rdb.Close()
+	snapshot_key := config.SnapshotKey(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL)
+	before, _ := rdb.HGetAll(ctx, snapshot_key).Result()
+
+	dir := t.TempDir()
+	base := time.Date(2021, 10, 18, 6, 0, 0, 0, time.Local)
+	writeSegment(t, dir, "cmc.prices", base.Add(15*time.Minute), []string{
+		`{"d":{"cr":{"id":1,"p":61000.5,"c":"BTC"},"t":"` + milli(base.Add(time.Minute)) + `"},"s":"0"}`,
+		`{"d":{"cr":{"id":1027,"p":3800.25,"c":"ETH"},"t":"` + milli(base.Add(3*time.Minute)) + `"},"s":"0"}`,
+	}, false)
+	for _, speed := range []float64{0, 1000} {
+		output := newOutput(ctx, redis_url, speed)
+		count, err := run(ctx, output, options{dir: dir, names: []string{"cmc.prices"}, from: base, to: base.Add(30 * time.Minute), speed: speed})
+		output.Close()
+		if err != nil || count != 2 {
+			t.Fatalf("replayed %d messages, err %v", count, err)
+		}
+	}
+
+	if n, _ := rdb.XLen(ctx, config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL).Result(); n != 5 {
+		t.Errorf("%d messages published", n)
+	}
+	after, _ := rdb.HGetAll(ctx, snapshot_key).Result()
+	if len(before) != 1 || !reflect.DeepEqual(after, before) {
+		t.Errorf("the snapshot changed from %v to %v", before, after)
+	}
+}
+
+func milli(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+func seconds(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
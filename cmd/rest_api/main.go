@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+const DEFAULT_REST_API_ADDR = ":8081"
+
+// Data older than this is served with 503 Service Unavailable
+var MAX_AGE = map[string]time.Duration{
+	config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL: 5 * time.Minute,
+	config.REDIS_TOPIC_ETH_GAS_PRICE:          time.Minute,      // polled every 5 seconds
+	config.REDIS_TOPIC_ETH_BLOCK_HEADER:       5 * time.Minute,  // a block every 13 seconds or so
+	config.REDIS_TOPIC_CMC_GLOBAL_METRICS:     30 * time.Minute, // polled every 10 minutes
+}
+
+type response struct {
+	Data      interface{} `json:"data"`
+	UpdatedAt int64       `json:"updated_at,omitempty"` // milliseconds, when the producer published it
+	Age       int64       `json:"age_ms,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type latest struct {
+	data       interface{}
+	updated_at time.Time
+}
+
+type service struct {
+	max_age map[string]time.Duration
+
+	mutex  sync.RWMutex
+	prices map[string]latest
+	topics map[string]latest // the latest message of other topics
+}
+
+func newService() *service {
+	max_age := make(map[string]time.Duration)
+	for topic, age := range MAX_AGE {
+		max_age[topic] = age
+	}
+	return &service{
+		max_age: max_age,
+		prices:  make(map[string]latest),
+		topics:  make(map[string]latest),
+	}
+}
+
+// subscribe keeps the latest message of topic, timestamped by its envelope.
+func subscribe[T any](ctx context.Context, redis_url, topic string, store func(T, time.Time)) *pubsub.TypedSubscriber[T] {
+	var produced_at int64 // set right before each message
+	subscriber := pubsub.NewTypedSubscriber(ctx, redis_url, topic, pubsub.JSONCodec{}, func(msg T) {
+		updated_at := time.Now()
+		if produced_at > 0 {
+			updated_at = time.UnixMilli(produced_at)
+		}
+		produced_at = 0
+		store(msg, updated_at)
+	}, nil)
+	subscriber.OnEnvelope(func(envelope *pojo.Envelope) {
+		produced_at = envelope.ProducedAt
+	})
+	subscriber.EnableSnapshot() // serve right after a restart
+	go subscriber.Run()
+	return subscriber
+}
+
+func (s *service) storePrice(price pojo.CurrencyPrice, updated_at time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if previous, ok := s.prices[price.Currency]; !ok || !updated_at.Before(previous.updated_at) {
+		s.prices[price.Currency] = latest{price, updated_at}
+	}
+}
+
+func (s *service) storer(topic string) func(interface{}, time.Time) {
+	return func(data interface{}, updated_at time.Time) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if previous, ok := s.topics[topic]; !ok || !updated_at.Before(previous.updated_at) {
+			s.topics[topic] = latest{data, updated_at}
+		}
+	}
+}
+
+func (s *service) subscribeAll(ctx context.Context, redis_url string) []*pubsub.Subscriber {
+	gas_price := s.storer(config.REDIS_TOPIC_ETH_GAS_PRICE)
+	block_header := s.storer(config.REDIS_TOPIC_ETH_BLOCK_HEADER)
+	global_metrics := s.storer(config.REDIS_TOPIC_CMC_GLOBAL_METRICS)
+	return []*pubsub.Subscriber{
+		subscribe(ctx, redis_url, config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, s.storePrice).Subscriber,
+		subscribe(ctx, redis_url, config.REDIS_TOPIC_ETH_GAS_PRICE, func(msg pojo.GasPriceMsg, t time.Time) { gas_price(msg, t) }).Subscriber,
+		subscribe(ctx, redis_url, config.REDIS_TOPIC_ETH_BLOCK_HEADER, func(msg pojo.BlockHeader, t time.Time) { block_header(msg, t) }).Subscriber,
+		subscribe(ctx, redis_url, config.REDIS_TOPIC_CMC_GLOBAL_METRICS, func(msg json.RawMessage, t time.Time) { global_metrics(msg, t) }).Subscriber,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// reply serves value with its freshness, or 503 if it is missing or stale.
+func (s *service) reply(w http.ResponseWriter, topic string, value latest, ok bool) {
+	if !ok {
+		writeJSON(w, http.StatusServiceUnavailable, response{Error: "no data yet"})
+		return
+	}
+	age := time.Since(value.updated_at)
+	resp := response{Data: value.data, UpdatedAt: value.updated_at.UnixMilli(), Age: age.Milliseconds()}
+	if age > s.max_age[topic] {
+		resp.Error = "stale"
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *service) handlePrices(w http.ResponseWriter, r *http.Request) {
+	currency := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/v1/prices"))
+	currency = strings.Trim(currency, "/")
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(currency) > 0 {
+		value, ok := s.prices[currency]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, response{Error: "unknown currency " + currency})
+			return
+		}
+		s.reply(w, config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, value, true)
+		return
+	}
+
+	// All fresh prices, the list is stale if none is fresh
+	prices := make(map[string]float64)
+	var newest time.Time
+	for currency, value := range s.prices {
+		if time.Since(value.updated_at) <= s.max_age[config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL] {
+			prices[currency] = value.data.(pojo.CurrencyPrice).Price
+		}
+		if value.updated_at.After(newest) {
+			newest = value.updated_at
+		}
+	}
+	s.reply(w, config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, latest{prices, newest}, len(s.prices) > 0)
+}
+
+func (s *service) handleTopic(topic string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		value, ok := s.topics[topic]
+		s.reply(w, topic, value, ok)
+	}
+}
+
+func (s *service) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/prices", s.handlePrices)
+	mux.HandleFunc("/v1/prices/", s.handlePrices)
+	mux.HandleFunc("/v1/gas_price", s.handleTopic(config.REDIS_TOPIC_ETH_GAS_PRICE))
+	mux.HandleFunc("/v1/block_header", s.handleTopic(config.REDIS_TOPIC_ETH_BLOCK_HEADER))
+	mux.HandleFunc("/v1/global_metrics", s.handleTopic(config.REDIS_TOPIC_CMC_GLOBAL_METRICS))
+	return mux
+}
+
+// run serves the latest data on listener until ctx is cancelled.
+func run(ctx context.Context, redis_url string, listener net.Listener, s *service) error {
+	for _, subscriber := range s.subscribeAll(ctx, redis_url) {
+		defer subscriber.Close()
+	}
+
+	server := &http.Server{Handler: s.handler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	redis_url := os.Getenv("REDIS_URL")
+	if len(redis_url) == 0 {
+		log.Fatal("The REDIS_URL environment variable is empty")
+	}
+	addr := os.Getenv("REST_API_ADDR")
+	if len(addr) == 0 {
+		addr = DEFAULT_REST_API_ADDR
+	}
+	if err := utils.WaitRedis(ctx, redis_url, utils.DEFAULT_REDIS_WAIT_OPTIONS); err != nil {
+		log.Fatal(err)
+	}
+	// every instance serves all messages to its own clients
+	pubsub.FanOut()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := run(ctx, redis_url, listener, newService()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/testutil"
+)
+
+func get(t *testing.T, url string) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestRun(t *testing.T) {
+	server, redis_url := testutil.NewRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	publisher := pubsub.NewPublisherWithMode(ctx, redis_url, config.REDIS_MODE_PUBSUB)
+	defer publisher.Close()
+	// served from the snapshot
+	publisher.Publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"BTC","price":61000.5}`)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newService()
+	s.max_age[config.REDIS_TOPIC_ETH_GAS_PRICE] = 200 * time.Millisecond
+	done := make(chan error)
+	go func() { done <- run(ctx, redis_url, listener, s) }()
+	for _, topic := range config.REDIS_TOPICS {
+		testutil.WaitSubscribers(t, server, topic, 1)
+	}
+	base_url := "http://" + listener.Addr().String()
+
+	var status int
+	var body map[string]interface{}
+	testutil.Eventually(t, 5*time.Second, func() bool {
+		status, body = get(t, base_url+"/v1/prices/btc")
+		return status == http.StatusOK
+	})
+	if data := body["data"].(map[string]interface{}); data["price"] != 61000.5 || body["updated_at"] == nil {
+		t.Errorf("unexpected %v", body)
+	}
+	if status, _ := get(t, base_url+"/v1/prices/XYZ"); status != http.StatusNotFound {
+		t.Errorf("got %d for an unknown currency", status)
+	}
+	status, body = get(t, base_url+"/v1/prices")
+	if prices := body["data"].(map[string]interface{}); status != http.StatusOK || prices["BTC"] != 61000.5 {
+		t.Errorf("got %d %v", status, body)
+	}
+	if status, body := get(t, base_url+"/v1/block_header"); status != http.StatusServiceUnavailable || body["error"] != "no data yet" {
+		t.Errorf("got %d %v before any block header", status, body)
+	}
+
+	publisher.Publish(config.REDIS_TOPIC_ETH_GAS_PRICE, `{"rapid":60000000000,"fast":50000000000,"standard":40000000000,"slow":30000000000,"timestamp":1634533200000,"priceUSD":3800.5}`)
+	testutil.Eventually(t, 5*time.Second, func() bool {
+		status, body = get(t, base_url+"/v1/gas_price")
+		return status == http.StatusOK
+	})
+	if data := body["data"].(map[string]interface{}); data["fast"] != 5e10 {
+		t.Errorf("unexpected %v", body)
+	}
+	testutil.Eventually(t, 5*time.Second, func() bool {
+		status, body = get(t, base_url+"/v1/gas_price")
+		return status == http.StatusServiceUnavailable
+	})
+	if body["error"] != "stale" || body["data"] == nil {
+		t.Errorf("unexpected %v", body)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/soulmachine/coinsignal/registry"
+)
+
+// export writes one <topic>.schema.json per topic into dir, or all schemas
+// keyed by topic to stdout if dir is empty.
+func export(dir string) error {
+	if len(dir) == 0 {
+		schemas := make(map[string]interface{})
+		for _, topic := range registry.Topics() {
+			schemas[topic.Name] = topic.Schema()
+		}
+		bytes, err := json.MarshalIndent(schemas, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, topic := range registry.Topics() {
+		bytes, err := json.MarshalIndent(topic.Schema(), "", "  ")
+		if err != nil {
+			return err
+		}
+		file_name := strings.ReplaceAll(topic.Name, ":", ".") + ".schema.json"
+		if err := os.WriteFile(path.Join(dir, file_name), append(bytes, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	dir := flag.String("dir", "", "directory to write one schema file per topic into (default: print all to stdout)")
+	flag.Parse()
+
+	if err := export(*dir); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/soulmachine/coinsignal/upload"
+)
+
+const DEFAULT_UPLOAD_INTERVAL = 3 * time.Second
+
+const DEFAULT_AWS_S3_ENDPOINT_URL = "https://s3.amazonaws.com"
+
+// destinationsFromEnv reads DEST_DIR, AWS_S3_DIR and MINIO_DIR with their
+// credentials, at least one must be set.
+func destinationsFromEnv() ([]upload.Destination, error) {
+	part_size := uint64(upload.DEFAULT_PART_SIZE)
+	if env := os.Getenv("UPLOAD_PART_SIZE"); len(env) > 0 {
+		n, err := strconv.ParseUint(env, 10, 64)
+		if err != nil || n < 5*1024*1024 {
+			return nil, fmt.Errorf("invalid UPLOAD_PART_SIZE %s, at least 5MiB", env)
+		}
+		part_size = n
+	}
+
+	destinations := make([]upload.Destination, 0)
+	if dest_dir := os.Getenv("DEST_DIR"); len(dest_dir) > 0 {
+		if err := os.MkdirAll(dest_dir, 0755); err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, upload.NewDirDestination(dest_dir))
+	}
+	if s3_dir := os.Getenv("AWS_S3_DIR"); len(s3_dir) > 0 {
+		access_key, secret_key := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if len(access_key) == 0 || len(secret_key) == 0 {
+			return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+		}
+		endpoint := os.Getenv("AWS_S3_ENDPOINT_URL")
+		if len(endpoint) == 0 {
+			endpoint = DEFAULT_AWS_S3_ENDPOINT_URL
+		}
+		region := os.Getenv("AWS_REGION")
+		if len(region) == 0 {
+			region = "us-east-1"
+		}
+		dest, err := upload.NewS3Destination(endpoint, access_key, secret_key, region, s3_dir)
+		if err != nil {
+			return nil, err
+		}
+		dest.SetPartSize(part_size)
+		destinations = append(destinations, dest)
+	}
+	if minio_dir := os.Getenv("MINIO_DIR"); len(minio_dir) > 0 {
+		access_key, secret_key := os.Getenv("MINIO_ACCESS_KEY_ID"), os.Getenv("MINIO_SECRET_ACCESS_KEY")
+		endpoint := os.Getenv("MINIO_ENDPOINT_URL")
+		if len(access_key) == 0 || len(secret_key) == 0 || len(endpoint) == 0 {
+			return nil, fmt.Errorf("MINIO_ACCESS_KEY_ID, MINIO_SECRET_ACCESS_KEY and MINIO_ENDPOINT_URL must be set")
+		}
+		dest, err := upload.NewS3Destination(endpoint, access_key, secret_key, "", minio_dir)
+		if err != nil {
+			return nil, err
+		}
+		dest.SetPartSize(part_size)
+		destinations = append(destinations, dest)
+	}
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("at least one of DEST_DIR, AWS_S3_DIR or MINIO_DIR must be set")
+	}
+	return destinations, nil
+}
+
+// retentionFromEnv reads RETENTION_MAX_BYTES, RETENTION_MAX_AGE and
+// RETENTION_MIN_FREE_PERCENT. Uploaded files are kept locally only if
+// RETENTION_MAX_BYTES or RETENTION_MAX_AGE is set, otherwise they are
+// removed once uploaded and the free space limit doesn't matter.
+func retentionFromEnv() (upload.RetentionOptions, bool, error) {
+	opts := upload.DEFAULT_RETENTION_OPTIONS
+	keep_local := false
+	if env := os.Getenv("RETENTION_MAX_BYTES"); len(env) > 0 {
+		n, err := strconv.ParseInt(env, 10, 64)
+		if err != nil || n <= 0 {
+			return opts, false, fmt.Errorf("invalid RETENTION_MAX_BYTES %s", env)
+		}
+		opts.MaxBytes = n
+		keep_local = true
+	}
+	if env := os.Getenv("RETENTION_MAX_AGE"); len(env) > 0 {
+		d, err := time.ParseDuration(env)
+		if err != nil || d <= 0 {
+			return opts, false, fmt.Errorf("invalid RETENTION_MAX_AGE %s", env)
+		}
+		opts.MaxAge = d
+		keep_local = true
+	}
+	if env := os.Getenv("RETENTION_MIN_FREE_PERCENT"); len(env) > 0 {
+		f, err := strconv.ParseFloat(env, 64)
+		if err != nil || f < 0 || f >= 100 {
+			return opts, false, fmt.Errorf("invalid RETENTION_MIN_FREE_PERCENT %s", env)
+		}
+		opts.MinFreePercent = f
+	}
+	return opts, keep_local, nil
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	data_dir := os.Getenv("DATA_DIR")
+	if len(data_dir) == 0 {
+		log.Fatal("The DATA_DIR environment variable is empty")
+	}
+	destinations, err := destinationsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	interval := DEFAULT_UPLOAD_INTERVAL
+	if env := os.Getenv("UPLOAD_INTERVAL"); len(env) > 0 {
+		if interval, err = time.ParseDuration(env); err != nil || interval <= 0 {
+			log.Fatalf("Invalid UPLOAD_INTERVAL %s\n", env)
+		}
+	}
+
+	uploader, err := upload.NewUploader(data_dir, destinations)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if env := os.Getenv("UPLOAD_TRANSFERS"); len(env) > 0 {
+		transfers, err := strconv.Atoi(env)
+		if err != nil || transfers <= 0 {
+			log.Fatalf("Invalid UPLOAD_TRANSFERS %s\n", env)
+		}
+		uploader.SetTransfers(transfers)
+	}
+	retention, keep_local, err := retentionFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if keep_local {
+		uploader.SetRetention(retention)
+	}
+	uploader.Run(ctx, interval)
+}
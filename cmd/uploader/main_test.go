@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/upload"
+)
+
+func TestDestinationsFromEnv(t *testing.T) {
+	if _, err := destinationsFromEnv(); err == nil {
+		t.Error("no destination should be an error")
+	}
+
+	dest_dir := t.TempDir() + "/dest"
+	t.Setenv("DEST_DIR", dest_dir)
+	t.Setenv("MINIO_DIR", "minio://bucket/path")
+	t.Setenv("MINIO_ENDPOINT_URL", "http://127.0.0.1:9000")
+	if _, err := destinationsFromEnv(); err == nil || !strings.Contains(err.Error(), "MINIO_ACCESS_KEY_ID") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	t.Setenv("MINIO_ACCESS_KEY_ID", "key")
+	t.Setenv("MINIO_SECRET_ACCESS_KEY", "secret")
+	destinations, err := destinationsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(destinations) != 2 || destinations[0].Name() != dest_dir || destinations[1].Name() != "minio://bucket/path" {
+		t.Errorf("unexpected destinations %v", destinations)
+	}
+
+	t.Setenv("UPLOAD_PART_SIZE", "1024")
+	if _, err := destinationsFromEnv(); err == nil || !strings.Contains(err.Error(), "UPLOAD_PART_SIZE") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRetentionFromEnv(t *testing.T) {
+	opts, keep_local, err := retentionFromEnv()
+	if err != nil || keep_local || opts != upload.DEFAULT_RETENTION_OPTIONS {
+		t.Errorf("unexpected retention %+v %v %v", opts, keep_local, err)
+	}
+
+	// the free space limit alone doesn't keep uploaded files
+	t.Setenv("RETENTION_MIN_FREE_PERCENT", "20")
+	opts, keep_local, err = retentionFromEnv()
+	if err != nil || keep_local || opts.MinFreePercent != 20 {
+		t.Errorf("unexpected retention %+v %v %v", opts, keep_local, err)
+	}
+	t.Setenv("RETENTION_MIN_FREE_PERCENT", "")
+
+	t.Setenv("RETENTION_MAX_BYTES", "1073741824")
+	t.Setenv("RETENTION_MAX_AGE", "72h")
+	opts, keep_local, err = retentionFromEnv()
+	expected := upload.RetentionOptions{MaxBytes: 1 << 30, MaxAge: 72 * time.Hour, MinFreePercent: upload.DEFAULT_MIN_FREE_PERCENT}
+	if err != nil || !keep_local || opts != expected {
+		t.Errorf("unexpected retention %+v %v %v", opts, keep_local, err)
+	}
+
+	t.Setenv("RETENTION_MIN_FREE_PERCENT", "100")
+	if _, _, err := retentionFromEnv(); err == nil || !strings.Contains(err.Error(), "RETENTION_MIN_FREE_PERCENT") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
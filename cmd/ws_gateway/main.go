@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/gorilla/websocket"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+const DEFAULT_WS_GATEWAY_ADDR = ":8080"
+
+// Messages queued per client, a client falling further behind is disconnected.
+// A snapshot is queued as one, however many frames it has.
+const CLIENT_BUFFER_SIZE = 1024
+
+const (
+	writeTimeout = 10 * time.Second
+	pongTimeout  = 60 * time.Second
+	pingInterval = 30 * time.Second
+)
+
+// Sent by clients
+type command struct {
+	Op         string   `json:"op"` // subscribe or unsubscribe
+	Topic      string   `json:"topic"`
+	Currencies []string `json:"currencies,omitempty"` // only for topics with a snapshot field
+}
+
+// Sent to clients
+type frame struct {
+	Topic    string          `json:"topic,omitempty"`
+	Snapshot bool            `json:"snapshot,omitempty"` // part of the initial snapshot
+	Data     json.RawMessage `json:"data,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+type client struct {
+	conn *websocket.Conn
+	send chan [][]byte              // frames written together, such as a snapshot
+	subs map[string]map[string]bool // topic -> currencies, nil for all, guarded by gateway.mutex
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	})
+}
+
+// gateway fans out the messages of config.REDIS_TOPICS to WebSocket clients.
+type gateway struct {
+	buffer_size int
+	upgrader    websocket.Upgrader
+
+	mutex   sync.Mutex
+	latest  map[string]map[string][]byte // topic -> key -> payload
+	clients map[*client]bool
+}
+
+func newGateway(buffer_size int) *gateway {
+	latest := make(map[string]map[string][]byte)
+	for _, topic := range config.REDIS_TOPICS {
+		latest[topic] = make(map[string][]byte)
+	}
+	return &gateway{
+		buffer_size: buffer_size,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true }, // dashboards are served elsewhere
+		},
+		latest:  latest,
+		clients: make(map[*client]bool),
+	}
+}
+
+// Key of a message in the snapshot of its topic, such as the currency
+func snapshotKey(topic string, payload []byte) string {
+	if field, ok := config.REDIS_SNAPSHOT_FIELDS[topic]; ok {
+		key, _ := jsonparser.GetString(payload, field)
+		return key
+	}
+	return config.REDIS_SNAPSHOT_LATEST
+}
+
+func encodeFrame(topic string, payload []byte, snapshot bool) []byte {
+	data := json.RawMessage(payload)
+	if !json.Valid(data) {
+		data, _ = json.Marshal(string(payload))
+	}
+	bytes, _ := json.Marshal(frame{Topic: topic, Snapshot: snapshot, Data: data})
+	return bytes
+}
+
+// Must be called with gateway.mutex held. A client whose buffer is full is
+// disconnected rather than slowing down everyone else.
+func (gateway *gateway) enqueue(c *client, frames ...[]byte) {
+	select {
+	case c.send <- frames:
+	default:
+		log.Printf("Disconnecting %s, %d messages behind\n", remoteAddr(c), len(c.send))
+		delete(gateway.clients, c)
+		c.close()
+	}
+}
+
+func (gateway *gateway) publish(topic, payload string) {
+	key := snapshotKey(topic, []byte(payload))
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	if latest, ok := gateway.latest[topic]; ok {
+		latest[key] = []byte(payload)
+	}
+
+	var msg []byte
+	for c := range gateway.clients {
+		currencies, ok := c.subs[topic]
+		if !ok || (currencies != nil && !currencies[key]) {
+			continue
+		}
+		if msg == nil {
+			msg = encodeFrame(topic, []byte(payload), false)
+		}
+		gateway.enqueue(c, msg)
+	}
+}
+
+func (gateway *gateway) subscribe(c *client, topic string, currencies []string) {
+	var filter map[string]bool
+	if len(currencies) > 0 {
+		filter = make(map[string]bool)
+		for _, currency := range currencies {
+			filter[currency] = true
+		}
+	}
+
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	if !gateway.clients[c] {
+		return
+	}
+	c.subs[topic] = filter
+	// Queued under the lock, so no live message can overtake the snapshot,
+	// and as a single entry, so a large snapshot doesn't fill the buffer
+	frames := make([][]byte, 0, len(gateway.latest[topic]))
+	for key, payload := range gateway.latest[topic] {
+		if filter == nil || filter[key] {
+			frames = append(frames, encodeFrame(topic, payload, true))
+		}
+	}
+	if len(frames) > 0 {
+		gateway.enqueue(c, frames...)
+	}
+}
+
+func (gateway *gateway) unsubscribe(c *client, topic string) {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	delete(c.subs, topic)
+}
+
+func (gateway *gateway) remove(c *client) {
+	gateway.mutex.Lock()
+	delete(gateway.clients, c)
+	gateway.mutex.Unlock()
+	c.close()
+}
+
+func (gateway *gateway) reply(c *client, error_msg string) {
+	bytes, _ := json.Marshal(frame{Error: error_msg})
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	if gateway.clients[c] {
+		gateway.enqueue(c, bytes)
+	}
+}
+
+func remoteAddr(c *client) string {
+	if c.conn == nil {
+		return "client"
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+func (gateway *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := gateway.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader has replied already
+	}
+	c := &client{
+		conn: conn,
+		send: make(chan [][]byte, gateway.buffer_size),
+		subs: make(map[string]map[string]bool),
+		done: make(chan struct{}),
+	}
+	gateway.mutex.Lock()
+	gateway.clients[c] = true
+	gateway.mutex.Unlock()
+
+	go gateway.writeLoop(c)
+	gateway.readLoop(c)
+}
+
+func (gateway *gateway) readLoop(c *client) {
+	defer gateway.remove(c)
+	c.conn.SetReadLimit(64 * 1024)
+	c.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+	for {
+		_, bytes, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		cmd := command{}
+		if err := json.Unmarshal(bytes, &cmd); err != nil {
+			gateway.reply(c, "invalid command: "+err.Error())
+			continue
+		}
+		if _, ok := gateway.latest[cmd.Topic]; !ok {
+			gateway.reply(c, "unknown topic "+cmd.Topic)
+			continue
+		}
+		switch cmd.Op {
+		case "subscribe":
+			if _, ok := config.REDIS_SNAPSHOT_FIELDS[cmd.Topic]; !ok && len(cmd.Currencies) > 0 {
+				gateway.reply(c, cmd.Topic+" can't be filtered by currency")
+				continue
+			}
+			gateway.subscribe(c, cmd.Topic, cmd.Currencies)
+		case "unsubscribe":
+			gateway.unsubscribe(c, cmd.Topic)
+		default:
+			gateway.reply(c, "unknown op "+cmd.Op)
+		}
+	}
+}
+
+func (gateway *gateway) writeLoop(c *client) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	defer c.close()
+	for {
+		select {
+		case <-c.done:
+			return
+		case frames := <-c.send:
+			for _, msg := range frames {
+				c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+				if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+					return
+				}
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (gateway *gateway) closeAll() {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	for c := range gateway.clients {
+		delete(gateway.clients, c)
+		c.close()
+	}
+}
+
+// run serves WebSocket clients on listener until ctx is cancelled.
+func run(ctx context.Context, redis_url string, listener net.Listener, buffer_size int) error {
+	gateway := newGateway(buffer_size)
+	for _, topic := range config.REDIS_TOPICS {
+		topic := topic
+		subscriber := pubsub.NewSubscriber(ctx, redis_url, topic, func(msg string) {
+			gateway.publish(topic, msg)
+		})
+		subscriber.EnableSnapshot() // for clients connecting before the next update
+		go subscriber.Run()
+		defer subscriber.Close()
+	}
+
+	server := &http.Server{Handler: gateway}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		gateway.closeAll()
+	}()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	redis_url := os.Getenv("REDIS_URL")
+	if len(redis_url) == 0 {
+		log.Fatal("The REDIS_URL environment variable is empty")
+	}
+	addr := os.Getenv("WS_GATEWAY_ADDR")
+	if len(addr) == 0 {
+		addr = DEFAULT_WS_GATEWAY_ADDR
+	}
+	if err := utils.WaitRedis(ctx, redis_url, utils.DEFAULT_REDIS_WAIT_OPTIONS); err != nil {
+		log.Fatal(err)
+	}
+	// every instance serves all messages to its own clients
+	pubsub.FanOut()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := run(ctx, redis_url, listener, CLIENT_BUFFER_SIZE); err != nil {
+		log.Fatal(err)
+	}
+}
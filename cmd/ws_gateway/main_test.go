@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/testutil"
+)
+
+func readFrame(t *testing.T, conn *websocket.Conn) frame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	f := frame{}
+	if err := conn.ReadJSON(&f); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestRun(t *testing.T) {
+	server, redis_url := testutil.NewRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	publisher := pubsub.NewPublisherWithMode(ctx, redis_url, config.REDIS_MODE_PUBSUB)
+	defer publisher.Close()
+	publisher.Publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"BTC","price":61000.5}`)
+	publisher.Publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"ETH","price":3800.25}`)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- run(ctx, redis_url, listener, CLIENT_BUFFER_SIZE) }()
+	for _, topic := range config.REDIS_TOPICS {
+		testutil.WaitSubscribers(t, server, topic, 1)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(command{Op: "subscribe", Topic: "carbonbot:misc:unknown"})
+	if f := readFrame(t, conn); !strings.HasPrefix(f.Error, "unknown topic") {
+		t.Errorf("unexpected %+v", f)
+	}
+
+	// part of the snapshot, or a live message if the gateway is still loading it
+	conn.WriteJSON(command{Op: "subscribe", Topic: config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, Currencies: []string{"BTC"}})
+	f := readFrame(t, conn)
+	if f.Topic != config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL || string(f.Data) != `{"currency":"BTC","price":61000.5}` {
+		t.Errorf("unexpected snapshot %+v", f)
+	}
+
+	publisher.Publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"ETH","price":3801}`)
+	publisher.Publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"BTC","price":61001}`)
+	f = readFrame(t, conn)
+	if f.Snapshot || string(f.Data) != `{"currency":"BTC","price":61001}` {
+		t.Errorf("unexpected %+v", f)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	gateway := newGateway(2)
+	c := &client{
+		send: make(chan [][]byte, gateway.buffer_size),
+		subs: make(map[string]map[string]bool),
+		done: make(chan struct{}),
+	}
+	gateway.clients[c] = true
+	gateway.subscribe(c, config.REDIS_TOPIC_ETH_GAS_PRICE, nil)
+
+	// nobody drains c.send
+	for i := 0; i < 3; i++ {
+		gateway.publish(config.REDIS_TOPIC_ETH_GAS_PRICE, `{"fast":1}`)
+	}
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("the slow client is still connected")
+	}
+	if len(gateway.clients) != 0 {
+		t.Error("the slow client is still registered")
+	}
+
+	// the latest message is kept for the next snapshot
+	if latest := gateway.latest[config.REDIS_TOPIC_ETH_GAS_PRICE][config.REDIS_SNAPSHOT_LATEST]; string(latest) != `{"fast":1}` {
+		t.Errorf("unexpected snapshot %s", latest)
+	}
+}
+
+// A snapshot larger than the buffer doesn't disconnect the client.
+func TestLargeSnapshot(t *testing.T) {
+	gateway := newGateway(2)
+	for i := 0; i < 10; i++ {
+		gateway.publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"C`+strconv.Itoa(i)+`","price":1}`)
+	}
+	c := &client{
+		send: make(chan [][]byte, gateway.buffer_size),
+		subs: make(map[string]map[string]bool),
+		done: make(chan struct{}),
+	}
+	gateway.clients[c] = true
+	gateway.subscribe(c, config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, nil)
+	gateway.publish(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"C0","price":2}`)
+	select {
+	case <-c.done:
+		t.Fatal("the client was disconnected")
+	default:
+	}
+
+	// the snapshot, then the live message
+	if frames := <-c.send; len(frames) != 10 {
+		t.Errorf("the snapshot has %d frames", len(frames))
+	}
+	if frames := <-c.send; len(frames) != 1 || string(frames[0]) != string(encodeFrame(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, []byte(`{"currency":"C0","price":2}`), false)) {
+		t.Errorf("unexpected frames %q", frames)
+	}
+}
@@ -16,6 +16,11 @@ apps.push({
   exec_mode: "fork",
   instances: 1,
   restart_delay: 5000, // 5 seconds
+  env: {
+    // bursts of thousands of prices, send them in pipelines
+    REDIS_BATCH_SIZE: "1000",
+    REDIS_BATCH_WINDOW_MS: "100",
+  },
 });
 
 apps.push({
@@ -43,13 +48,27 @@ apps.push({
   exec_mode: "fork",
   instances: 1,
   restart_delay: 5000, // 5 seconds
+  env: {
+    // bursts of thousands of prices, send them in pipelines
+    REDIS_BATCH_SIZE: "1000",
+    REDIS_BATCH_WINDOW_MS: "100",
+  },
 });
 
 apps.push({
-  name: "upload",
-  script: "/usr/local/bin/upload.sh",
-  exec_interpreter: "bash",
-  exec_mode: "fork_mode",
+  name: "record",
+  script: "record",
+  exec_interpreter: "none",
+  exec_mode: "fork",
+  instances: 1,
+  restart_delay: 5000, // 5 seconds
+});
+
+apps.push({
+  name: "uploader",
+  script: "uploader",
+  exec_interpreter: "none",
+  exec_mode: "fork",
   instances: 1,
   restart_delay: 5000, // 5 seconds
 });
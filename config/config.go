@@ -6,3 +6,54 @@ const REDIS_TOPIC_CMC_GLOBAL_METRICS = REDIS_TOPIC_PREFIX + "cmc_global_metrics"
 const REDIS_TOPIC_CURRENCY_PRICE_CHANNEL = REDIS_TOPIC_PREFIX + "currency_price_channel"
 const REDIS_TOPIC_ETH_GAS_PRICE = REDIS_TOPIC_PREFIX + "eth_gas_price"
 const REDIS_TOPIC_FUNDING_RATE = "carbonbot:funding_rate"
+
+// Topics published by the crawlers in this repository
+var REDIS_TOPICS = []string{
+	REDIS_TOPIC_ETH_BLOCK_HEADER,
+	REDIS_TOPIC_CMC_GLOBAL_METRICS,
+	REDIS_TOPIC_CURRENCY_PRICE_CHANNEL,
+	REDIS_TOPIC_ETH_GAS_PRICE,
+}
+
+// Transports selectable by the REDIS_MODE environment variable
+const REDIS_MODE_PUBSUB = "pubsub" // fire-and-forget PUBLISH, the default
+const REDIS_MODE_STREAM = "stream" // XADD + consumer groups
+
+// Validation of messages against their schema in the topic registry,
+// selectable by the VALIDATE_MESSAGES environment variable
+const VALIDATE_OFF = "off"       // the default
+const VALIDATE_WARN = "warn"     // log invalid messages and pass them on
+const VALIDATE_STRICT = "strict" // log invalid messages and drop them
+
+// Approximate number of entries kept in each Redis stream in stream mode
+const REDIS_STREAM_DEFAULT_MAXLEN = 100000
+
+var REDIS_STREAM_MAXLEN = map[string]int64{
+	REDIS_TOPIC_ETH_BLOCK_HEADER:       10000,  // about one and a half days
+	REDIS_TOPIC_CMC_GLOBAL_METRICS:     1000,   // one week at 10 minutes per tick
+	REDIS_TOPIC_CURRENCY_PRICE_CHANNEL: 500000, // high volume, only a few minutes
+	REDIS_TOPIC_ETH_GAS_PRICE:          20000,  // one day at 5 seconds per tick
+}
+
+func StreamMaxLen(topic string) int64 {
+	if maxlen, ok := REDIS_STREAM_MAXLEN[topic]; ok {
+		return maxlen
+	}
+	return REDIS_STREAM_DEFAULT_MAXLEN
+}
+
+// The latest message of each carbonbot:misc:* topic is kept in a Redis hash,
+// one entry per value of the JSON field below, or a single entry named
+// REDIS_SNAPSHOT_LATEST if the topic isn't listed.
+const REDIS_SNAPSHOT_LATEST = "latest"
+
+var REDIS_SNAPSHOT_FIELDS = map[string]string{
+	REDIS_TOPIC_CURRENCY_PRICE_CHANNEL: "currency",
+}
+
+// SnapshotKey returns the name of the Redis hash holding the snapshot of topic.
+// The hash tag puts it in the slot of topic in a Redis Cluster, so that a
+// message and its snapshot entry are still written in one transaction.
+func SnapshotKey(topic string) string {
+	return "{" + topic + "}:snapshot"
+}
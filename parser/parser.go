@@ -0,0 +1,70 @@
+// Package parser converts raw data archived by the crawlers into the
+// messages published on Redis, so that archives can be replayed.
+package parser
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/buger/jsonparser"
+	"github.com/soulmachine/coinsignal/pojo"
+)
+
+// ParseCmcPrice parses a message from wss://stream.coinmarketcap.com/price/latest,
+// with the currency symbol added at d.cr.c by cmc_price_crawler.
+func ParseCmcPrice(json_bytes []byte) (*pojo.CurrencyPrice, error) {
+	currency, err := jsonparser.GetString(json_bytes, "d", "cr", "c")
+	if err != nil {
+		return nil, err
+	}
+	priceStr, _, _, err := jsonparser.Get(json_bytes, "d", "cr", "p")
+	if err != nil {
+		return nil, err
+	}
+	price, err := strconv.ParseFloat(string(priceStr), 64)
+	if err != nil {
+		return nil, err
+	}
+	return &pojo.CurrencyPrice{
+		Currency: currency,
+		Price:    price,
+	}, nil
+}
+
+// ParseCmcGlobalMetrics flattens the USD quote of a response from
+// /v1/global-metrics/quotes/latest into its data.
+func ParseCmcGlobalMetrics(body []byte) (string, error) {
+	data, _, _, err := jsonparser.Get(body, "data")
+	if err != nil {
+		return "", err
+	}
+
+	usd, _, _, _ := jsonparser.Get(data, "quote", "USD")
+	data = jsonparser.Delete(data, "quote")
+	last_updated, _, _, _ := jsonparser.Get(data, "last_updated")
+	data = jsonparser.Delete(data, "last_updated")
+
+	jsonparser.ObjectEach(usd, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		data, _ = jsonparser.Set(data, value, string(key))
+		return nil
+	})
+
+	last_updated = []byte("\"" + string(last_updated) + "\"")
+	data, _ = jsonparser.Set(data, last_updated, "last_updated") // TODO: workaround jsonparser/issues/218
+
+	return string(data), nil
+}
+
+// ParseGasPrice parses a response from https://etherchain.org/api/gasnow
+func ParseGasPrice(body []byte) (*pojo.GasPriceMsg, error) {
+	data, _, _, err := jsonparser.Get(body, "data")
+	if err != nil {
+		return nil, err
+	}
+
+	msg := pojo.GasPriceMsg{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
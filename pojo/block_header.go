@@ -7,6 +7,6 @@ type BlockHeader struct {
 	GasUsed   float64 `json:"gasUsed"`
 	Reward    float64 `json:"reward"`
 	RewardUSD float64 `json:"reward_usd"`
-	Slow      float64 `json:"slow"`
+	Slow      float64 `json:"slow" schema:"optional"`
 	Timestamp int64   `json:"timestamp"`
 }
@@ -0,0 +1,25 @@
+package pojo
+
+import "encoding/json"
+
+const ENVELOPE_VERSION = 1
+
+const ENCODING_BASE64 = "base64"
+
+// Envelope wraps every message published on carbonbot:misc:* topics.
+//
+// Seq starts from 1 for each topic whenever a producer starts, so a new
+// Session (the start time of the producer in milliseconds) resets it.
+//
+// Payload is the message itself if it is JSON, otherwise Encoding is
+// ENCODING_BASE64 and Payload is a JSON string of the base64 encoded bytes.
+type Envelope struct {
+	Producer   string          `json:"producer"`
+	Host       string          `json:"host"`
+	Session    int64           `json:"session"`
+	Seq        uint64          `json:"seq"`
+	ProducedAt int64           `json:"produced_at"`
+	Version    int             `json:"version"`
+	Encoding   string          `json:"encoding,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+}
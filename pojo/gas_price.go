@@ -0,0 +1,11 @@
+package pojo
+
+// price in Wei
+type GasPriceMsg struct {
+	Rapid     uint64  `json:"rapid"`
+	Fast      uint64  `json:"fast"`
+	Standard  uint64  `json:"standard"`
+	Slow      uint64  `json:"slow"`
+	Timestamp int64   `json:"timestamp"`
+	PriceUSD  float64 `json:"priceUSD"`
+}
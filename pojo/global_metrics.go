@@ -0,0 +1,18 @@
+package pojo
+
+// GlobalMetrics is the data of /v1/global-metrics/quotes/latest from
+// CoinMarketCap, with the USD quote flattened into it.
+type GlobalMetrics struct {
+	ActiveCryptocurrencies int     `json:"active_cryptocurrencies"`
+	TotalCryptocurrencies  int     `json:"total_cryptocurrencies,omitempty"`
+	ActiveMarketPairs      int     `json:"active_market_pairs,omitempty"`
+	ActiveExchanges        int     `json:"active_exchanges"`
+	TotalExchanges         int     `json:"total_exchanges,omitempty"`
+	BtcDominance           float64 `json:"btc_dominance"`
+	EthDominance           float64 `json:"eth_dominance"`
+	TotalMarketCap         float64 `json:"total_market_cap"`
+	TotalVolume24h         float64 `json:"total_volume_24h"`
+	AltcoinMarketCap       float64 `json:"altcoin_market_cap,omitempty"`
+	AltcoinVolume24h       float64 `json:"altcoin_volume_24h,omitempty"`
+	LastUpdated            string  `json:"last_updated"`
+}
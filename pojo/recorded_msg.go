@@ -0,0 +1,13 @@
+package pojo
+
+import "encoding/json"
+
+// RecordedMessage is a line of the files written by cmd/record.
+//
+// Msg is the message exactly as published if it is JSON, envelope included,
+// otherwise a JSON string.
+type RecordedMessage struct {
+	Channel    string          `json:"channel"`
+	ReceivedAt int64           `json:"received_at"` // milliseconds
+	Msg        json.RawMessage `json:"msg"`
+}
@@ -0,0 +1,128 @@
+package pubsub
+
+import (
+	"sync"
+	"time"
+)
+
+// BatchStats describes the batches sent so far by a BatchPublisher.
+type BatchStats struct {
+	Batches          uint64
+	Messages         uint64
+	LastBatchSize    int
+	MaxBatchSize     int
+	LastFlushLatency time.Duration // from the first message queued to the batch sent
+	MaxFlushLatency  time.Duration
+}
+
+// BatchPublisher collects messages for up to window or max_count messages,
+// whichever comes first, and sends them in one Redis pipeline.
+//
+// Messages are sent in the order of Publish calls, so the order within each
+// topic is preserved.
+type BatchPublisher struct {
+	publisher *Publisher
+	window    time.Duration
+	max_count int
+
+	mutex       sync.Mutex
+	pending     []message
+	first_at    time.Time // when the first pending message was queued
+	flush_mutex sync.Mutex
+	stats       BatchStats
+	stopCh      chan struct{}
+	done        sync.WaitGroup
+}
+
+func NewBatchPublisher(publisher *Publisher, window time.Duration, max_count int) *BatchPublisher {
+	if max_count < 1 {
+		max_count = 1
+	}
+	batch := &BatchPublisher{
+		publisher: publisher,
+		window:    window,
+		max_count: max_count,
+		pending:   make([]message, 0, max_count),
+		stopCh:    make(chan struct{}),
+	}
+
+	batch.done.Add(1)
+	go func() {
+		defer batch.done.Done()
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-batch.stopCh:
+				return
+			case <-ticker.C:
+				batch.Flush()
+			}
+		}
+	}()
+	return batch
+}
+
+func (batch *BatchPublisher) Publish(channel, msg string) {
+	if !valid(batch.publisher.validation, channel, msg) {
+		return
+	}
+	batch.mutex.Lock()
+	if len(batch.pending) == 0 {
+		batch.first_at = time.Now()
+	}
+	// seq and produced_at are assigned now rather than at flush time
+	batch.pending = append(batch.pending, batch.publisher.prepare(channel, msg))
+	full := len(batch.pending) >= batch.max_count
+	batch.mutex.Unlock()
+
+	if full {
+		batch.Flush()
+	}
+}
+
+// Flush sends all pending messages right away.
+func (batch *BatchPublisher) Flush() {
+	// Serialize flushes, otherwise two batches could overtake each other
+	batch.flush_mutex.Lock()
+	defer batch.flush_mutex.Unlock()
+
+	batch.mutex.Lock()
+	msgs := batch.pending
+	first_at := batch.first_at
+	batch.pending = make([]message, 0, batch.max_count)
+	batch.mutex.Unlock()
+
+	if len(msgs) == 0 {
+		return
+	}
+	batch.publisher.publishAll(msgs)
+	latency := time.Since(first_at)
+
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+	batch.stats.Batches++
+	batch.stats.Messages += uint64(len(msgs))
+	batch.stats.LastBatchSize = len(msgs)
+	if len(msgs) > batch.stats.MaxBatchSize {
+		batch.stats.MaxBatchSize = len(msgs)
+	}
+	batch.stats.LastFlushLatency = latency
+	if latency > batch.stats.MaxFlushLatency {
+		batch.stats.MaxFlushLatency = latency
+	}
+}
+
+func (batch *BatchPublisher) Stats() BatchStats {
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+	return batch.stats
+}
+
+// Close flushes pending messages and closes the underlying Publisher.
+func (batch *BatchPublisher) Close() {
+	close(batch.stopCh)
+	batch.done.Wait()
+	batch.Flush()
+	batch.publisher.Close()
+}
@@ -0,0 +1,107 @@
+package pubsub
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/testutil"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+func newBatchPublisher(t *testing.T, window time.Duration, max_count int) (*BatchPublisher, redis.UniversalClient) {
+	t.Helper()
+	_, redis_url := testutil.NewRedis(t)
+	batch := NewBatchPublisher(NewPublisherWithMode(context.Background(), redis_url, config.REDIS_MODE_STREAM), window, max_count)
+	rdb := utils.NewRedisClient(redis_url)
+	t.Cleanup(func() { rdb.Close() })
+	return batch, rdb
+}
+
+func publishN(batch *BatchPublisher, topic string, from, to int) {
+	for i := from; i < to; i++ {
+		batch.Publish(topic, `{"n":`+strconv.Itoa(i)+`}`)
+	}
+}
+
+func streamLen(rdb redis.UniversalClient, topic string) int64 {
+	n, _ := rdb.XLen(context.Background(), topic).Result()
+	return n
+}
+
+func TestBatchFlushBySize(t *testing.T) {
+	batch, rdb := newBatchPublisher(t, time.Hour, 3)
+	defer batch.Close()
+	topic := config.REDIS_TOPIC_PREFIX + "test"
+
+	publishN(batch, topic, 0, 2)
+	if n := streamLen(rdb, topic); n != 0 {
+		t.Fatalf("%d messages sent before the batch is full", n)
+	}
+	publishN(batch, topic, 2, 7)
+	if n := streamLen(rdb, topic); n != 6 {
+		t.Fatalf("%d messages sent, expected 2 batches", n)
+	}
+	stats := batch.Stats()
+	if stats.Batches != 2 || stats.Messages != 6 || stats.LastBatchSize != 3 || stats.MaxBatchSize != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// in the order published
+	entries, _ := rdb.XRange(context.Background(), topic, "-", "+").Result()
+	for i, entry := range entries {
+		msg, _ := entry.Values[STREAM_FIELD].(string)
+		if envelope := parseEnvelope(msg); envelope == nil || envelope.Seq != uint64(i+1) || string(envelope.Payload) != `{"n":`+strconv.Itoa(i)+`}` {
+			t.Errorf("entry %d is %s", i, msg)
+		}
+	}
+}
+
+func TestBatchFlushByWindow(t *testing.T) {
+	window := 50 * time.Millisecond
+	batch, rdb := newBatchPublisher(t, window, 100)
+	defer batch.Close()
+	topic := config.REDIS_TOPIC_PREFIX + "test"
+
+	publishN(batch, topic, 0, 2)
+	// the stats are updated once the batch is sent
+	testutil.Eventually(t, 5*time.Second, func() bool { return batch.Stats().Messages == 2 })
+	if n := streamLen(rdb, topic); n != 2 {
+		t.Fatalf("%d messages sent", n)
+	}
+	stats := batch.Stats()
+	if stats.Batches != 1 || stats.Messages != 2 || stats.LastBatchSize != 2 || stats.MaxBatchSize != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.LastFlushLatency <= 0 || stats.LastFlushLatency > 2*window+time.Second || stats.MaxFlushLatency != stats.LastFlushLatency {
+		t.Errorf("unexpected latency %+v", stats)
+	}
+
+	publishN(batch, topic, 2, 3)
+	testutil.Eventually(t, 5*time.Second, func() bool { return batch.Stats().Messages == 3 })
+	stats = batch.Stats()
+	if n := streamLen(rdb, topic); n != 3 || stats.Batches != 2 || stats.LastBatchSize != 1 || stats.MaxBatchSize != 2 || stats.MaxFlushLatency < stats.LastFlushLatency {
+		t.Errorf("unexpected stats %+v, %d messages sent", stats, n)
+	}
+}
+
+func TestBatchClose(t *testing.T) {
+	batch, rdb := newBatchPublisher(t, time.Hour, 100)
+	topic := config.REDIS_TOPIC_PREFIX + "test"
+	publishN(batch, topic, 0, 5)
+	if n := streamLen(rdb, topic); n != 0 {
+		t.Fatalf("%d messages sent before the window ends", n)
+	}
+
+	// pending messages are sent, not lost
+	batch.Close()
+	if n := streamLen(rdb, topic); n != 5 {
+		t.Errorf("%d messages sent on close", n)
+	}
+	if stats := batch.Stats(); stats.Batches != 1 || stats.Messages != 5 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
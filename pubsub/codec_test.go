@@ -0,0 +1,124 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/testutil"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodecs(t *testing.T) {
+	price := pojo.CurrencyPrice{Currency: "BTC", Price: 61000.5}
+	for _, codec := range []Codec{JSONCodec{}, MsgpackCodec{}} {
+		bytes, err := codec.Marshal(price)
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		decoded := pojo.CurrencyPrice{}
+		if err := codec.Unmarshal(bytes, &decoded); err != nil || !reflect.DeepEqual(decoded, price) {
+			t.Errorf("%s: decoded %+v, %v", codec.Name(), decoded, err)
+		}
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	codec := ProtobufCodec{}
+	bytes, err := codec.Marshal(wrapperspb.String("BTC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// into a message, or a pointer to a nil message pointer
+	decoded := &wrapperspb.StringValue{}
+	if err := codec.Unmarshal(bytes, decoded); err != nil || decoded.Value != "BTC" {
+		t.Errorf("decoded %v, %v", decoded, err)
+	}
+	var ptr *wrapperspb.StringValue
+	if err := codec.Unmarshal(bytes, &ptr); err != nil || ptr.GetValue() != "BTC" {
+		t.Errorf("decoded %v, %v", ptr, err)
+	}
+
+	if _, err := codec.Marshal("BTC"); err == nil {
+		t.Error("a string is not a protobuf message")
+	}
+	var s string
+	if err := codec.Unmarshal(bytes, &s); err == nil {
+		t.Error("a string is not a protobuf message")
+	}
+}
+
+// subscribeTyped returns what a TypedSubscriber of channel receives.
+func subscribeTyped[T any](t *testing.T, server *miniredis.Miniredis, redis_url, channel string, codec Codec) (<-chan T, <-chan error) {
+	t.Helper()
+	received := make(chan T, 1)
+	errs := make(chan error, 1)
+	subscriber := NewTypedSubscriber(context.Background(), redis_url, channel, codec, func(msg T) { received <- msg }, func(err error) { errs <- err })
+	t.Cleanup(subscriber.Close)
+	go subscriber.Run()
+	testutil.WaitSubscribers(t, server, channel, 1)
+	return received, errs
+}
+
+// Binary payloads travel base64 encoded in the envelope and are decoded for
+// the TypedSubscriber.
+func TestTypedSubscriber(t *testing.T) {
+	server, redis_url := testutil.NewRedis(t)
+	t.Setenv("REDIS_MODE", config.REDIS_MODE_PUBSUB)
+	publisher := NewPublisher(context.Background(), redis_url)
+	defer publisher.Close()
+
+	price := pojo.CurrencyPrice{Currency: "BTC", Price: 61000}
+	for _, codec := range []Codec{JSONCodec{}, MsgpackCodec{}} {
+		channel := config.REDIS_TOPIC_PREFIX + "typed-" + codec.Name()
+		received, _ := subscribeTyped[pojo.CurrencyPrice](t, server, redis_url, channel, codec)
+		raw := testutil.Collect(t, redis_url, channel)
+		if err := NewTypedPublisher[pojo.CurrencyPrice](publisher, channel, codec).Publish(price); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case decoded := <-received:
+			if !reflect.DeepEqual(decoded, price) {
+				t.Errorf("%s: decoded %+v", codec.Name(), decoded)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out", codec.Name())
+		}
+		envelope := parseEnvelope(testutil.Receive(t, raw, 5*time.Second))
+		if binary := codec.Name() == "msgpack"; envelope == nil || (envelope.Encoding == pojo.ENCODING_BASE64) != binary {
+			t.Errorf("%s: unexpected envelope %+v", codec.Name(), envelope)
+		}
+	}
+
+	channel := config.REDIS_TOPIC_PREFIX + "typed-protobuf"
+	received, _ := subscribeTyped[*wrapperspb.StringValue](t, server, redis_url, channel, ProtobufCodec{})
+	NewTypedPublisher[*wrapperspb.StringValue](publisher, channel, ProtobufCodec{}).Publish(wrapperspb.String("BTC"))
+	select {
+	case decoded := <-received:
+		if !proto.Equal(decoded, wrapperspb.String("BTC")) {
+			t.Errorf("protobuf: decoded %v", decoded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("protobuf: timed out")
+	}
+
+	// undecodable messages go to on_err
+	channel = config.REDIS_TOPIC_PREFIX + "typed-mismatch"
+	_, errs := subscribeTyped[pojo.CurrencyPrice](t, server, redis_url, channel, JSONCodec{})
+	NewTypedPublisher[pojo.CurrencyPrice](publisher, channel, MsgpackCodec{}).Publish(price)
+	select {
+	case err := <-errs:
+		decode_err := &DecodeError{}
+		if !errors.As(err, &decode_err) || decode_err.Codec != "json" || decode_err.Channel != channel {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the decode error")
+	}
+}
@@ -0,0 +1,61 @@
+package pubsub
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/soulmachine/coinsignal/config"
+)
+
+// Field name of the payload inside each stream entry
+const STREAM_FIELD = "msg"
+
+// RedisMode returns the transport selected by REDIS_MODE, pubsub by default.
+func RedisMode() string {
+	mode := os.Getenv("REDIS_MODE")
+	switch mode {
+	case "", config.REDIS_MODE_PUBSUB:
+		return config.REDIS_MODE_PUBSUB
+	case config.REDIS_MODE_STREAM:
+		return config.REDIS_MODE_STREAM
+	default:
+		log.Fatalf("Unknown REDIS_MODE %s, must be %s or %s", mode, config.REDIS_MODE_PUBSUB, config.REDIS_MODE_STREAM)
+		return ""
+	}
+}
+
+// Consumer group used when REDIS_CONSUMER_GROUP is unset, shared by all
+// instances of the binary unless FanOut was called.
+var default_group = filepath.Base(os.Args[0])
+
+// FanOut makes each instance of the binary receive every message in stream
+// mode, by defaulting the consumer group to the binary name and the hostname
+// instead of the binary name alone. Instances sharing a hostname still need
+// their own REDIS_CONSUMER_GROUP. Must be called before creating subscribers.
+func FanOut() {
+	if host, err := os.Hostname(); err == nil && len(host) > 0 {
+		default_group = filepath.Base(os.Args[0]) + "-" + host
+	}
+}
+
+// Consumer group used in stream mode, REDIS_CONSUMER_GROUP or default_group.
+func consumerGroup() string {
+	group := os.Getenv("REDIS_CONSUMER_GROUP")
+	if len(group) == 0 {
+		group = default_group
+	}
+	return group
+}
+
+// Consumer name used in stream mode, REDIS_CONSUMER_NAME or the hostname.
+func consumerName() string {
+	name := os.Getenv("REDIS_CONSUMER_NAME")
+	if len(name) == 0 {
+		name, _ = os.Hostname()
+	}
+	if len(name) == 0 {
+		name = consumerGroup()
+	}
+	return name
+}
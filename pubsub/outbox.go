@@ -0,0 +1,331 @@
+package pubsub
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Eviction policies applied when the outbox reaches its size cap
+const OUTBOX_DROP_OLDEST = "drop_oldest"
+const OUTBOX_DROP_NEWEST = "drop_newest"
+
+const outboxSuffix = ".outbox" // must not end with .json, otherwise the uploader picks it up
+
+// Longer lines make a segment unreadable
+var max_outbox_line = 64 * 1024 * 1024
+
+// Unreadable segments are renamed with this suffix and kept for inspection
+const corruptSuffix = ".corrupt"
+
+var ErrOutboxFull = errors.New("outbox is full")
+
+// Outbox is an on-disk FIFO queue of messages that couldn't be published.
+//
+// Messages are appended to numbered segment files, the oldest segment is
+// replayed first, and a segment is deleted once all its messages are sent.
+type Outbox struct {
+	dir           string
+	max_bytes     int64
+	segment_bytes int64
+	policy        string
+
+	mutex     sync.Mutex
+	segments  []string // oldest first, the last one is being appended to
+	sizes     map[string]int64
+	total     int64
+	next_id   uint64
+	file      *os.File // open handle of the last segment, nil if none
+	dropped   uint64
+	replaying bool // a Replay is running, see Queue
+}
+
+func NewOutbox(dir string, max_bytes int64, policy string) (*Outbox, error) {
+	if policy != OUTBOX_DROP_OLDEST && policy != OUTBOX_DROP_NEWEST {
+		return nil, fmt.Errorf("unknown outbox policy %s", policy)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segment_bytes := max_bytes / 8
+	if segment_bytes > 4*1024*1024 {
+		segment_bytes = 4 * 1024 * 1024
+	}
+	if segment_bytes < 1 {
+		segment_bytes = 1
+	}
+	outbox := &Outbox{
+		dir:           dir,
+		max_bytes:     max_bytes,
+		segment_bytes: segment_bytes,
+		policy:        policy,
+		sizes:         make(map[string]int64),
+	}
+
+	// Pick up messages left behind by a previous process
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), outboxSuffix) {
+			continue
+		}
+		var id uint64
+		if _, err := fmt.Sscanf(entry.Name(), "%020d"+outboxSuffix, &id); err != nil {
+			continue
+		}
+		outbox.segments = append(outbox.segments, entry.Name())
+		outbox.sizes[entry.Name()] = entry.Size()
+		outbox.total += entry.Size()
+		if id >= outbox.next_id {
+			outbox.next_id = id + 1
+		}
+	}
+	sort.Strings(outbox.segments)
+	if len(outbox.segments) > 0 {
+		log.Printf("Found %d bytes of unpublished messages in %s\n", outbox.total, dir)
+	}
+	return outbox, nil
+}
+
+// Empty returns true if there is nothing waiting to be replayed.
+func (outbox *Outbox) Empty() bool {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	return outbox.total == 0
+}
+
+// Dropped returns the number of messages lost to the eviction policy.
+func (outbox *Outbox) Dropped() uint64 {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	return outbox.dropped
+}
+
+func (outbox *Outbox) Push(channel, msg string) error {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	return outbox.push(channel, msg)
+}
+
+// Queue pushes msgs if older messages are waiting or being replayed, so that
+// msgs are sent after them, and returns false without pushing otherwise.
+func (outbox *Outbox) Queue(msgs []message) (bool, error) {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	if outbox.total == 0 && !outbox.replaying {
+		return false, nil
+	}
+	var first error
+	for _, msg := range msgs {
+		if err := outbox.push(msg.Channel, msg.Msg); err != nil && first == nil {
+			first = err
+		}
+	}
+	return true, first
+}
+
+func (outbox *Outbox) push(channel, msg string) error {
+	line, err := json.Marshal(message{channel, msg})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	size := int64(len(line))
+
+	for outbox.total+size > outbox.max_bytes {
+		if outbox.policy == OUTBOX_DROP_NEWEST || len(outbox.segments) == 0 {
+			outbox.dropped++
+			return ErrOutboxFull
+		}
+		if err := outbox.evictOldest(); err != nil {
+			return err
+		}
+	}
+
+	if outbox.file == nil || outbox.sizes[outbox.current()]+size > outbox.segment_bytes {
+		if err := outbox.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := outbox.file.Write(line); err != nil {
+		return err
+	}
+	outbox.sizes[outbox.current()] += size
+	outbox.total += size
+	return nil
+}
+
+// Replay sends queued messages in order and stops at the first failure,
+// keeping the unsent messages for the next attempt.
+//
+// A segment is read under the lock but sent without it, so that Push and
+// Empty don't wait for the network. Messages queued meanwhile are replayed
+// too. Unreadable segments are moved aside.
+func (outbox *Outbox) Replay(send func(channel, msg string) error) error {
+	outbox.mutex.Lock()
+	outbox.replaying = true
+	outbox.mutex.Unlock()
+	for {
+		name, records, ok := outbox.next()
+		if !ok {
+			return nil
+		}
+		for i, record := range records {
+			if err := send(record.Channel, record.Msg); err != nil {
+				outbox.mutex.Lock()
+				// unless evicted meanwhile
+				if i > 0 && len(outbox.segments) > 0 && outbox.segments[0] == name {
+					outbox.rewrite(name, records[i:])
+				}
+				outbox.replaying = false
+				outbox.mutex.Unlock()
+				return err
+			}
+		}
+		outbox.mutex.Lock()
+		if len(outbox.segments) > 0 && outbox.segments[0] == name {
+			if err := outbox.removeOldest(); err != nil {
+				log.Println(err)
+			}
+		}
+		outbox.mutex.Unlock()
+	}
+}
+
+// next reads the oldest readable segment, false if there is none, in which
+// case the replay ends under the same lock so that no message queued by
+// Queue is left behind.
+func (outbox *Outbox) next() (string, []message, bool) {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	for len(outbox.segments) > 0 {
+		name := outbox.segments[0]
+		if len(outbox.segments) == 1 {
+			// Stop appending to the last segment so that it can be replayed too
+			outbox.closeFile()
+		}
+		file_path := path.Join(outbox.dir, name)
+		records, err := readOutboxSegment(file_path)
+		if err == nil {
+			return name, records, true
+		}
+		log.Printf("Moved aside the unreadable outbox segment %s: %v\n", file_path, err)
+		if err := os.Rename(file_path, file_path+corruptSuffix); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		outbox.segments = outbox.segments[1:]
+		outbox.total -= outbox.sizes[name]
+		delete(outbox.sizes, name)
+	}
+	outbox.replaying = false
+	return "", nil, false
+}
+
+func (outbox *Outbox) Close() {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+	outbox.closeFile()
+}
+
+func (outbox *Outbox) current() string {
+	return outbox.segments[len(outbox.segments)-1]
+}
+
+func (outbox *Outbox) rotate() error {
+	outbox.closeFile()
+	name := fmt.Sprintf("%020d"+outboxSuffix, outbox.next_id)
+	file, err := os.OpenFile(path.Join(outbox.dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	outbox.next_id++
+	outbox.file = file
+	outbox.segments = append(outbox.segments, name)
+	outbox.sizes[name] = 0
+	return nil
+}
+
+func (outbox *Outbox) closeFile() {
+	if outbox.file != nil {
+		outbox.file.Sync()
+		outbox.file.Close()
+		outbox.file = nil
+	}
+}
+
+func (outbox *Outbox) evictOldest() error {
+	if len(outbox.segments) == 1 {
+		outbox.closeFile()
+	}
+	records, _ := readOutboxSegment(path.Join(outbox.dir, outbox.segments[0]))
+	outbox.dropped += uint64(len(records))
+	log.Printf("Outbox %s is full, dropped %d oldest messages\n", outbox.dir, len(records))
+	return outbox.removeOldest()
+}
+
+func (outbox *Outbox) removeOldest() error {
+	name := outbox.segments[0]
+	outbox.segments = outbox.segments[1:]
+	outbox.total -= outbox.sizes[name]
+	delete(outbox.sizes, name)
+	return os.Remove(path.Join(outbox.dir, name))
+}
+
+// Replace a partially replayed segment with its unsent messages, atomically.
+func (outbox *Outbox) rewrite(name string, records []message) {
+	file_path := path.Join(outbox.dir, name)
+	tmp_path := file_path + ".tmp"
+	file, err := os.Create(tmp_path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	writer := bufio.NewWriter(file)
+	var size int64
+	for _, record := range records {
+		line, _ := json.Marshal(record)
+		n, _ := writer.Write(append(line, '\n'))
+		size += int64(n)
+	}
+	writer.Flush()
+	file.Sync()
+	file.Close()
+	if err := os.Rename(tmp_path, file_path); err != nil {
+		log.Println(err)
+		return
+	}
+	outbox.total += size - outbox.sizes[name]
+	outbox.sizes[name] = size
+}
+
+func readOutboxSegment(file_path string) ([]message, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]message, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), max_outbox_line)
+	for scanner.Scan() {
+		record := message{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// a partial line written right before a crash
+			log.Printf("Skipped a corrupted line in %s\n", file_path)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,210 @@
+package pubsub
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newOutbox(t *testing.T, dir string, max_bytes int64, policy string) *Outbox {
+	t.Helper()
+	outbox, err := NewOutbox(dir, max_bytes, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(outbox.Close)
+	return outbox
+}
+
+func push(t *testing.T, outbox *Outbox, msgs ...string) {
+	t.Helper()
+	for _, msg := range msgs {
+		if err := outbox.Push("test", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// replay returns the messages sent, failing after fail_after of them if not negative.
+func replay(outbox *Outbox, fail_after int) ([]string, error) {
+	sent := make([]string, 0)
+	err := outbox.Replay(func(channel, msg string) error {
+		if fail_after >= 0 && len(sent) == fail_after {
+			return errors.New("redis is down")
+		}
+		sent = append(sent, msg)
+		return nil
+	})
+	return sent, err
+}
+
+func TestOutboxReplay(t *testing.T) {
+	outbox := newOutbox(t, t.TempDir(), 1024*1024, OUTBOX_DROP_OLDEST)
+	if !outbox.Empty() {
+		t.Fatal("a new outbox should be empty")
+	}
+	push(t, outbox, "1", "2", "3")
+
+	// the unsent messages are kept, in order
+	sent, err := replay(outbox, 1)
+	if err == nil || !reflect.DeepEqual(sent, []string{"1"}) {
+		t.Fatalf("sent %v, %v", sent, err)
+	}
+	push(t, outbox, "4")
+	sent, err = replay(outbox, -1)
+	if err != nil || !reflect.DeepEqual(sent, []string{"2", "3", "4"}) {
+		t.Fatalf("sent %v, %v", sent, err)
+	}
+	if !outbox.Empty() {
+		t.Error("the outbox should be empty once replayed")
+	}
+}
+
+func TestOutboxReplayUnlocked(t *testing.T) {
+	outbox := newOutbox(t, t.TempDir(), 1024*1024, OUTBOX_DROP_OLDEST)
+	push(t, outbox, "1")
+
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	sent := make([]string, 0)
+	done := make(chan error)
+	go func() {
+		done <- outbox.Replay(func(channel, msg string) error {
+			if len(sent) == 0 {
+				close(sending)
+				<-release
+			}
+			sent = append(sent, msg)
+			return nil
+		})
+	}()
+	<-sending
+
+	// a slow send doesn't block publishing
+	pushed := make(chan bool)
+	go func() {
+		push(t, outbox, "2")
+		pushed <- outbox.Empty()
+	}()
+	select {
+	case empty := <-pushed:
+		if empty {
+			t.Error("the outbox should not be empty")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Push is blocked by Replay")
+	}
+	close(release)
+	if err := <-done; err != nil || !reflect.DeepEqual(sent, []string{"1", "2"}) {
+		t.Errorf("sent %v, %v", sent, err)
+	}
+}
+
+// Messages published during a replay queue behind it until the replay ends.
+func TestOutboxQueueDuringReplay(t *testing.T) {
+	outbox := newOutbox(t, t.TempDir(), 1024*1024, OUTBOX_DROP_OLDEST)
+	if queued, err := outbox.Queue([]message{{"test", "0"}}); queued || err != nil {
+		t.Fatalf("queued %v into an empty outbox, %v", queued, err)
+	}
+	push(t, outbox, "1")
+
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	sent := make([]string, 0)
+	done := make(chan error)
+	go func() {
+		done <- outbox.Replay(func(channel, msg string) error {
+			if msg == "2" {
+				close(sending)
+				<-release
+			}
+			sent = append(sent, msg)
+			return nil
+		})
+	}()
+	if queued, err := outbox.Queue([]message{{"test", "2"}}); !queued || err != nil {
+		t.Fatalf("queued %v during the replay, %v", queued, err)
+	}
+	<-sending
+
+	// "1" is replayed, "2" is being sent
+	if queued, err := outbox.Queue([]message{{"test", "3"}}); !queued || err != nil {
+		t.Fatalf("queued %v during the replay, %v", queued, err)
+	}
+	close(release)
+	if err := <-done; err != nil || !reflect.DeepEqual(sent, []string{"1", "2", "3"}) {
+		t.Errorf("sent %v, %v", sent, err)
+	}
+	if queued, _ := outbox.Queue([]message{{"test", "4"}}); queued || !outbox.Empty() {
+		t.Error("nothing should be queued once the replay ends")
+	}
+}
+
+func TestOutboxEviction(t *testing.T) {
+	msg := strings.Repeat("x", 100)
+	outbox := newOutbox(t, t.TempDir(), 1000, OUTBOX_DROP_OLDEST)
+	for i := 0; i < 20; i++ {
+		push(t, outbox, strconv.Itoa(i)+msg)
+	}
+	if outbox.Dropped() == 0 {
+		t.Fatal("the oldest messages should be dropped")
+	}
+	sent, _ := replay(outbox, -1)
+	if len(sent) == 0 || len(sent)+int(outbox.Dropped()) != 20 || sent[len(sent)-1] != "19"+msg {
+		t.Errorf("sent %d messages, dropped %d", len(sent), outbox.Dropped())
+	}
+
+	outbox = newOutbox(t, t.TempDir(), 1000, OUTBOX_DROP_NEWEST)
+	var err error
+	for i := 0; i < 20 && err == nil; i++ {
+		err = outbox.Push("test", strconv.Itoa(i)+msg)
+	}
+	if !errors.Is(err, ErrOutboxFull) || outbox.Dropped() != 1 {
+		t.Fatalf("unexpected error %v, dropped %d", err, outbox.Dropped())
+	}
+	if sent, _ := replay(outbox, -1); sent[0] != "0"+msg {
+		t.Errorf("the oldest message should be kept, got %s", sent[0])
+	}
+}
+
+func TestOutboxRestart(t *testing.T) {
+	dir := t.TempDir()
+	outbox, _ := NewOutbox(dir, 1024*1024, OUTBOX_DROP_OLDEST)
+	push(t, outbox, "1", "2")
+	outbox.Close()
+
+	outbox = newOutbox(t, dir, 1024*1024, OUTBOX_DROP_OLDEST)
+	if outbox.Empty() {
+		t.Fatal("the messages of the previous process should be found")
+	}
+	push(t, outbox, "3")
+	if sent, err := replay(outbox, -1); err != nil || !reflect.DeepEqual(sent, []string{"1", "2", "3"}) {
+		t.Errorf("sent %v, %v", sent, err)
+	}
+}
+
+func TestOutboxUnreadableSegment(t *testing.T) {
+	dir := t.TempDir()
+	outbox, _ := NewOutbox(dir, 1024*1024, OUTBOX_DROP_OLDEST)
+	push(t, outbox, "1")
+	outbox.Close()
+	// longer than max_outbox_line
+	unreadable := path.Join(dir, "00000000000000000000"+outboxSuffix)
+	os.Rename(path.Join(dir, "00000000000000000000"+outboxSuffix), path.Join(dir, "00000000000000000001"+outboxSuffix))
+	os.WriteFile(unreadable, []byte(strings.Repeat("x", 128*1024)+"\n"), 0644)
+
+	outbox = newOutbox(t, dir, 1024*1024, OUTBOX_DROP_OLDEST)
+	defer func(max int) { max_outbox_line = max }(max_outbox_line)
+	max_outbox_line = 64 * 1024
+	if sent, err := replay(outbox, -1); err != nil || !reflect.DeepEqual(sent, []string{"1"}) {
+		t.Errorf("sent %v, %v", sent, err)
+	}
+	if _, err := os.Stat(unreadable + corruptSuffix); err != nil || !outbox.Empty() {
+		t.Errorf("the unreadable segment should be moved aside, %v", err)
+	}
+}
@@ -2,29 +2,261 @@ package pubsub
 
 import (
 	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/go-redis/redis/v8"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
 	"github.com/soulmachine/coinsignal/utils"
 )
 
+const OUTBOX_DEFAULT_MAX_BYTES = 256 * 1024 * 1024
+
+type message struct {
+	Channel string `json:"channel"`
+	Msg     string `json:"msg"`
+}
+
 type Publisher struct {
-	rdb *redis.Client
-	ctx context.Context
+	rdb        redis.UniversalClient
+	ctx        context.Context
+	mode       string
+	validation string
+	snapshot   bool    // whether to update the snapshots of topics
+	outbox     *Outbox // nil if disabled
+	stopCh     chan struct{}
+
+	producer string
+	host     string
+	session  int64
+	mutex    sync.Mutex
+	seqs     map[string]uint64 // last seq per topic
+	locks    map[string]*sync.Mutex
 }
 
+// NewPublisher creates a publisher using the transport selected by REDIS_MODE.
 func NewPublisher(ctx context.Context, redis_url string) *Publisher {
+	return NewPublisherWithMode(ctx, redis_url, RedisMode())
+}
+
+func NewPublisherWithMode(ctx context.Context, redis_url, mode string) *Publisher {
 	rdb := utils.NewRedisClient(redis_url)
-	return &Publisher{rdb, ctx}
+	host, _ := os.Hostname()
+	return &Publisher{
+		rdb:        rdb,
+		ctx:        ctx,
+		mode:       mode,
+		validation: ValidationMode(),
+		snapshot:   true,
+		stopCh:     make(chan struct{}),
+		producer:   filepath.Base(os.Args[0]),
+		host:       host,
+		session:    time.Now().UnixNano() / int64(time.Millisecond),
+		seqs:       make(map[string]uint64),
+		locks:      make(map[string]*sync.Mutex),
+	}
 }
 
-func (publisher *Publisher) Publish(channel, msg string) {
-	err := publisher.rdb.Publish(publisher.ctx, channel, msg).Err()
+// EnableOutbox spools messages under dir while Redis is unavailable and
+// replays them in order once Redis answers PING again.
+func (publisher *Publisher) EnableOutbox(dir string, max_bytes int64, policy string) error {
+	outbox, err := NewOutbox(dir, max_bytes, policy)
 	if err != nil {
+		return err
+	}
+	publisher.outbox = outbox
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-publisher.stopCh:
+				return
+			case <-ticker.C:
+				if outbox.Empty() || publisher.rdb.Ping(publisher.ctx).Err() != nil {
+					continue
+				}
+				if err := outbox.Replay(publisher.send); err != nil {
+					log.Error(err.Error())
+				} else {
+					log.Info("Replayed all messages in the outbox " + dir)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// EnableOutboxFromEnv enables the outbox under DATA_DIR/outbox/name, with the
+// size cap from OUTBOX_MAX_BYTES and the eviction policy from OUTBOX_POLICY.
+func (publisher *Publisher) EnableOutboxFromEnv(name string) error {
+	data_dir := os.Getenv("DATA_DIR")
+	if len(data_dir) == 0 {
+		log.Warn("The DATA_DIR environment variable is empty, outbox disabled")
+		return nil
+	}
+	max_bytes := int64(OUTBOX_DEFAULT_MAX_BYTES)
+	if value := os.Getenv("OUTBOX_MAX_BYTES"); len(value) > 0 {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		max_bytes = n
+	}
+	policy := os.Getenv("OUTBOX_POLICY")
+	if len(policy) == 0 {
+		policy = OUTBOX_DROP_OLDEST
+	}
+	return publisher.EnableOutbox(path.Join(data_dir, "outbox", name), max_bytes, policy)
+}
+
+// SetValidation overrides VALIDATE_MESSAGES, must be called before Publish.
+func (publisher *Publisher) SetValidation(mode string) {
+	publisher.validation = mode
+}
+
+// DisableSnapshot leaves the snapshots of topics untouched, so that old
+// messages, such as replayed ones, don't overwrite the latest. Must be called
+// before Publish.
+func (publisher *Publisher) DisableSnapshot() {
+	publisher.snapshot = false
+}
+
+func (publisher *Publisher) Publish(channel, msg string) {
+	if !valid(publisher.validation, channel, msg) {
+		return
+	}
+	// The seq is assigned and sent under the same lock, otherwise concurrent
+	// messages of a topic could reach Redis out of order and be dropped by
+	// subscribers as duplicates
+	lock := publisher.topicLock(channel)
+	lock.Lock()
+	defer lock.Unlock()
+	publisher.publishAll([]message{publisher.prepare(channel, msg)})
+}
+
+func (publisher *Publisher) topicLock(channel string) *sync.Mutex {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	lock, ok := publisher.locks[channel]
+	if !ok {
+		lock = &sync.Mutex{}
+		publisher.locks[channel] = lock
+	}
+	return lock
+}
+
+func (publisher *Publisher) prepare(channel, msg string) message {
+	if strings.HasPrefix(channel, config.REDIS_TOPIC_PREFIX) {
+		msg = publisher.wrap(channel, msg)
+	}
+	return message{channel, msg}
+}
+
+// Send prepared messages in one pipeline, or spool them if Redis is down.
+func (publisher *Publisher) publishAll(msgs []message) {
+	// Once something is spooled, newer messages queue behind it until it is
+	// replayed, to keep order
+	if publisher.outbox != nil {
+		queued, err := publisher.outbox.Queue(msgs)
+		if err != nil {
+			log.Error(err.Error())
+		}
+		if queued {
+			return
+		}
+	}
+	if err := publisher.sendAll(msgs); err != nil {
 		log.Error(err.Error())
+		if publisher.outbox != nil {
+			publisher.spool(msgs)
+		}
+	}
+}
+
+// Wrap msg in an Envelope with the next seq of channel.
+func (publisher *Publisher) wrap(channel, msg string) string {
+	encoding := ""
+	payload := json.RawMessage(msg)
+	if !json.Valid(payload) {
+		// binary payloads from codecs such as msgpack or protobuf
+		encoding = pojo.ENCODING_BASE64
+		payload, _ = json.Marshal([]byte(msg))
+	}
+	publisher.mutex.Lock()
+	publisher.seqs[channel]++
+	seq := publisher.seqs[channel]
+	publisher.mutex.Unlock()
+
+	envelope := pojo.Envelope{
+		Producer:   publisher.producer,
+		Host:       publisher.host,
+		Session:    publisher.session,
+		Seq:        seq,
+		ProducedAt: time.Now().UnixNano() / int64(time.Millisecond),
+		Version:    pojo.ENVELOPE_VERSION,
+		Encoding:   encoding,
+		Payload:    payload,
+	}
+	bytes, _ := json.Marshal(envelope)
+	return string(bytes)
+}
+
+func (publisher *Publisher) send(channel, msg string) error {
+	return publisher.sendAll([]message{{channel, msg}})
+}
+
+// Send messages and update the snapshots of their channels in one
+// transaction, so that a subscriber reading a snapshot never misses a message.
+// In a Redis Cluster the transaction is split by slot, each topic and its
+// snapshot share one, see config.SnapshotKey, but a batch of several topics
+// isn't atomic as a whole.
+func (publisher *Publisher) sendAll(msgs []message) error {
+	_, err := publisher.rdb.TxPipelined(publisher.ctx, func(pipe redis.Pipeliner) error {
+		for _, msg := range msgs {
+			if publisher.mode == config.REDIS_MODE_STREAM {
+				pipe.XAdd(publisher.ctx, &redis.XAddArgs{
+					Stream: msg.Channel,
+					MaxLen: config.StreamMaxLen(msg.Channel),
+					Approx: true,
+					Values: map[string]interface{}{STREAM_FIELD: msg.Msg},
+				})
+			} else {
+				pipe.Publish(publisher.ctx, msg.Channel, msg.Msg)
+			}
+			if !publisher.snapshot {
+				continue
+			}
+			if field, ok := snapshotField(msg.Channel, msg.Msg); ok {
+				pipe.HSet(publisher.ctx, config.SnapshotKey(msg.Channel), field, msg.Msg)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (publisher *Publisher) spool(msgs []message) {
+	for _, msg := range msgs {
+		if err := publisher.outbox.Push(msg.Channel, msg.Msg); err != nil {
+			log.Error(err.Error())
+		}
 	}
 }
 
 func (publisher *Publisher) Close() {
+	close(publisher.stopCh)
+	if publisher.outbox != nil {
+		publisher.outbox.Close()
+	}
 	publisher.rdb.Close()
 }
@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/soulmachine/coinsignal/pojo"
+)
+
+// Kinds of SequenceEvent
+const SEQUENCE_GAP = "gap"
+const SEQUENCE_DUPLICATE = "duplicate"
+
+// SequenceEvent reports messages missed or received twice from a producer.
+type SequenceEvent struct {
+	Kind     string
+	Topic    string
+	Producer string
+	Host     string
+	Expected uint64 // the next seq expected
+	Got      uint64
+}
+
+func logSequenceEvent(event SequenceEvent) {
+	if event.Kind == SEQUENCE_GAP {
+		log.Printf("Missed %d messages on %s from %s@%s, expected seq %d but got %d\n",
+			event.Got-event.Expected, event.Topic, event.Producer, event.Host, event.Expected, event.Got)
+	} else {
+		log.Printf("Duplicated message on %s from %s@%s, expected seq %d but got %d\n",
+			event.Topic, event.Producer, event.Host, event.Expected, event.Got)
+	}
+}
+
+// Try to decode msg as an Envelope, returns nil for bare payloads, such as
+// messages from producers outside this repository.
+func parseEnvelope(msg string) *pojo.Envelope {
+	envelope := pojo.Envelope{}
+	if err := json.Unmarshal([]byte(msg), &envelope); err != nil {
+		return nil
+	}
+	if envelope.Version == 0 || envelope.Payload == nil {
+		return nil
+	}
+	return &envelope
+}
+
+// Returns the payload of envelope as it was passed to Publish.
+func envelopePayload(envelope *pojo.Envelope) string {
+	if envelope.Encoding == pojo.ENCODING_BASE64 {
+		var bytes []byte
+		if err := json.Unmarshal(envelope.Payload, &bytes); err != nil {
+			log.Println(err)
+		}
+		return string(bytes)
+	}
+	return string(envelope.Payload)
+}
+
+type producerKey struct {
+	producer string
+	host     string
+}
+
+type producerState struct {
+	session int64
+	seq     uint64
+}
+
+// sequenceTracker follows the seq of every producer on one topic.
+type sequenceTracker struct {
+	topic  string
+	last   map[producerKey]producerState
+	seeded map[producerKey]producerState // latest of each producer in the snapshot
+}
+
+func newSequenceTracker(topic string) *sequenceTracker {
+	return &sequenceTracker{topic, make(map[producerKey]producerState), make(map[producerKey]producerState)}
+}
+
+// seed records a message delivered from the snapshot. Live messages that are
+// not newer than the snapshot are then dropped without reporting them.
+func (tracker *sequenceTracker) seed(envelope *pojo.Envelope) {
+	key := producerKey{envelope.Producer, envelope.Host}
+	current := producerState{envelope.Session, envelope.Seq}
+	last, ok := tracker.seeded[key]
+	if !ok || current.session > last.session || (current.session == last.session && current.seq > last.seq) {
+		tracker.seeded[key] = current
+		tracker.last[key] = current
+	}
+}
+
+func (tracker *sequenceTracker) inSnapshot(key producerKey, envelope *pojo.Envelope) bool {
+	seeded, ok := tracker.seeded[key]
+	if !ok {
+		return false
+	}
+	return envelope.Session < seeded.session || (envelope.Session == seeded.session && envelope.Seq <= seeded.seq)
+}
+
+// check returns a SequenceEvent if envelope isn't the next expected message,
+// and whether it should be delivered, duplicates are not.
+func (tracker *sequenceTracker) check(envelope *pojo.Envelope) (*SequenceEvent, bool) {
+	key := producerKey{envelope.Producer, envelope.Host}
+	last, ok := tracker.last[key]
+	current := producerState{envelope.Session, envelope.Seq}
+
+	event := &SequenceEvent{
+		Topic:    tracker.topic,
+		Producer: envelope.Producer,
+		Host:     envelope.Host,
+		Got:      envelope.Seq,
+	}
+	switch {
+	case !ok:
+		// first message seen from this producer, nothing to compare with
+		tracker.last[key] = current
+		return nil, true
+	case tracker.inSnapshot(key, envelope):
+		return nil, false
+	case envelope.Session < last.session:
+		event.Kind = SEQUENCE_DUPLICATE
+		event.Expected = last.seq + 1
+		return event, false
+	case envelope.Session > last.session:
+		// the producer restarted
+		tracker.last[key] = current
+		if envelope.Seq > 1 {
+			event.Kind = SEQUENCE_GAP
+			event.Expected = 1
+			return event, true
+		}
+		return nil, true
+	case envelope.Seq <= last.seq:
+		event.Kind = SEQUENCE_DUPLICATE
+		event.Expected = last.seq + 1
+		return event, false
+	case envelope.Seq > last.seq+1:
+		tracker.last[key] = current
+		event.Kind = SEQUENCE_GAP
+		event.Expected = last.seq + 1
+		return event, true
+	default:
+		tracker.last[key] = current
+		return nil, true
+	}
+}
@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/testutil"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+func envelope(session int64, seq uint64) *pojo.Envelope {
+	return &pojo.Envelope{Producer: "crawler", Host: "myhost", Session: session, Seq: seq, Version: pojo.ENVELOPE_VERSION, Payload: []byte("{}")}
+}
+
+func TestSequenceTracker(t *testing.T) {
+	tracker := newSequenceTracker("test")
+	for _, tt := range []struct {
+		session  int64
+		seq      uint64
+		kind     string // of the event, empty if none
+		expected uint64
+		deliver  bool
+	}{
+		{1, 5, "", 0, true}, // the first message
+		{1, 6, "", 0, true},
+		{1, 9, SEQUENCE_GAP, 7, true},
+		{1, 9, SEQUENCE_DUPLICATE, 10, false},
+		{1, 8, SEQUENCE_DUPLICATE, 10, false},
+		{2, 1, "", 0, true}, // restarted
+		{1, 10, SEQUENCE_DUPLICATE, 2, false},
+		{3, 4, SEQUENCE_GAP, 1, true}, // restarted, missing the first messages
+	} {
+		event, deliver := tracker.check(envelope(tt.session, tt.seq))
+		if deliver != tt.deliver || (event == nil) != (tt.kind == "") {
+			t.Fatalf("%d/%d: unexpected event %+v, deliver %v", tt.session, tt.seq, event, deliver)
+		}
+		if event != nil && (event.Kind != tt.kind || event.Expected != tt.expected || event.Got != tt.seq || event.Producer != "crawler") {
+			t.Errorf("%d/%d: unexpected event %+v", tt.session, tt.seq, event)
+		}
+	}
+}
+
+func TestSequenceTrackerSnapshot(t *testing.T) {
+	tracker := newSequenceTracker("test")
+	tracker.seed(envelope(1, 3))
+	tracker.seed(envelope(1, 5))
+	tracker.seed(envelope(1, 4)) // older entries of other keys
+	// covered by the snapshot, dropped silently
+	for _, seq := range []uint64{4, 5} {
+		if event, deliver := tracker.check(envelope(1, seq)); event != nil || deliver {
+			t.Errorf("%d: unexpected event %+v, deliver %v", seq, event, deliver)
+		}
+	}
+	if event, deliver := tracker.check(envelope(1, 6)); event != nil || !deliver {
+		t.Errorf("unexpected event %+v, deliver %v", event, deliver)
+	}
+}
+
+// Concurrent messages of a topic reach Redis in the order of their seq.
+func TestPublishOrder(t *testing.T) {
+	_, redis_url := testutil.NewRedis(t)
+	publisher := NewPublisherWithMode(context.Background(), redis_url, config.REDIS_MODE_STREAM)
+	defer publisher.Close()
+	topic := config.REDIS_TOPIC_PREFIX + "test"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				publisher.Publish(topic, `{"n":`+strconv.Itoa(i*50+j)+`}`)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	rdb := utils.NewRedisClient(redis_url)
+	defer rdb.Close()
+	entries, err := rdb.XRange(context.Background(), topic, "-", "+").Result()
+	if err != nil || len(entries) != 400 {
+		t.Fatalf("read %d entries, %v", len(entries), err)
+	}
+	for i, entry := range entries {
+		msg, _ := entry.Values[STREAM_FIELD].(string)
+		if envelope := parseEnvelope(msg); envelope == nil || envelope.Seq != uint64(i+1) {
+			t.Fatalf("entry %d is %s", i, msg)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package pubsub
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+)
+
+// Returns the entry of msg in the snapshot hash of channel, false if channel
+// has no snapshot or msg lacks the key field.
+func snapshotField(channel, msg string) (string, bool) {
+	if !strings.HasPrefix(channel, config.REDIS_TOPIC_PREFIX) {
+		return "", false
+	}
+	field, ok := config.REDIS_SNAPSHOT_FIELDS[channel]
+	if !ok {
+		return config.REDIS_SNAPSHOT_LATEST, true
+	}
+	// msg is normally wrapped in an Envelope
+	value, err := jsonparser.GetString([]byte(msg), "payload", field)
+	if err != nil {
+		value, err = jsonparser.GetString([]byte(msg), field)
+	}
+	if err != nil || len(value) == 0 {
+		return "", false
+	}
+	return value, true
+}
+
+// Sort snapshot entries by the time they were published.
+func sortSnapshot(entries map[string]string) []string {
+	type item struct {
+		envelope *pojo.Envelope
+		msg      string
+	}
+	items := make([]item, 0, len(entries))
+	for _, msg := range entries {
+		items = append(items, item{parseEnvelope(msg), msg})
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i].envelope, items[j].envelope
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		if a.ProducedAt != b.ProducedAt {
+			return a.ProducedAt < b.ProducedAt
+		}
+		return a.Seq < b.Seq
+	})
+	msgs := make([]string, len(items))
+	for i, item := range items {
+		msgs[i] = item.msg
+	}
+	return msgs
+}
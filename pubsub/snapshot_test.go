@@ -0,0 +1,79 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/testutil"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+func TestSnapshotField(t *testing.T) {
+	for _, tt := range []struct {
+		channel, msg, field string
+		ok                  bool
+	}{
+		{config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"version":1,"payload":{"currency":"BTC","price":61000}}`, "BTC", true},
+		{config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"currency":"ETH","price":3800}`, "ETH", true},
+		{config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, `{"price":3800}`, "", false},
+		{config.REDIS_TOPIC_ETH_GAS_PRICE, `{"rapid":1}`, config.REDIS_SNAPSHOT_LATEST, true},
+		{"other", `{"currency":"BTC"}`, "", false},
+	} {
+		if field, ok := snapshotField(tt.channel, tt.msg); field != tt.field || ok != tt.ok {
+			t.Errorf("%s %s: got %q %v", tt.channel, tt.msg, field, ok)
+		}
+	}
+}
+
+// The snapshot shares the Redis Cluster slot of its topic.
+func TestSnapshotKey(t *testing.T) {
+	topic := config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL
+	if key := config.SnapshotKey(topic); !strings.HasPrefix(key, "{"+topic+"}") {
+		t.Errorf("unexpected key %s", key)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	_, redis_url := testutil.NewRedis(t)
+	ctx := context.Background()
+	publisher := NewPublisherWithMode(ctx, redis_url, config.REDIS_MODE_PUBSUB)
+	defer publisher.Close()
+	topic := config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL
+	publisher.Publish(topic, `{"currency":"BTC","price":61000}`)
+	publisher.Publish(topic, `{"currency":"ETH","price":3800}`)
+	publisher.Publish(topic, `{"currency":"BTC","price":61001}`)
+
+	rdb := utils.NewRedisClient(redis_url)
+	defer rdb.Close()
+	entries, err := rdb.HGetAll(ctx, config.SnapshotKey(topic)).Result()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("unexpected snapshot %v, %v", entries, err)
+	}
+
+	received := make([]string, 0)
+	subscriber := NewSubscriberWithMode(ctx, redis_url, topic, config.REDIS_MODE_PUBSUB, func(msg string) {
+		received = append(received, msg)
+	})
+	defer subscriber.Close()
+	subscriber.EnableSnapshot()
+	subscriber.deliverSnapshot()
+	// in the order published
+	expected := []string{`{"currency":"ETH","price":3800}`, `{"currency":"BTC","price":61001}`}
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("received %v", received)
+	}
+
+	// live messages covered by the snapshot are skipped, newer ones are not
+	events := make([]SequenceEvent, 0)
+	subscriber.OnSequenceEvent(func(event SequenceEvent) { events = append(events, event) })
+	subscriber.deliver(entries["BTC"])
+	publisher.Publish(topic, `{"currency":"ETH","price":3801}`)
+	latest, _ := rdb.HGet(ctx, config.SnapshotKey(topic), "ETH").Result()
+	subscriber.deliver(latest)
+	if len(received) != 3 || received[2] != `{"currency":"ETH","price":3801}` || len(events) != 0 {
+		t.Errorf("received %v, events %v", received, events)
+	}
+}
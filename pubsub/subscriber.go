@@ -2,32 +2,200 @@ package pubsub
 
 import (
 	"context"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
 	"github.com/soulmachine/coinsignal/utils"
 )
 
 type Subscriber struct {
-	pubsub *redis.PubSub
-	on_msg func(string)
+	ctx        context.Context
+	cancel     context.CancelFunc
+	rdb        redis.UniversalClient
+	channel    string
+	mode       string
+	validation string
+	pubsub     *redis.PubSub // only in pubsub mode
+	on_msg     func(string)
+
+	tracker     *sequenceTracker
+	on_sequence func(SequenceEvent)
+	on_envelope func(*pojo.Envelope)
+	snapshot    bool
 }
 
+// NewSubscriber creates a subscriber using the transport selected by REDIS_MODE.
 func NewSubscriber(ctx context.Context, redis_url, channel string, on_msg func(string)) *Subscriber {
+	return NewSubscriberWithMode(ctx, redis_url, channel, RedisMode(), on_msg)
+}
+
+func NewSubscriberWithMode(ctx context.Context, redis_url, channel, mode string, on_msg func(string)) *Subscriber {
+	ctx, cancel := context.WithCancel(ctx)
 	rdb := utils.NewRedisClient(redis_url)
-	pubsub := rdb.Subscribe(ctx, channel)
+	subscriber := &Subscriber{ctx, cancel, rdb, channel, mode, ValidationMode(), nil, on_msg, newSequenceTracker(channel), logSequenceEvent, nil, false}
+
+	if mode == config.REDIS_MODE_STREAM {
+		// Start from new entries if the group doesn't exist yet, otherwise
+		// the group resumes from its last acknowledged ID.
+		err := rdb.XGroupCreateMkStream(ctx, channel, consumerGroup(), "$").Err()
+		if err != nil && !strings.Contains(err.Error(), "BUSYGROUP") {
+			log.Fatalln(err)
+		}
+	} else {
+		subscriber.pubsub = rdb.Subscribe(ctx, channel)
+	}
+	return subscriber
+}
+
+// OnSequenceEvent replaces the default handler, which logs gaps and
+// duplicates. Must be called before Run.
+func (subscriber *Subscriber) OnSequenceEvent(on_sequence func(SequenceEvent)) {
+	subscriber.on_sequence = on_sequence
+}
 
-	return &Subscriber{pubsub, on_msg}
+// SetValidation overrides VALIDATE_MESSAGES, must be called before Run.
+func (subscriber *Subscriber) SetValidation(mode string) {
+	subscriber.validation = mode
+}
+
+// OnEnvelope registers a callback receiving the envelope of each message
+// right before its payload is passed to on_msg, from the same goroutine.
+// Must be called before Run.
+func (subscriber *Subscriber) OnEnvelope(on_envelope func(*pojo.Envelope)) {
+	subscriber.on_envelope = on_envelope
+}
+
+// EnableSnapshot delivers the latest message per key of the channel before
+// live messages, live messages already covered by the snapshot are skipped.
+// Must be called before Run.
+func (subscriber *Subscriber) EnableSnapshot() {
+	subscriber.snapshot = true
 }
 
 func (subscriber *Subscriber) Run() {
+	if subscriber.mode == config.REDIS_MODE_STREAM {
+		if subscriber.snapshot {
+			subscriber.deliverSnapshot()
+		}
+		subscriber.runStream()
+		return
+	}
+	if subscriber.snapshot {
+		// Messages published after the subscription is confirmed are queued
+		// in the connection, so reading the snapshot now loses nothing.
+		if _, err := subscriber.pubsub.Receive(subscriber.ctx); err != nil {
+			log.Println(err)
+		}
+		subscriber.deliverSnapshot()
+	}
 	ch := subscriber.pubsub.Channel()
 	// Consume messages.
 	for msg := range ch {
 		// fmt.Println(msg.Channel, msg.Payload)
-		subscriber.on_msg(msg.Payload)
+		subscriber.deliver(msg.Payload)
 	}
 }
 
+func (subscriber *Subscriber) runStream() {
+	group := consumerGroup()
+	consumer := consumerName()
+	// "0" re-delivers entries this consumer read but never acknowledged,
+	// ">" asks for entries never delivered to the group.
+	last_id := "0"
+	for subscriber.ctx.Err() == nil {
+		streams, err := subscriber.rdb.XReadGroup(subscriber.ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{subscriber.channel, last_id},
+			Count:    100,
+			Block:    5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			last_id = ">" // nothing pending, or no new entries within Block
+			continue
+		}
+		if err != nil {
+			if subscriber.ctx.Err() != nil {
+				return
+			}
+			log.Println(err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, stream := range streams {
+			if last_id != ">" && len(stream.Messages) == 0 {
+				last_id = ">" // pending entries exhausted
+			}
+			for _, msg := range stream.Messages {
+				if subscriber.ctx.Err() != nil {
+					return // closed, the rest stays pending for the next run
+				}
+				payload, _ := msg.Values[STREAM_FIELD].(string)
+				subscriber.deliver(payload)
+				if err := subscriber.rdb.XAck(subscriber.ctx, subscriber.channel, group, msg.ID).Err(); err != nil {
+					log.Println(err)
+				}
+				if last_id != ">" {
+					last_id = msg.ID
+				}
+			}
+		}
+	}
+}
+
+func (subscriber *Subscriber) deliverSnapshot() {
+	entries, err := subscriber.rdb.HGetAll(subscriber.ctx, config.SnapshotKey(subscriber.channel)).Result()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, msg := range sortSnapshot(entries) {
+		envelope := parseEnvelope(msg)
+		if envelope == nil {
+			subscriber.handle(nil, msg)
+			continue
+		}
+		subscriber.tracker.seed(envelope)
+		subscriber.handle(envelope, envelopePayload(envelope))
+	}
+}
+
+// Unwrap the envelope if any and pass the payload to on_msg, duplicates are
+// reported and dropped.
+func (subscriber *Subscriber) deliver(msg string) {
+	envelope := parseEnvelope(msg)
+	if envelope == nil {
+		subscriber.handle(nil, msg)
+		return
+	}
+	event, ok := subscriber.tracker.check(envelope)
+	if event != nil {
+		subscriber.on_sequence(*event)
+	}
+	if ok {
+		subscriber.handle(envelope, envelopePayload(envelope))
+	}
+}
+
+// Pass a valid payload to the callbacks, envelope is nil for plain messages.
+func (subscriber *Subscriber) handle(envelope *pojo.Envelope, payload string) {
+	if !valid(subscriber.validation, subscriber.channel, payload) {
+		return
+	}
+	if envelope != nil && subscriber.on_envelope != nil {
+		subscriber.on_envelope(envelope)
+	}
+	subscriber.on_msg(payload)
+}
+
 func (subscriber *Subscriber) Close() {
-	subscriber.pubsub.Close()
+	subscriber.cancel()
+	if subscriber.pubsub != nil {
+		subscriber.pubsub.Close()
+	}
+	subscriber.rdb.Close()
 }
@@ -0,0 +1,83 @@
+package pubsub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/testutil"
+)
+
+// Entries read but not acknowledged before a close are delivered again after
+// a restart, followed by new entries, without gaps.
+func TestStreamResume(t *testing.T) {
+	_, redis_url := testutil.NewRedis(t)
+	publisher := NewPublisherWithMode(context.Background(), redis_url, config.REDIS_MODE_STREAM)
+	defer publisher.Close()
+	topic := config.REDIS_TOPIC_PREFIX + "test"
+
+	received := make(chan string, 100)
+	var first *Subscriber
+	first = NewSubscriberWithMode(context.Background(), redis_url, topic, config.REDIS_MODE_STREAM, func(msg string) {
+		received <- msg
+		if len(received) == 2 {
+			first.Close() // before the second message is acknowledged
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		first.Run()
+		close(done)
+	}()
+	for i := 0; i < 5; i++ {
+		publisher.Publish(topic, `{"n":`+strconv.Itoa(i)+`}`)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the first subscriber didn't stop")
+	}
+	if len(received) != 2 || <-received != `{"n":0}` || <-received != `{"n":1}` {
+		t.Fatalf("received %d messages before the close", len(received))
+	}
+
+	second := NewSubscriberWithMode(context.Background(), redis_url, topic, config.REDIS_MODE_STREAM, func(msg string) { received <- msg })
+	defer second.Close()
+	go second.Run()
+	for i := 5; i < 7; i++ {
+		publisher.Publish(topic, `{"n":`+strconv.Itoa(i)+`}`)
+	}
+	got := []string{}
+	for len(got) < 6 {
+		got = append(got, testutil.Receive(t, received, 5*time.Second))
+	}
+	expected := []string{}
+	for i := 1; i < 7; i++ {
+		expected = append(expected, `{"n":`+strconv.Itoa(i)+`}`)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("received %v after the restart", got)
+	}
+}
+
+func TestConsumerGroup(t *testing.T) {
+	defer func(group string) { default_group = group }(default_group)
+	binary := filepath.Base(os.Args[0])
+	t.Setenv("REDIS_CONSUMER_GROUP", "")
+	if group := consumerGroup(); group != binary {
+		t.Errorf("group %s", group)
+	}
+	FanOut()
+	if host, _ := os.Hostname(); consumerGroup() != binary+"-"+host {
+		t.Errorf("group %s with fan-out", consumerGroup())
+	}
+	t.Setenv("REDIS_CONSUMER_GROUP", "gateway-1")
+	if group := consumerGroup(); group != "gateway-1" {
+		t.Errorf("group %s", group)
+	}
+}
@@ -0,0 +1,66 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// TypedPublisher encodes messages of type T with a codec before publishing.
+type TypedPublisher[T any] struct {
+	publisher *Publisher
+	channel   string
+	codec     Codec
+}
+
+func NewTypedPublisher[T any](publisher *Publisher, channel string, codec Codec) *TypedPublisher[T] {
+	return &TypedPublisher[T]{publisher, channel, codec}
+}
+
+func (publisher *TypedPublisher[T]) Publish(msg T) error {
+	bytes, err := publisher.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	publisher.publisher.Publish(publisher.channel, string(bytes))
+	return nil
+}
+
+// DecodeError is passed to the error callback of TypedSubscriber.
+type DecodeError struct {
+	Channel string
+	Codec   string
+	Msg     string
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode %s message on %s: %v", e.Codec, e.Channel, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// TypedSubscriber decodes messages into T, undecodable messages go to on_err
+// instead of on_msg.
+type TypedSubscriber[T any] struct {
+	*Subscriber
+}
+
+// NewTypedSubscriber subscribes to channel with the transport selected by
+// REDIS_MODE. If on_err is nil, decode errors are logged.
+func NewTypedSubscriber[T any](ctx context.Context, redis_url, channel string, codec Codec, on_msg func(T), on_err func(error)) *TypedSubscriber[T] {
+	if on_err == nil {
+		on_err = func(err error) { log.Println(err) }
+	}
+	subscriber := NewSubscriber(ctx, redis_url, channel, func(payload string) {
+		var msg T
+		if err := codec.Unmarshal([]byte(payload), &msg); err != nil {
+			on_err(&DecodeError{channel, codec.Name(), payload, err})
+			return
+		}
+		on_msg(msg)
+	})
+	return &TypedSubscriber[T]{subscriber}
+}
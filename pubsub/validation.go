@@ -0,0 +1,46 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/registry"
+)
+
+// ValidationMode returns the validation selected by VALIDATE_MESSAGES, off by default.
+func ValidationMode() string {
+	mode := os.Getenv("VALIDATE_MESSAGES")
+	switch mode {
+	case "", config.VALIDATE_OFF:
+		return config.VALIDATE_OFF
+	case config.VALIDATE_WARN, config.VALIDATE_STRICT:
+		return mode
+	default:
+		log.Fatalf("Unknown VALIDATE_MESSAGES %s, must be %s, %s or %s", mode, config.VALIDATE_OFF, config.VALIDATE_WARN, config.VALIDATE_STRICT)
+		return ""
+	}
+}
+
+// valid checks the payload msg of channel against the topic registry and
+// returns false if it must be dropped. Unregistered channels always pass, and
+// so do binary payloads from codecs such as msgpack or protobuf, as the
+// schemas describe JSON.
+func valid(mode, channel, msg string) bool {
+	if mode == config.VALIDATE_OFF || !json.Valid([]byte(msg)) {
+		return true
+	}
+	topic, ok := registry.Lookup(channel)
+	if !ok {
+		return true
+	}
+	if err := topic.Validate([]byte(msg)); err != nil {
+		if mode == config.VALIDATE_STRICT {
+			log.Printf("Dropped %v\n", err)
+			return false
+		}
+		log.Println(err)
+	}
+	return true
+}
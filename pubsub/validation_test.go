@@ -0,0 +1,62 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+	"github.com/soulmachine/coinsignal/testutil"
+)
+
+func TestValid(t *testing.T) {
+	channel := config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL
+	price := pojo.CurrencyPrice{Currency: "BTC", Price: 61000}
+	msgpack, err := MsgpackCodec{}.Marshal(price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mode, channel, msg string
+		valid              bool
+	}{
+		{config.VALIDATE_STRICT, channel, `{"currency":"BTC","price":61000}`, true},
+		{config.VALIDATE_STRICT, channel, `{"currency":1}`, false},
+		{config.VALIDATE_WARN, channel, `{"currency":1}`, true},
+		{config.VALIDATE_OFF, channel, `{"currency":1}`, true},
+		{config.VALIDATE_STRICT, config.REDIS_TOPIC_PREFIX + "unregistered", `{"currency":1}`, true},
+		// binary payloads aren't checked against the JSON schema
+		{config.VALIDATE_STRICT, channel, string(msgpack), true},
+	}
+	for _, test := range tests {
+		if valid(test.mode, test.channel, test.msg) != test.valid {
+			t.Errorf("%s %s %q should be valid: %v", test.mode, test.channel, test.msg, test.valid)
+		}
+	}
+}
+
+// Strict validation keeps messages of non-JSON codecs.
+func TestStrictValidationMsgpack(t *testing.T) {
+	server, redis_url := testutil.NewRedis(t)
+	t.Setenv("REDIS_MODE", config.REDIS_MODE_PUBSUB)
+	t.Setenv("VALIDATE_MESSAGES", config.VALIDATE_STRICT)
+	publisher := NewPublisher(context.Background(), redis_url)
+	defer publisher.Close()
+
+	channel := config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL
+	received, _ := subscribeTyped[pojo.CurrencyPrice](t, server, redis_url, channel, MsgpackCodec{})
+	price := pojo.CurrencyPrice{Currency: "BTC", Price: 61000}
+	if err := NewTypedPublisher[pojo.CurrencyPrice](publisher, channel, MsgpackCodec{}).Publish(price); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case decoded := <-received:
+		if !reflect.DeepEqual(decoded, price) {
+			t.Errorf("decoded %+v", decoded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message was dropped")
+	}
+}
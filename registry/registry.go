@@ -0,0 +1,118 @@
+// Package registry ties each Redis topic to its payload type in pojo, the
+// binary producing it and a description, and derives a JSON Schema from the
+// type to validate messages against.
+package registry
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+)
+
+type Topic struct {
+	Name        string
+	Type        reflect.Type // of the payload, inside the envelope if any
+	Producer    string       // binary publishing the topic
+	Description string
+
+	schema map[string]interface{}
+}
+
+var (
+	mutex  sync.RWMutex
+	topics = make(map[string]*Topic)
+)
+
+func init() {
+	Register(config.REDIS_TOPIC_ETH_BLOCK_HEADER, pojo.BlockHeader{}, "crawler_block_header",
+		"Every new Ethereum block header, with numbers in decimal and the block reward in ETH and USD")
+	Register(config.REDIS_TOPIC_CMC_GLOBAL_METRICS, pojo.GlobalMetrics{}, "cmc_global_metrics",
+		"CoinMarketCap global metrics in USD, every 10 minutes")
+	Register(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL, pojo.CurrencyPrice{}, "cmc_price_crawler, mark_price",
+		"USD prices of currencies from CoinMarketCap and Binance mark prices")
+	Register(config.REDIS_TOPIC_ETH_GAS_PRICE, pojo.GasPriceMsg{}, "crawler_gas_price",
+		"Ethereum gas prices in Wei from gasnow, every 5 seconds")
+	Register(config.REDIS_TOPIC_FUNDING_RATE, pojo.CarbonbotMessage{}, "carbonbot",
+		"Funding rates of all exchanges, consumed by mark_price")
+}
+
+// Register adds or replaces a topic, sample is a value of its payload type.
+func Register(name string, sample interface{}, producer, description string) *Topic {
+	t := reflect.TypeOf(sample)
+	topic := &Topic{
+		Name:        name,
+		Type:        t,
+		Producer:    producer,
+		Description: description,
+		schema:      schemaOf(t),
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	topics[name] = topic
+	return topic
+}
+
+func Lookup(name string) (*Topic, bool) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	topic, ok := topics[name]
+	return topic, ok
+}
+
+// Topics returns all registered topics sorted by name.
+func Topics() []*Topic {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	list := make([]*Topic, 0, len(topics))
+	for _, topic := range topics {
+		list = append(list, topic)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Schema returns the JSON Schema of the payload of topic.
+func (topic *Topic) Schema() map[string]interface{} {
+	schema := map[string]interface{}{
+		"$schema":     JSON_SCHEMA_DRAFT,
+		"title":       topic.Name,
+		"description": topic.Description,
+	}
+	for key, value := range topic.schema {
+		schema[key] = value
+	}
+	return schema
+}
+
+// Validate checks the payload msg against the schema of topic. Unknown
+// fields are allowed, so producers can add fields without breaking anyone.
+func (topic *Topic) Validate(msg []byte) error {
+	var value interface{}
+	if err := unmarshalNumbers(msg, &value); err != nil {
+		return &ValidationError{topic.Name, "", err.Error()}
+	}
+	if path, reason, ok := validate(topic.schema, value, ""); !ok {
+		return &ValidationError{topic.Name, path, reason}
+	}
+	return nil
+}
+
+// ValidationError tells where a message differs from the schema of its topic.
+type ValidationError struct {
+	Topic  string
+	Path   string // JSON pointer of the offending value, empty for the whole message
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Path) == 0 {
+		return "invalid message on " + e.Topic + ": " + e.Reason
+	}
+	return "invalid message on " + e.Topic + " at " + e.Path + ": " + e.Reason
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
@@ -0,0 +1,96 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/soulmachine/coinsignal/config"
+	"github.com/soulmachine/coinsignal/pojo"
+)
+
+func TestSchema(t *testing.T) {
+	topic, ok := Lookup(config.REDIS_TOPIC_CURRENCY_PRICE_CHANNEL)
+	if !ok {
+		t.Fatal("currency prices aren't registered")
+	}
+	bytes, _ := json.Marshal(topic.Schema())
+	actual := make(map[string]interface{})
+	json.Unmarshal(bytes, &actual)
+
+	expected := make(map[string]interface{})
+	json.Unmarshal([]byte(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title": "carbonbot:misc:currency_price_channel",
+		"description": "USD prices of currencies from CoinMarketCap and Binance mark prices",
+		"type": "object",
+		"properties": {"currency": {"type": "string"}, "price": {"type": "number"}},
+		"required": ["currency", "price"]
+	}`), &expected)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %s", bytes)
+	}
+
+	for _, name := range config.REDIS_TOPICS {
+		if _, ok := Lookup(name); !ok {
+			t.Errorf("%s isn't registered", name)
+		}
+	}
+}
+
+func marshal(v interface{}) []byte {
+	bytes, _ := json.Marshal(v)
+	return bytes
+}
+
+// Optional fields keep their wire format.
+func TestOptionalField(t *testing.T) {
+	header, _ := Lookup(config.REDIS_TOPIC_ETH_BLOCK_HEADER)
+	for _, name := range header.Schema()["required"].([]string) {
+		if name == "slow" {
+			t.Error("slow should be optional")
+		}
+	}
+	if bytes := marshal(pojo.BlockHeader{}); !strings.Contains(string(bytes), `"slow":0`) {
+		t.Errorf("slow should be serialized, got %s", bytes)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	header, _ := Lookup(config.REDIS_TOPIC_ETH_BLOCK_HEADER)
+	gas, _ := Lookup(config.REDIS_TOPIC_ETH_GAS_PRICE)
+
+	cases := []struct {
+		topic *Topic
+		msg   string
+		valid bool
+		path  string
+	}{
+		// unknown fields such as hash are fine, slow is optional
+		{header, `{"number":13440000,"miner":"0xea67","gasLimit":30000000,"gasUsed":12000000,"reward":2.1,"reward_usd":7980.5,"timestamp":1634533200,"hash":"0x1"}`, true, ""},
+		{header, `{"number":13440000,"miner":"0xea67","gasLimit":30000000,"gasUsed":12000000,"reward":2.1,"reward_usd":7980.5,"slow":"0","timestamp":1634533200}`, false, "/slow"},
+		// hex strings left behind by jsonparser
+		{header, `{"number":"0xcd1600","miner":"0xea67","gasLimit":30000000,"gasUsed":12000000,"reward":2.1,"reward_usd":7980.5,"timestamp":1634533200}`, false, "/number"},
+		{header, `{"number":13440000,"miner":"0xea67","gasLimit":30000000,"gasUsed":12000000,"reward":2.1,"timestamp":1634533200}`, false, "/reward_usd"},
+		{gas, `{"rapid":60000000000,"fast":50000000000,"standard":40000000000,"slow":30000000000,"timestamp":1634533200000,"priceUSD":3800.5}`, true, ""},
+		{gas, `{"rapid":60000000000.5,"fast":50000000000,"standard":40000000000,"slow":30000000000,"timestamp":1634533200000,"priceUSD":3800.5}`, false, "/rapid"},
+		{gas, `{"rapid":-1,"fast":50000000000,"standard":40000000000,"slow":30000000000,"timestamp":1634533200000,"priceUSD":3800.5}`, false, "/rapid"},
+		{gas, `[]`, false, ""},
+	}
+	for i, c := range cases {
+		err := c.topic.Validate([]byte(c.msg))
+		validation_error := &ValidationError{}
+		switch {
+		case c.valid:
+			if err != nil {
+				t.Errorf("case %d: %v", i, err)
+			}
+		case !errors.As(err, &validation_error):
+			t.Errorf("case %d: expected a ValidationError, got %v", i, err)
+		case validation_error.Path != c.path:
+			t.Errorf("case %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const JSON_SCHEMA_DRAFT = "https://json-schema.org/draft/2020-12/schema"
+
+// schemaOf derives a JSON Schema from a Go type the way encoding/json
+// marshals it, fields tagged omitempty or schema:"optional" are optional.
+func schemaOf(t reflect.Type) map[string]interface{} {
+	if t == rawMessageType {
+		return map[string]interface{}{} // anything
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string"} // base64
+		}
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := make([]string, 0)
+		addFields(t, properties, &required)
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && len(name) == 0 && field.Type.Kind() == reflect.Struct {
+			addFields(field.Type, properties, required) // embedded fields are promoted
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type)
+		optional := strings.Contains(options, "omitempty") || field.Tag.Get("schema") == "optional"
+		if !optional && field.Type.Kind() != reflect.Ptr {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func unmarshalNumbers(msg []byte, value *interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(msg))
+	decoder.UseNumber() // keep integers exact
+	return decoder.Decode(value)
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// validate returns the path of the first violation of schema in value and why.
+func validate(schema map[string]interface{}, value interface{}, path string) (string, string, bool) {
+	expected, ok := schema["type"].(string)
+	if !ok {
+		return "", "", true
+	}
+	mismatch := func() (string, string, bool) {
+		return path, fmt.Sprintf("expected %s, got %s", expected, typeName(value)), false
+	}
+
+	switch expected {
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return mismatch()
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return mismatch()
+		}
+	case "number", "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return mismatch()
+		}
+		f, err := strconv.ParseFloat(string(number), 64)
+		if err != nil {
+			return mismatch()
+		}
+		if expected == "integer" && f != math.Trunc(f) {
+			return path, "expected integer, got " + string(number), false
+		}
+		if minimum, ok := schema["minimum"].(int); ok && f < float64(minimum) {
+			return path, fmt.Sprintf("%s is less than %d", number, minimum), false
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		if item_schema, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range items {
+				if p, reason, ok := validate(item_schema, item, path+"/"+strconv.Itoa(i)); !ok {
+					return p, reason, false
+				}
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		if required, ok := schema["required"].([]string); ok {
+			for _, name := range required {
+				if _, ok := object[name]; !ok {
+					return path + "/" + name, "missing", false
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		for name, field := range object {
+			field_schema, ok := properties[name].(map[string]interface{})
+			if !ok {
+				field_schema = additional // nil allows unknown fields
+			}
+			if p, reason, ok := validate(field_schema, field, path+"/"+name); !ok {
+				return p, reason, false
+			}
+		}
+	}
+	return "", "", true
+}
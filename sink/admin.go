@@ -0,0 +1,143 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+// AdminServer controls the rolling files of a FileSink over HTTP, on a Unix
+// socket or a local address:
+//
+//	GET  /status           the utils.RollingFileStatus of every file
+//	POST /roll[?file=...]  rolls every file, or one such as cmc.prices
+//	POST /flush[?file=...] flushes every file, or one
+type AdminServer struct {
+	listener net.Listener
+	server   *http.Server
+	sink     *FileSink
+}
+
+// NewAdminServer listens on address, a socket path if network is unix or
+// such as 127.0.0.1:6060 if tcp.
+func NewAdminServer(network, address string, sink *FileSink) (*AdminServer, error) {
+	if network == "unix" {
+		// left behind by a crashed process
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	admin := &AdminServer{listener: listener, sink: sink}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", admin.status)
+	mux.HandleFunc("/roll", admin.control((*utils.RollingFile).Roll))
+	mux.HandleFunc("/flush", admin.control((*utils.RollingFile).Flush))
+	admin.server = &http.Server{Handler: mux}
+	go func() {
+		if err := admin.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println(err)
+		}
+	}()
+	return admin, nil
+}
+
+// NewAdminServerFromEnv listens on ADMIN_ADDR if set, otherwise on the Unix
+// socket ADMIN_SOCKET, which defaults to DATA_DIR/<name>.sock.
+func NewAdminServerFromEnv(data_dir, name string, sink *FileSink) (*AdminServer, error) {
+	if addr := os.Getenv("ADMIN_ADDR"); len(addr) > 0 {
+		return NewAdminServer("tcp", addr, sink)
+	}
+	socket := os.Getenv("ADMIN_SOCKET")
+	if len(socket) == 0 {
+		socket = path.Join(data_dir, name+".sock")
+	}
+	return NewAdminServer("unix", socket, sink)
+}
+
+// Addr returns the address listened on.
+func (admin *AdminServer) Addr() net.Addr {
+	return admin.listener.Addr()
+}
+
+func (admin *AdminServer) Close() {
+	admin.server.Close()
+}
+
+// files returns the files named by the file parameter, all if empty.
+func (admin *AdminServer) files(r *http.Request) ([]*utils.RollingFile, bool) {
+	files := admin.sink.Files()
+	if filename := r.URL.Query().Get("file"); len(filename) > 0 {
+		rf, ok := files[filename]
+		return []*utils.RollingFile{rf}, ok
+	}
+	filenames := make([]string, 0, len(files))
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	selected := make([]*utils.RollingFile, 0, len(files))
+	for _, filename := range filenames {
+		selected = append(selected, files[filename])
+	}
+	return selected, true
+}
+
+func (admin *AdminServer) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	files, ok := admin.files(r)
+	if !ok {
+		http.Error(w, "no such file", http.StatusNotFound)
+		return
+	}
+	reply(w, files)
+}
+
+// control runs op on the files requested, then replies with their status.
+func (admin *AdminServer) control(op func(*utils.RollingFile) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		files, ok := admin.files(r)
+		if !ok {
+			http.Error(w, "no such file", http.StatusNotFound)
+			return
+		}
+		for _, rf := range files {
+			if err := op(rf); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		reply(w, files)
+	}
+}
+
+func reply(w http.ResponseWriter, files []*utils.RollingFile) {
+	statuses := make([]utils.RollingFileStatus, 0, len(files))
+	for _, rf := range files {
+		status, err := rf.Status()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		statuses = append(statuses, status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,78 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+func TestAdminServer(t *testing.T) {
+	data_dir := t.TempDir()
+	file_sink := NewFileSink(data_dir)
+	defer file_sink.Close()
+	file_sink.SetOptions("carbonbot.misc.test", utils.RollingFileOptions{Compression: utils.COMPRESSION_NONE})
+	file_sink.SetOptions("cmc.prices", utils.RollingFileOptions{Compression: utils.COMPRESSION_NONE})
+	file_sink.Write("carbonbot:misc:test", "{}")
+	file_sink.Write("cmc.prices", `{"id":1}`)
+
+	// left behind by a crashed process
+	socket := path.Join(data_dir, "test.sock")
+	if listener, err := net.Listen("unix", socket); err == nil {
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		listener.Close()
+	}
+	admin, err := NewAdminServerFromEnv(data_dir, "test", file_sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	request := func(method, url string) ([]utils.RollingFileStatus, int) {
+		req, _ := http.NewRequest(method, "http://admin"+url, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		statuses := make([]utils.RollingFileStatus, 0)
+		json.NewDecoder(resp.Body).Decode(&statuses)
+		return statuses, resp.StatusCode
+	}
+
+	statuses, code := request(http.MethodPost, "/flush")
+	if code != http.StatusOK || len(statuses) != 2 || statuses[0].Filename != "carbonbot.misc.test" || statuses[1].Bytes != 9 {
+		t.Fatalf("unexpected statuses %+v, %d", statuses, code)
+	}
+	if bytes, _ := os.ReadFile(statuses[1].ActivePath); string(bytes) != "{\"id\":1}\n" {
+		t.Errorf("unexpected active file %q", bytes)
+	}
+
+	statuses, code = request(http.MethodPost, "/roll?file=cmc.prices")
+	if code != http.StatusOK || len(statuses) != 1 || statuses[0].Bytes != 0 || statuses[0].LastRoll.IsZero() {
+		t.Fatalf("unexpected statuses %+v, %d", statuses, code)
+	}
+	if bytes, _ := os.ReadFile(statuses[0].LastSegment); string(bytes) != "{\"id\":1}\n" {
+		t.Errorf("unexpected segment %q", bytes)
+	}
+
+	statuses, _ = request(http.MethodGet, "/status")
+	if len(statuses) != 2 || statuses[0].Bytes != 3 || !statuses[0].LastRoll.IsZero() {
+		t.Errorf("unexpected statuses %+v", statuses)
+	}
+	if _, code := request(http.MethodPost, "/roll?file=unknown"); code != http.StatusNotFound {
+		t.Errorf("unexpected status code %d", code)
+	}
+	if _, code := request(http.MethodGet, "/roll"); code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status code %d", code)
+	}
+}
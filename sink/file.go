@@ -0,0 +1,85 @@
+package sink
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+// FileSink writes each topic as lines into its own rolling file under dir.
+type FileSink struct {
+	dir     string
+	mutex   sync.Mutex
+	files   map[string]*utils.RollingFile
+	options map[string]utils.RollingFileOptions // per filename
+}
+
+func NewFileSink(dir string) *FileSink {
+	return &FileSink{
+		dir:     dir,
+		files:   make(map[string]*utils.RollingFile),
+		options: make(map[string]utils.RollingFileOptions),
+	}
+}
+
+// SetOptions sets the rolling options of filename, which the environment
+// overrides, see utils.RollingFileOptionsFromEnv. Must be called before the
+// first message of the file is written.
+func (sink *FileSink) SetOptions(filename string, opts utils.RollingFileOptions) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.options[filename] = opts
+}
+
+func (sink *FileSink) Write(topic, msg string) {
+	sink.mutex.Lock()
+	rf, ok := sink.files[topic]
+	if !ok {
+		// Redis topics such as carbonbot:misc:eth_gas_price contain colons
+		filename := strings.ReplaceAll(topic, ":", ".")
+		defaults, ok := sink.options[filename]
+		if !ok {
+			defaults = utils.DEFAULT_ROLLING_FILE_OPTIONS
+		}
+		opts, err := utils.RollingFileOptionsFromEnv(filename, defaults)
+		if err != nil {
+			log.Println(err)
+			opts = defaults
+		}
+		rf, err = utils.NewRollingFileWithOptions(sink.dir, filename, opts)
+		if err != nil {
+			sink.mutex.Unlock()
+			log.Println(err) // retried by the next message
+			return
+		}
+		sink.files[topic] = rf
+	}
+	sink.mutex.Unlock()
+
+	// Dropped lines are reported by rf once in a while
+	if err := rf.Write(msg + "\n"); err != nil && !errors.Is(err, utils.ErrRollingFileFull) {
+		log.Println(err)
+	}
+}
+
+// Files returns the rolling files opened so far, by filename.
+func (sink *FileSink) Files() map[string]*utils.RollingFile {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	files := make(map[string]*utils.RollingFile, len(sink.files))
+	for topic, rf := range sink.files {
+		files[strings.ReplaceAll(topic, ":", ".")] = rf
+	}
+	return files
+}
+
+func (sink *FileSink) Close() {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	for _, rf := range sink.files {
+		rf.Close()
+	}
+}
@@ -0,0 +1,24 @@
+package sink
+
+// Implemented by pubsub.Publisher and pubsub.BatchPublisher
+type publisher interface {
+	Publish(channel, msg string)
+	Close()
+}
+
+// RedisSink publishes each topic to the Redis channel or stream of the same name.
+type RedisSink struct {
+	publisher publisher
+}
+
+func NewRedisSink(publisher publisher) *RedisSink {
+	return &RedisSink{publisher}
+}
+
+func (sink *RedisSink) Write(topic, msg string) {
+	sink.publisher.Publish(topic, msg)
+}
+
+func (sink *RedisSink) Close() {
+	sink.publisher.Close()
+}
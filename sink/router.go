@@ -0,0 +1,221 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soulmachine/coinsignal/pubsub"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+// Processed messages go to Redis, raw data such as cmc.prices go to files.
+const DEFAULT_ROUTES = "carbonbot:*=redis;*=file"
+
+const DEFAULT_BATCH_WINDOW = 100 * time.Millisecond
+
+type route struct {
+	pattern string
+	sinks   []Sink
+}
+
+// Router fans out each topic to the sinks of the first route matching it.
+type Router struct {
+	sinks  map[string]Sink
+	routes []route
+	admin  *AdminServer // of the file sink, if any
+}
+
+func NewRouter() *Router {
+	return &Router{sinks: make(map[string]Sink)}
+}
+
+// NewRouterFromEnv creates the sinks available in the environment and the
+// routes in SINK_ROUTES, which defaults to DEFAULT_ROUTES.
+//
+// The redis sink requires REDIS_URL, the file sink requires DATA_DIR, and
+// the stdout sink is always available. name identifies the crawler.
+//
+// Redis is waited for up to REDIS_WAIT_TIMEOUT if set, after which the
+// router falls back to the file sink alone.
+//
+// Files roll every 15 minutes unless set otherwise by SetFileOptions or the
+// ROLL_* environment variables, see utils.RollingFileOptionsFromEnv.
+//
+// The redis sink batches messages into pipelines if REDIS_BATCH_SIZE is
+// greater than 1, flushing at least every REDIS_BATCH_WINDOW_MS.
+//
+// The files can be rolled and flushed through an AdminServer, see
+// NewAdminServerFromEnv, or rolled by SIGHUP.
+func NewRouterFromEnv(ctx context.Context, name string) (*Router, error) {
+	router := NewRouter()
+
+	data_dir := os.Getenv("DATA_DIR")
+	if len(data_dir) == 0 {
+		log.Println("The DATA_DIR environment variable is empty")
+	} else {
+		if _, err := utils.RollingFileOptionsFromEnv("", utils.DEFAULT_ROLLING_FILE_OPTIONS); err != nil {
+			return nil, err
+		}
+		router.AddSink("file", NewFileSink(data_dir))
+	}
+
+	redis_url := os.Getenv("REDIS_URL")
+	redis_ready := len(redis_url) > 0
+	if !redis_ready {
+		log.Println("The REDIS_URL environment variable is empty")
+	} else {
+		opts, err := utils.RedisWaitOptionsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		if err := utils.WaitRedis(ctx, redis_url, opts); err != nil {
+			// Keep archiving if Redis doesn't show up, unless asked to stop
+			if !errors.Is(err, utils.ErrRedisWaitTimeout) || len(router.sinks) == 0 {
+				return nil, err
+			}
+			log.Println(err)
+			log.Println("Running in file-only mode")
+			redis_ready = false
+		}
+	}
+	if redis_ready {
+		publisher := pubsub.NewPublisher(ctx, redis_url)
+		if err := publisher.EnableOutboxFromEnv(name); err != nil {
+			return nil, err
+		}
+		batch_size, batch_window, err := batchOptionsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		if batch_size > 1 {
+			router.AddSink("redis", NewRedisSink(pubsub.NewBatchPublisher(publisher, batch_window, batch_size)))
+		} else {
+			router.AddSink("redis", NewRedisSink(publisher))
+		}
+	}
+
+	if len(router.sinks) == 0 {
+		return nil, errors.New("Both DATA_DIR and REDIS_URL are empty")
+	}
+	router.AddSink("stdout", NewStdoutSink())
+
+	routes := os.Getenv("SINK_ROUTES")
+	if len(routes) == 0 {
+		routes = DEFAULT_ROUTES
+	}
+	if err := router.ParseRoutes(routes); err != nil {
+		router.Close()
+		return nil, err
+	}
+	if file_sink, ok := router.sinks["file"].(*FileSink); ok {
+		admin, err := NewAdminServerFromEnv(data_dir, name, file_sink)
+		if err != nil {
+			log.Println(err) // SIGHUP still rolls
+		} else {
+			router.admin = admin
+		}
+	}
+	return router, nil
+}
+
+func batchOptionsFromEnv() (int, time.Duration, error) {
+	batch_size := 0
+	if value := os.Getenv("REDIS_BATCH_SIZE"); len(value) > 0 {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid REDIS_BATCH_SIZE %s", value)
+		}
+		batch_size = n
+	}
+	batch_window := DEFAULT_BATCH_WINDOW
+	if value := os.Getenv("REDIS_BATCH_WINDOW_MS"); len(value) > 0 {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid REDIS_BATCH_WINDOW_MS %s", value)
+		}
+		batch_window = time.Duration(n) * time.Millisecond
+	}
+	return batch_size, batch_window, nil
+}
+
+func (router *Router) AddSink(name string, sink Sink) {
+	router.sinks[name] = sink
+}
+
+// SetFileOptions sets the rolling options of filename if there is a file
+// sink, see FileSink.SetOptions.
+func (router *Router) SetFileOptions(filename string, opts utils.RollingFileOptions) {
+	if file_sink, ok := router.sinks["file"].(*FileSink); ok {
+		file_sink.SetOptions(filename, opts)
+	}
+}
+
+// AddRoute sends topics matching pattern, see path.Match, to the named sinks.
+//
+// Names of sinks that aren't configured are ignored, so that the same routes
+// work with or without DATA_DIR or REDIS_URL.
+func (router *Router) AddRoute(pattern string, names ...string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid route pattern %s: %v", pattern, err)
+	}
+	sinks := make([]Sink, 0, len(names))
+	for _, name := range names {
+		if sink, ok := router.sinks[name]; ok {
+			sinks = append(sinks, sink)
+		}
+	}
+	router.routes = append(router.routes, route{pattern, sinks})
+	return nil
+}
+
+// ParseRoutes adds routes in the format pattern=sink1,sink2;pattern=sink3
+func (router *Router) ParseRoutes(routes string) error {
+	for _, item := range strings.Split(routes, ";") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid route %s", item)
+		}
+		names := make([]string, 0)
+		for _, name := range strings.Split(kv[1], ",") {
+			name = strings.TrimSpace(name)
+			if len(name) > 0 {
+				names = append(names, name)
+			}
+		}
+		if err := router.AddRoute(strings.TrimSpace(kv[0]), names...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (router *Router) Write(topic, msg string) {
+	for _, route := range router.routes {
+		if matched, _ := path.Match(route.pattern, topic); matched {
+			for _, sink := range route.sinks {
+				sink.Write(topic, msg)
+			}
+			return
+		}
+	}
+}
+
+func (router *Router) Close() {
+	if router.admin != nil {
+		router.admin.Close()
+	}
+	for _, sink := range router.sinks {
+		sink.Close()
+	}
+}
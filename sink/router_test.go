@@ -0,0 +1,135 @@
+package sink
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/testutil"
+)
+
+// recordSink keeps the topics written to it.
+type recordSink struct {
+	mutex  sync.Mutex
+	topics []string
+}
+
+func (sink *recordSink) Write(topic, msg string) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.topics = append(sink.topics, topic)
+}
+
+func (sink *recordSink) Close() {}
+
+func (sink *recordSink) Topics() []string {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return append([]string{}, sink.topics...)
+}
+
+func TestParseRoutes(t *testing.T) {
+	topics := []string{"carbonbot:misc:eth_gas_price", "carbonbot:trade", "cmc.prices"}
+	tests := []struct {
+		routes string
+		redis  []string
+		file   []string
+	}{
+		{DEFAULT_ROUTES, topics[:2], topics[2:]},
+		// the first matching route wins
+		{"carbonbot:misc:*=file; carbonbot:*=redis; *=file", topics[1:2], []string{topics[0], topics[2]}},
+		{"*=redis;carbonbot:*=file", topics, []string{}},
+		// fan-out to several sinks
+		{"carbonbot:*=redis,file", topics[:2], topics[:2]},
+		// sinks that aren't configured are ignored
+		{"*=redis, kafka", topics, []string{}},
+		{"", []string{}, []string{}},
+	}
+	for _, test := range tests {
+		redis_sink, file_sink := &recordSink{}, &recordSink{}
+		router := NewRouter()
+		router.AddSink("redis", redis_sink)
+		router.AddSink("file", file_sink)
+		if err := router.ParseRoutes(test.routes); err != nil {
+			t.Fatalf("%s: %v", test.routes, err)
+		}
+		for _, topic := range topics {
+			router.Write(topic, "{}")
+		}
+		if topics := redis_sink.Topics(); !reflect.DeepEqual(topics, test.redis) {
+			t.Errorf("%s: redis received %v", test.routes, topics)
+		}
+		if topics := file_sink.Topics(); !reflect.DeepEqual(topics, test.file) {
+			t.Errorf("%s: file received %v", test.routes, topics)
+		}
+	}
+
+	for _, routes := range []string{"carbonbot:*", "[=redis"} {
+		if err := NewRouter().ParseRoutes(routes); err == nil {
+			t.Errorf("%s should be invalid", routes)
+		}
+	}
+}
+
+func TestRouterFromEnv(t *testing.T) {
+	_, redis_url := testutil.NewRedis(t)
+	t.Setenv("DATA_DIR", t.TempDir())
+	t.Setenv("SINK_ROUTES", "carbonbot:misc:*=redis,file;*=file")
+	router, err := NewRouterFromEnv(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	received := testutil.Collect(t, redis_url, "carbonbot:misc:test")
+	router.Write("carbonbot:misc:test", "{}")
+	router.Write("cmc.prices", `{"id":1}`)
+	if msg := testutil.Receive(t, received, 5*time.Second); len(msg) == 0 {
+		t.Error("empty message")
+	}
+	files := router.sinks["file"].(*FileSink).Files()
+	if _, ok := files["carbonbot.misc.test"]; !ok || len(files) != 2 {
+		t.Errorf("unexpected files %v", files)
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("unexpected message %s", msg)
+	default:
+	}
+}
+
+func TestRouterFileOnly(t *testing.T) {
+	// nothing listens on the address once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	t.Setenv("REDIS_URL", "redis://"+listener.Addr().String())
+	t.Setenv("REDIS_WAIT_TIMEOUT", "200ms")
+	t.Setenv("SINK_ROUTES", "")
+
+	// without a file sink there is nothing left to write to
+	t.Setenv("DATA_DIR", "")
+	if _, err := NewRouterFromEnv(context.Background(), "test"); err == nil {
+		t.Fatal("expected an error without Redis and DATA_DIR")
+	}
+
+	t.Setenv("DATA_DIR", t.TempDir())
+	router, err := NewRouterFromEnv(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	if _, ok := router.sinks["redis"]; ok {
+		t.Error("the redis sink should be disabled")
+	}
+	router.Write("carbonbot:misc:test", "{}")
+	router.Write("cmc.prices", `{"id":1}`)
+	if files := router.sinks["file"].(*FileSink).Files(); len(files) != 1 || files["cmc.prices"] == nil {
+		t.Errorf("unexpected files %v", files)
+	}
+}
@@ -0,0 +1,8 @@
+package sink
+
+// Sink is a destination of messages, such as Redis or a rolling file.
+type Sink interface {
+	// Write delivers msg to topic, errors are handled by the sink itself.
+	Write(topic, msg string)
+	Close()
+}
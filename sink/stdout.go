@@ -0,0 +1,23 @@
+package sink
+
+import (
+	"fmt"
+	"sync"
+)
+
+// StdoutSink prints each message prefixed by its topic, mostly for debugging.
+type StdoutSink struct {
+	mutex sync.Mutex
+}
+
+func NewStdoutSink() *StdoutSink {
+	return &StdoutSink{}
+}
+
+func (sink *StdoutSink) Write(topic, msg string) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	fmt.Println(topic, msg)
+}
+
+func (sink *StdoutSink) Close() {}
@@ -0,0 +1,90 @@
+package testutil
+
+import (
+	"context"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// EthNode fakes the newHeads subscription of an Ethereum full node.
+type EthNode struct {
+	URL string // ws:// URL to pass to ethclient.Dial
+
+	mutex         sync.Mutex
+	subscriptions []*subscription
+}
+
+type subscription struct {
+	notifier *rpc.Notifier
+	id       rpc.ID
+}
+
+func NewEthNode(t *testing.T) *EthNode {
+	t.Helper()
+	node := &EthNode{}
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &ethService{node}); err != nil {
+		t.Fatal(err)
+	}
+	http_server := httptest.NewServer(server.WebsocketHandler([]string{"*"}))
+	t.Cleanup(func() {
+		http_server.Close()
+		server.Stop()
+	})
+	node.URL = "ws" + strings.TrimPrefix(http_server.URL, "http")
+	return node
+}
+
+// Subscribers returns the number of newHeads subscriptions so far.
+func (node *EthNode) Subscribers() int {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return len(node.subscriptions)
+}
+
+// NewHead sends a header to every newHeads subscriber.
+func (node *EthNode) NewHead(header *types.Header) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	for _, sub := range node.subscriptions {
+		sub.notifier.Notify(sub.id, header)
+	}
+}
+
+// NewHeader returns a plausible mainnet header with the given number.
+func NewHeader(number int64) *types.Header {
+	return &types.Header{
+		ParentHash: common.HexToHash("0x01"),
+		Coinbase:   common.HexToAddress("0xea674fdde714fd979de3edf0f56aa9716b898ec8"),
+		Difficulty: big.NewInt(10000000000000000),
+		Number:     big.NewInt(number),
+		GasLimit:   30000000,
+		GasUsed:    15000000,
+		Time:       1634533200,
+		BaseFee:    big.NewInt(50000000000),
+	}
+}
+
+type ethService struct {
+	node *EthNode
+}
+
+// NewHeads is called by eth_subscribe("newHeads")
+func (service *ethService) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	sub := notifier.CreateSubscription()
+	service.node.mutex.Lock()
+	service.node.subscriptions = append(service.node.subscriptions, &subscription{notifier, sub.ID})
+	service.node.mutex.Unlock()
+	return sub, nil
+}
@@ -0,0 +1,108 @@
+package testutil
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// NewCMCServer fakes the CoinMarketCap REST API, serving the global metrics
+// at /v1/global-metrics/quotes/latest and a listing of currencies, id to
+// symbol, at /data-api/v3/cryptocurrency/listing.
+func NewCMCServer(t *testing.T, currencies map[int64]string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/global-metrics/quotes/latest", func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("X-CMC_PRO_API_KEY")) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"status":{"error_code":1002,"error_message":"API key missing."}}`)
+			return
+		}
+		fmt.Fprint(w, CMC_GLOBAL_METRICS)
+	})
+	mux.HandleFunc("/data-api/v3/cryptocurrency/listing", func(w http.ResponseWriter, r *http.Request) {
+		items := make([]string, 0, len(currencies))
+		for id, symbol := range currencies {
+			items = append(items, fmt.Sprintf(`{"id":%d,"name":"%s","symbol":"%s"}`, id, symbol, symbol))
+		}
+		fmt.Fprintf(w, `{"data":{"cryptoCurrencyList":[%s],"totalCount":"%d"},"status":{"error_code":"0"}}`, strings.Join(items, ","), len(items))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// A trimmed response of /v1/global-metrics/quotes/latest
+const CMC_GLOBAL_METRICS = `{"status":{"error_code":0},"data":{"active_cryptocurrencies":7000,"active_exchanges":400,"btc_dominance":44.5,"eth_dominance":18.9,"quote":{"USD":{"total_market_cap":2500000000000.5,"total_volume_24h":100000000000.5,"last_updated":"2021-10-18T05:00:00.000Z"}},"last_updated":"2021-10-18T05:00:00.000Z"}}`
+
+// NewEtherscanServer fakes the block reward API of Etherscan, reward is in Wei.
+func NewEtherscanServer(t *testing.T, reward string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("module") != "block" || query.Get("action") != "getblockreward" {
+			fmt.Fprint(w, `{"status":"0","message":"NOTOK","result":"Error! Missing Or invalid Module name"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"status":"1","message":"OK","result":{"blockNumber":"%s","blockReward":"%s","uncles":[],"uncleInclusionReward":"0"}}`, query.Get("blockno"), reward)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// A response of https://etherchain.org/api/gasnow
+const GASNOW_GAS_PRICE = `{"code":200,"data":{"rapid":60000000000,"fast":50000000000,"standard":40000000000,"slow":30000000000,"timestamp":1634533200000,"priceUSD":3800.5}}`
+
+// NewGasnowServer fakes the gasnow API, serving GASNOW_GAS_PRICE.
+func NewGasnowServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, GASNOW_GAS_PRICE)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// NewWebSocketServer serves each WebSocket connection with handler, the
+// server URL returned starts with ws://.
+func NewWebSocketServer(t *testing.T, handler func(conn *websocket.Conn)) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handler(conn)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// NewCMCStreamServer fakes wss://stream.coinmarketcap.com/price/latest, it
+// waits for the subscribe command, then sends a price update for each id.
+func NewCMCStreamServer(t *testing.T, prices map[int64]float64) string {
+	t.Helper()
+	return NewWebSocketServer(t, func(conn *websocket.Conn) {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		for id, price := range prices {
+			msg := fmt.Sprintf(`{"d":{"cr":{"id":%d,"p":%v,"p24h":1.5,"mc":1000000}},"s":"0","t":"1634533200000"}`, id, price)
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+				return
+			}
+		}
+		// keep the connection open until the client closes it
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+}
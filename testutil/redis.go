@@ -0,0 +1,82 @@
+// Package testutil provides in-process stand-ins for Redis and the third-party
+// APIs used by the crawlers, so that every cmd can run end to end in go test.
+package testutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+// NewRedis starts an in-process Redis-compatible server, stopped when the test ends.
+//
+// It also points REDIS_URL at the server and unsets DATA_DIR, so tests opt in
+// to file output explicitly.
+func NewRedis(t *testing.T) (*miniredis.Miniredis, string) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	redis_url := "redis://" + server.Addr()
+	t.Setenv("REDIS_URL", redis_url)
+	t.Setenv("DATA_DIR", "")
+	return server, redis_url
+}
+
+// Collect subscribes to channel and returns the payloads received, call it
+// before the messages are published.
+func Collect(t *testing.T, redis_url, channel string) <-chan string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	rdb := utils.NewRedisClient(redis_url)
+	pubsub := rdb.Subscribe(ctx, channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		pubsub.Close()
+		rdb.Close()
+	})
+
+	out := make(chan string, 1024)
+	go func() {
+		for msg := range pubsub.Channel() {
+			out <- msg.Payload
+		}
+	}()
+	return out
+}
+
+// Receive waits up to timeout for the next message from ch.
+func Receive(t *testing.T, ch <-chan string, timeout time.Duration) string {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for a message")
+		return ""
+	}
+}
+
+// WaitSubscribers waits until channel has at least n subscribers.
+func WaitSubscribers(t *testing.T, server *miniredis.Miniredis, channel string, n int) {
+	t.Helper()
+	Eventually(t, 5*time.Second, func() bool {
+		return server.PubSubNumSub(channel)[channel] >= n
+	})
+}
+
+// Eventually polls cond every 10ms and fails the test if it isn't true within timeout.
+func Eventually(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
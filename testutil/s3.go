@@ -0,0 +1,244 @@
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// S3Server fakes the part of the S3 API used by minio-go to put, get, stat
+// and list objects, including multipart uploads, with path-style URLs and
+// no authentication.
+type S3Server struct {
+	*httptest.Server
+
+	mutex      sync.Mutex
+	objects    map[string][]byte // bucket/key
+	uploads    map[string]map[int][]byte
+	next_id    int
+	fail_puts  int // the next puts to fail
+	multiparts int // completed multipart uploads
+}
+
+func NewS3Server(t *testing.T) *S3Server {
+	t.Helper()
+	s3 := &S3Server{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+	s3.Server = httptest.NewServer(http.HandlerFunc(s3.handle))
+	t.Cleanup(s3.Server.Close)
+	return s3
+}
+
+func (s3 *S3Server) Object(bucket, key string) ([]byte, bool) {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+	object, ok := s3.objects[bucket+"/"+key]
+	return object, ok
+}
+
+func (s3 *S3Server) PutObject(bucket, key string, data []byte) {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+	s3.objects[bucket+"/"+key] = data
+}
+
+// Keys returns the keys in bucket, sorted.
+func (s3 *S3Server) Keys(bucket string) []string {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+	keys := make([]string, 0)
+	for name := range s3.objects {
+		if key, ok := cutPrefix(name, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// FailPuts makes the next n puts, of objects or parts, fail with Access Denied.
+func (s3 *S3Server) FailPuts(n int) {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+	s3.fail_puts = n
+}
+
+// Multiparts returns the number of completed multipart uploads.
+func (s3 *S3Server) Multiparts() int {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+	return s3.multiparts
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return "", false
+	}
+	return s[len(prefix):], true
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// readBody decodes the aws-chunked encoding minio-go uses over plain HTTP.
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return body, err
+	}
+	decoded := make([]byte, 0, len(body))
+	reader := bufio.NewReader(bytes.NewReader(body))
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size_hex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(size_hex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return decoded, nil
+		}
+		chunk := make([]byte, size+2) // and \r\n
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, chunk[:size]...)
+	}
+}
+
+type s3Object struct {
+	Key          string
+	Size         int
+	ETag         string
+	LastModified string
+}
+
+type s3Part struct {
+	PartNumber int
+}
+
+func (s3 *S3Server) handle(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+
+	if len(key) == 0 {
+		switch {
+		case query.Has("location"):
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+		case r.Method == http.MethodGet:
+			s3.list(w, bucket, query.Get("prefix"))
+		default:
+			w.WriteHeader(http.StatusOK) // the bucket exists
+		}
+		return
+	}
+
+	name := bucket + "/" + key
+	switch r.Method {
+	case http.MethodPut:
+		if s3.fail_puts > 0 {
+			s3.fail_puts--
+			// not retried by minio-go, unlike 5xx
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>injected failure</Message></Error>`)
+			return
+		}
+		data, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if upload_id := query.Get("uploadId"); len(upload_id) > 0 {
+			part, _ := strconv.Atoi(query.Get("partNumber"))
+			s3.uploads[upload_id][part] = data
+		} else {
+			s3.objects[name] = data
+		}
+		w.Header().Set("ETag", etag(data))
+	case http.MethodPost:
+		if query.Has("uploads") {
+			s3.next_id++
+			upload_id := strconv.Itoa(s3.next_id)
+			s3.uploads[upload_id] = make(map[int][]byte)
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, bucket, key, upload_id)
+			return
+		}
+		upload_id := query.Get("uploadId")
+		complete := struct {
+			Parts []s3Part `xml:"Part"`
+		}{}
+		body, _ := readBody(r)
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data := make([]byte, 0)
+		for _, part := range complete.Parts {
+			data = append(data, s3.uploads[upload_id][part.PartNumber]...)
+		}
+		delete(s3.uploads, upload_id)
+		s3.objects[name] = data
+		s3.multiparts++
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`, bucket, key, etag(data))
+	case http.MethodDelete:
+		delete(s3.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		data, ok := s3.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message><Key>%s</Key></Error>`, key)
+			}
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	}
+}
+
+func (s3 *S3Server) list(w http.ResponseWriter, bucket, prefix string) {
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []s3Object
+	}{Name: bucket, Prefix: prefix}
+	for name, data := range s3.objects {
+		key, ok := cutPrefix(name, bucket+"/")
+		if ok && strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, s3Object{key, len(data), etag(data), time.Now().UTC().Format(time.RFC3339)})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
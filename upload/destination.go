@@ -0,0 +1,154 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Files larger than this are uploaded to S3 in parts of this size
+const DEFAULT_PART_SIZE = 64 * 1024 * 1024
+
+// Destination stores files under their key, the slash-separated path
+// relative to DATA_DIR.
+type Destination interface {
+	// Name identifies the destination in the retry state
+	Name() string
+	// Upload returns nil once the file is durably stored
+	Upload(ctx context.Context, key, file_path string) error
+}
+
+// DirDestination copies files into a local or NFS directory.
+type DirDestination struct {
+	dir string
+}
+
+func NewDirDestination(dir string) *DirDestination {
+	return &DirDestination{dir}
+}
+
+func (dest *DirDestination) Name() string {
+	return dest.dir
+}
+
+func (dest *DirDestination) Upload(ctx context.Context, key, file_path string) error {
+	in, err := os.Open(file_path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dst_path := filepath.Join(dest.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dst_path), 0755); err != nil {
+		return err
+	}
+	tmp_path := dst_path + ".tmp"
+	out, err := os.Create(tmp_path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp_path) // no-op once renamed
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp_path, dst_path)
+}
+
+// S3Destination puts files into a bucket of AWS S3 or MinIO, in parts if
+// they are larger than part_size.
+type S3Destination struct {
+	client    *minio.Client
+	dir_url   string
+	bucket    string
+	prefix    string
+	part_size uint64
+}
+
+// NewS3Destination connects to endpoint, such as https://s3.amazonaws.com
+// or http://ip:9000, dir_url is the bucket and an optional prefix, such as
+// s3://bucket/path or minio://bucket/path.
+func NewS3Destination(endpoint, access_key, secret_key, region, dir_url string) (*S3Destination, error) {
+	bucket, prefix, err := ParseDirURL(dir_url)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewS3Client(endpoint, access_key, secret_key, region)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Destination{client, dir_url, bucket, prefix, DEFAULT_PART_SIZE}, nil
+}
+
+// NewS3Client connects to endpoint, such as https://s3.amazonaws.com or
+// http://ip:9000.
+func NewS3Client(endpoint, access_key, secret_key, region string) (*minio.Client, error) {
+	endpoint_url, err := url.Parse(endpoint)
+	if err != nil || len(endpoint_url.Host) == 0 {
+		return nil, fmt.Errorf("invalid endpoint %s", endpoint)
+	}
+	return minio.New(endpoint_url.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(access_key, secret_key, ""),
+		Secure: endpoint_url.Scheme == "https",
+		Region: region,
+	})
+}
+
+// ParseDirURL splits s3://bucket/path into bucket, path/
+func ParseDirURL(dir_url string) (string, string, error) {
+	_, rest, ok := strings.Cut(dir_url, "://")
+	if !ok {
+		return "", "", fmt.Errorf("invalid %s, expected s3://bucket/path", dir_url)
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if len(bucket) == 0 {
+		return "", "", fmt.Errorf("invalid %s, expected s3://bucket/path", dir_url)
+	}
+	prefix = strings.Trim(prefix, "/")
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	return bucket, prefix, nil
+}
+
+// SetPartSize sets the size of parts of multipart uploads, at least 5MiB.
+func (dest *S3Destination) SetPartSize(part_size uint64) {
+	dest.part_size = part_size
+}
+
+func (dest *S3Destination) Name() string {
+	return dest.dir_url
+}
+
+func (dest *S3Destination) Upload(ctx context.Context, key, file_path string) error {
+	_, err := dest.client.FPutObject(ctx, dest.bucket, dest.prefix+key, file_path, minio.PutObjectOptions{
+		PartSize:    dest.part_size,
+		ContentType: contentType(key),
+	})
+	return err
+}
+
+func contentType(key string) string {
+	switch {
+	case strings.HasSuffix(key, ".gz"):
+		return "application/gzip"
+	case strings.HasSuffix(key, ".zst"):
+		return "application/zstd"
+	default:
+		return "application/json"
+	}
+}
@@ -0,0 +1,177 @@
+package upload
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+// The same alert is raised at most this often
+const ALERT_INTERVAL = 10 * time.Minute
+
+const DEFAULT_MIN_FREE_PERCENT = 10
+
+// RetentionOptions limit the segments kept in DATA_DIR once uploaded, zero
+// values disable the corresponding limit.
+type RetentionOptions struct {
+	MaxBytes       int64         // total size of local segments and manifests
+	MaxAge         time.Duration // since a segment was last modified
+	MinFreePercent float64       // of the disk, below which an alert is raised
+}
+
+var DEFAULT_RETENTION_OPTIONS = RetentionOptions{MinFreePercent: DEFAULT_MIN_FREE_PERCENT}
+
+// A segment and its manifest, deleted together
+type localSegment struct {
+	keys     []string
+	paths    []string
+	size     int64
+	mod_time time.Time
+	uploaded bool
+}
+
+// SetRetention keeps uploaded segments locally until a limit of opts is
+// reached, instead of removing them once uploaded.
+func (uploader *Uploader) SetRetention(opts RetentionOptions) {
+	uploader.retention = opts
+	uploader.keep_local = true
+}
+
+// OnAlert sets the callback of alerts, such as a nearly full disk, instead
+// of logging them.
+func (uploader *Uploader) OnAlert(fn func(string)) {
+	uploader.on_alert = fn
+}
+
+func (uploader *Uploader) alert(kind, msg string) {
+	if time.Since(uploader.last_alerts[kind]) < ALERT_INTERVAL {
+		return
+	}
+	uploader.last_alerts[kind] = time.Now()
+	if uploader.on_alert == nil {
+		log.Println("ALERT: " + msg)
+		return
+	}
+	uploader.on_alert(msg)
+}
+
+// diskUsage returns the free and total bytes of the disk holding dir.
+func diskUsage(dir string) (uint64, uint64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
+
+func (uploader *Uploader) localSegments(segments, manifests map[string]string) []*localSegment {
+	locals := make([]*localSegment, 0, len(segments))
+	add := func(local *localSegment, key, file_path string) bool {
+		info, err := os.Stat(file_path)
+		if err != nil {
+			return false
+		}
+		local.keys = append(local.keys, key)
+		local.paths = append(local.paths, file_path)
+		local.size += info.Size()
+		if info.ModTime().After(local.mod_time) {
+			local.mod_time = info.ModTime()
+		}
+		local.uploaded = local.uploaded && uploader.state.Uploaded(key, uploader.destinations)
+		return true
+	}
+	paired := make(map[string]bool)
+	for key, file_path := range segments {
+		local := &localSegment{uploaded: true}
+		if !add(local, key, file_path) {
+			continue
+		}
+		manifest_key := segmentStem(key) + utils.MANIFEST_SUFFIX
+		if manifest_path, ok := manifests[manifest_key]; ok {
+			add(local, manifest_key, manifest_path)
+			paired[manifest_key] = true
+		}
+		locals = append(locals, local)
+	}
+	for key, file_path := range manifests {
+		local := &localSegment{uploaded: true}
+		if !paired[key] && add(local, key, file_path) {
+			locals = append(locals, local)
+		}
+	}
+	sort.Slice(locals, func(i, j int) bool { return locals[i].mod_time.Before(locals[j].mod_time) })
+	return locals
+}
+
+// enforceRetention deletes uploaded segments, oldest first, while they are
+// too old, too large in total or the disk is nearly full, so that crawlers
+// keep writing the newest data. Segments not uploaded yet are never deleted.
+func (uploader *Uploader) enforceRetention(segments, manifests map[string]string) {
+	opts := &uploader.retention
+	locals := uploader.localSegments(segments, manifests)
+	var total int64
+	for _, local := range locals {
+		total += local.size
+	}
+	free, capacity, err := uploader.disk_usage(uploader.dir)
+	if err != nil {
+		log.Println(err)
+	}
+	min_free := int64(opts.MinFreePercent / 100 * float64(capacity))
+	need_free := min_free - int64(free)
+
+	var blocked int64 // size of segments which should go but aren't uploaded
+	deleted := 0
+	for _, local := range locals {
+		expired := opts.MaxAge > 0 && time.Since(local.mod_time) > opts.MaxAge
+		over := opts.MaxBytes > 0 && total-blocked > opts.MaxBytes
+		if !expired && !over && need_free <= 0 {
+			break // the rest is newer
+		}
+		if !local.uploaded {
+			blocked += local.size
+			continue
+		}
+		if !uploader.remove(local) {
+			continue
+		}
+		total -= local.size
+		need_free -= local.size
+		deleted++
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d uploaded segments, %d bytes left in %s\n", deleted, total, uploader.dir)
+	}
+
+	if opts.MaxBytes > 0 && total > opts.MaxBytes {
+		uploader.alert("max_bytes", fmt.Sprintf("%d bytes of segments in %s exceed the limit of %d, %d bytes aren't uploaded yet", total, uploader.dir, opts.MaxBytes, blocked))
+	}
+	if need_free > 0 && capacity > 0 {
+		free_percent := 100 * float64(min_free-need_free) / float64(capacity)
+		uploader.alert("disk", fmt.Sprintf("The disk of %s is nearly full, %.1f%% free, below %.1f%%", uploader.dir, free_percent, opts.MinFreePercent))
+	}
+}
+
+func (uploader *Uploader) remove(local *localSegment) bool {
+	for i, file_path := range local.paths {
+		if err := os.Remove(file_path); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+			return false
+		}
+		uploader.state.forget(local.keys[i])
+	}
+	return true
+}
+
+// cmc.prices/2021/10/18/cmc.prices.myhost.202110180615.json.gz ->
+// cmc.prices/2021/10/18/cmc.prices.myhost.202110180615
+func segmentStem(key string) string {
+	key = strings.TrimSuffix(strings.TrimSuffix(key, ".gz"), ".zst")
+	return strings.TrimSuffix(key, ".json")
+}
@@ -0,0 +1,96 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingDestination stores nothing and fails for the keys containing fail.
+type failingDestination struct {
+	fail string
+}
+
+func (dest *failingDestination) Name() string {
+	return "failing"
+}
+
+func (dest *failingDestination) Upload(ctx context.Context, key, file_path string) error {
+	if strings.Contains(key, dest.fail) {
+		return errors.New("injected failure")
+	}
+	return nil
+}
+
+func writeAged(t *testing.T, file_path string, size int, age time.Duration) {
+	t.Helper()
+	os.MkdirAll(filepath.Dir(file_path), 0755)
+	if err := os.WriteFile(file_path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file_path, time.Now().Add(-age), time.Now().Add(-age))
+}
+
+func TestRetention(t *testing.T) {
+	data_dir := t.TempDir()
+	dir := filepath.Join(data_dir, "cmc.prices/2021/10/18")
+	oldest := filepath.Join(dir, "cmc.prices.myhost.202110180600")
+	failed := filepath.Join(dir, "cmc.prices.myhost.202110180615")
+	newest := filepath.Join(dir, "cmc.prices.myhost.202110180630")
+	writeAged(t, oldest+".json.gz", 100, 3*time.Hour)
+	writeAged(t, oldest+".manifest", 10, 3*time.Hour)
+	writeAged(t, failed+".json.gz", 100, 2*time.Hour)
+	writeAged(t, newest+".json.gz", 100, time.Hour)
+
+	uploader, err := NewUploader(data_dir, []Destination{&failingDestination{"0615"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := uint64(50)
+	uploader.disk_usage = func(dir string) (uint64, uint64, error) { return free, 1000, nil }
+	alerts := make([]string, 0)
+	uploader.OnAlert(func(msg string) { alerts = append(alerts, msg) })
+	uploader.SetRetention(RetentionOptions{MaxBytes: 250})
+
+	ctx := context.Background()
+	if err := uploader.Scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// kept locally, under the limit once the oldest is removed
+	if exists(oldest+".json.gz") || exists(oldest+".manifest") {
+		t.Error("the oldest segment and its manifest should be removed")
+	}
+	if !exists(failed+".json.gz") || !exists(newest+".json.gz") {
+		t.Error("the newer segments should be kept")
+	}
+	if len(alerts) != 0 {
+		t.Errorf("unexpected alerts %v", alerts)
+	}
+
+	// the disk is nearly full, the segment not uploaded is still kept
+	uploader.SetRetention(RetentionOptions{MinFreePercent: 20})
+	uploader.Scan(ctx)
+	if !exists(failed+".json.gz") || exists(newest+".json.gz") {
+		t.Error("only the uploaded segment should be removed")
+	}
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "nearly full, 15.0% free") {
+		t.Errorf("unexpected alerts %v", alerts)
+	}
+	uploader.Scan(ctx)
+	if len(alerts) != 1 {
+		t.Errorf("the alert should not be repeated, %v", alerts)
+	}
+
+	uploader.SetRetention(RetentionOptions{MaxAge: time.Hour, MaxBytes: 50})
+	uploader.Scan(ctx)
+	if !exists(failed+".json.gz") || len(alerts) != 2 || !strings.Contains(alerts[1], "100 bytes aren't uploaded yet") {
+		t.Errorf("unexpected alerts %v", alerts)
+	}
+	if keys := uploader.State().keys(); len(keys) != 1 || keys[0] != "cmc.prices/2021/10/18/cmc.prices.myhost.202110180615.json.gz" {
+		t.Errorf("unexpected state of %v", keys)
+	}
+}
@@ -0,0 +1,107 @@
+package upload
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Attempt is the upload state of a file to one destination.
+type Attempt struct {
+	Done      bool      `json:"done,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"` // failed so far
+	LastError string    `json:"last_error,omitempty"`
+	NextRetry time.Time `json:"next_retry,omitempty"`
+}
+
+// State keeps the attempts of every file waiting for upload, by key and
+// destination name, across restarts.
+type State struct {
+	path  string
+	mutex sync.Mutex
+	files map[string]map[string]*Attempt
+}
+
+// LoadState reads the state saved at state_path, if any.
+func LoadState(state_path string) (*State, error) {
+	state := &State{path: state_path, files: make(map[string]map[string]*Attempt)}
+	bytes, err := os.ReadFile(state_path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &state.files); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Save writes the state atomically.
+func (state *State) Save() error {
+	state.mutex.Lock()
+	bytes, err := json.Marshal(state.files)
+	state.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(state.path+".tmp", bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(state.path+".tmp", state.path)
+}
+
+// Attempt returns the state of key at destination.
+func (state *State) Attempt(key, destination string) Attempt {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if attempt, ok := state.files[key][destination]; ok {
+		return *attempt
+	}
+	return Attempt{}
+}
+
+// Uploaded tells whether key is stored in every destination.
+func (state *State) Uploaded(key string, destinations []Destination) bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	for _, destination := range destinations {
+		if attempt, ok := state.files[key][destination.Name()]; !ok || !attempt.Done {
+			return false
+		}
+	}
+	return true
+}
+
+func (state *State) update(key, destination string, fn func(*Attempt)) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if _, ok := state.files[key]; !ok {
+		state.files[key] = make(map[string]*Attempt)
+	}
+	attempt, ok := state.files[key][destination]
+	if !ok {
+		attempt = &Attempt{}
+		state.files[key][destination] = attempt
+	}
+	fn(attempt)
+}
+
+func (state *State) forget(key string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	delete(state.files, key)
+}
+
+// keys returns the keys with a state.
+func (state *State) keys() []string {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	keys := make([]string, 0, len(state.files))
+	for key := range state.files {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,366 @@
+// Package upload moves the segments rolled under DATA_DIR to one or more
+// destinations, a directory, AWS S3 or MinIO, and removes a local file only
+// once every destination has it, right away or when the retention limits
+// are reached.
+package upload
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+const (
+	// Retry state kept in DATA_DIR, not ending in .json so it is never uploaded
+	STATE_FILENAME = "uploader.state"
+
+	// Plain .json files, such as those rotated by logrotate, may still be
+	// written for a while, they are compressed once older than this
+	MIN_AGE = time.Minute
+
+	MIN_RETRY_BACKOFF = 3 * time.Second
+	MAX_RETRY_BACKOFF = 5 * time.Minute
+
+	DEFAULT_TRANSFERS = 8
+)
+
+type Uploader struct {
+	dir          string
+	destinations []Destination
+	state        *State
+	transfers    int // files uploaded concurrently
+
+	min_age     time.Duration
+	min_backoff time.Duration
+	max_backoff time.Duration
+
+	retention   RetentionOptions
+	keep_local  bool // uploaded files, until the retention removes them
+	disk_usage  func(dir string) (uint64, uint64, error)
+	on_alert    func(string)
+	last_alerts map[string]time.Time
+	index_sizes map[string]int64 // of each index when last sent to every destination
+}
+
+func NewUploader(dir string, destinations []Destination) (*Uploader, error) {
+	state, err := LoadState(filepath.Join(dir, STATE_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+	return &Uploader{
+		dir:          dir,
+		destinations: destinations,
+		state:        state,
+		transfers:    DEFAULT_TRANSFERS,
+		min_age:      MIN_AGE,
+		min_backoff:  MIN_RETRY_BACKOFF,
+		max_backoff:  MAX_RETRY_BACKOFF,
+		retention:    DEFAULT_RETENTION_OPTIONS,
+		disk_usage:   diskUsage,
+		last_alerts:  make(map[string]time.Time),
+		index_sizes:  make(map[string]int64),
+	}, nil
+}
+
+func (uploader *Uploader) SetTransfers(transfers int) {
+	uploader.transfers = transfers
+}
+
+func (uploader *Uploader) State() *State {
+	return uploader.state
+}
+
+// Run scans dir every period until ctx is cancelled.
+func (uploader *Uploader) Run(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		if err := uploader.Scan(ctx); err != nil {
+			log.Println(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan uploads the files ready in dir to the destinations which don't have
+// them yet and whose retry backoff elapsed. Manifests are uploaded after
+// their segments, so that a manifest in a destination means its segment is
+// complete there. Indexes follow once they grew, and may list segments still
+// waiting for a retry. The retention limits are enforced last.
+func (uploader *Uploader) Scan(ctx context.Context) error {
+	segments, manifests, indexes, err := uploader.ready()
+	if err != nil {
+		return err
+	}
+	uploader.uploadAll(ctx, segments)
+	pending := make(map[string]string)
+	for key, file_path := range manifests {
+		segment, ok := segmentOf(key, segments)
+		if ok && uploader.state.Uploaded(segment, uploader.destinations) || !segmentExists(file_path) {
+			pending[key] = file_path
+		}
+	}
+	uploader.uploadAll(ctx, pending)
+	uploader.uploadIndexes(ctx, indexes)
+
+	// Files removed by someone else
+	for _, key := range uploader.state.keys() {
+		_, is_segment := segments[key]
+		_, is_manifest := manifests[key]
+		if !is_segment && !is_manifest {
+			uploader.state.forget(key)
+		}
+	}
+	uploader.enforceRetention(segments, manifests)
+	return uploader.state.Save()
+}
+
+// ready returns the segments, manifests and indexes under dir by key,
+// compressing plain .json files old enough.
+func (uploader *Uploader) ready() (map[string]string, map[string]string, map[string]string, error) {
+	segments := make(map[string]string)
+	manifests := make(map[string]string)
+	indexes := make(map[string]string)
+	err := filepath.Walk(uploader.dir, func(file_path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // removed while walking
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		return uploader.readyIn(file_path, segments, manifests, indexes)
+	})
+	return segments, manifests, indexes, err
+}
+
+// readyIn adds the files ready right in dir. Segments rolled by a RollingFile
+// and their manifests are found through the index of dir, so that a segment
+// is only uploaded once complete, other files, such as those rotated by
+// logrotate, and directories written before indexes existed are listed.
+func (uploader *Uploader) readyIn(dir string, segments, manifests, indexes map[string]string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	indexed := utils.HasIndex(dir)
+	if indexed {
+		listed, corrupt, err := utils.ReadIndex(dir)
+		if err != nil {
+			return err
+		}
+		if corrupt > 0 {
+			log.Printf("Skipped %d corrupt lines of %s\n", corrupt, filepath.Join(dir, utils.INDEX_FILENAME))
+		}
+		for i := range listed {
+			if segment_path, ok := utils.SegmentPath(dir, &listed[i]); ok {
+				if err := uploader.add(segment_path, segments, manifests); err != nil {
+					return err
+				}
+			}
+			manifest_path := filepath.Join(dir, listed[i].Segment+utils.MANIFEST_SUFFIX)
+			if _, err := os.Stat(manifest_path); err == nil {
+				if err := uploader.add(manifest_path, segments, manifests); err != nil {
+					return err
+				}
+			}
+		}
+		index_path := filepath.Join(dir, utils.INDEX_FILENAME)
+		key, err := uploader.key(index_path)
+		if err != nil {
+			return err
+		}
+		indexes[key] = index_path
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		if _, is_segment := utils.ParseSegmentName(name); indexed && (is_segment || strings.HasSuffix(name, utils.MANIFEST_SUFFIX)) {
+			continue // found through the index
+		}
+		if err := uploader.add(filepath.Join(dir, name), segments, manifests); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add puts file_path into segments or manifests by key if it is one, plain
+// .json files old enough are compressed first.
+func (uploader *Uploader) add(file_path string, segments, manifests map[string]string) error {
+	name := filepath.Base(file_path)
+	if strings.HasSuffix(name, ".json") {
+		info, err := os.Stat(file_path)
+		if err != nil || time.Since(info.ModTime()) < uploader.min_age {
+			return nil
+		}
+		compressed, err := utils.CompressFile(file_path, utils.COMPRESSION_GZIP)
+		if err != nil {
+			log.Printf("Failed to compress %s: %v\n", file_path, err)
+			return nil
+		}
+		file_path = compressed
+		name = filepath.Base(compressed)
+	}
+	key, err := uploader.key(file_path)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(name, ".json.gz") || strings.HasSuffix(name, ".json.zst") {
+		segments[key] = file_path
+	} else if strings.HasSuffix(name, utils.MANIFEST_SUFFIX) {
+		manifests[key] = file_path
+	}
+	return nil
+}
+
+// key returns the key of file_path, its path relative to dir with slashes.
+func (uploader *Uploader) key(file_path string) (string, error) {
+	rel, err := filepath.Rel(uploader.dir, file_path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// segmentExists tells whether the segment of manifest_path is still local.
+func segmentExists(manifest_path string) bool {
+	stem := strings.TrimSuffix(manifest_path, utils.MANIFEST_SUFFIX)
+	for _, suffix := range []string{".json", ".json.gz", ".json.zst", ".json.compressing"} {
+		if _, err := os.Stat(stem + suffix); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentOf returns the key of the segment of manifest_key among segments.
+func segmentOf(manifest_key string, segments map[string]string) (string, bool) {
+	stem := strings.TrimSuffix(manifest_key, utils.MANIFEST_SUFFIX)
+	for _, suffix := range []string{".json.gz", ".json.zst"} {
+		if _, ok := segments[stem+suffix]; ok {
+			return stem + suffix, true
+		}
+	}
+	return "", false
+}
+
+func (uploader *Uploader) uploadAll(ctx context.Context, files map[string]string) {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // oldest first within a directory
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < uploader.transfers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				uploader.upload(ctx, key, files[key])
+			}
+		}()
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- key
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// upload sends file_path to every destination due, and removes it once all
+// have it unless kept locally.
+func (uploader *Uploader) upload(ctx context.Context, key, file_path string) {
+	if len(uploader.destinations) == 0 {
+		return
+	}
+	for _, destination := range uploader.destinations {
+		name := destination.Name()
+		attempt := uploader.state.Attempt(key, name)
+		if attempt.Done || time.Now().Before(attempt.NextRetry) {
+			continue
+		}
+		if err := destination.Upload(ctx, key, file_path); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to upload %s to %s: %v\n", key, name, err)
+			uploader.state.update(key, name, func(attempt *Attempt) {
+				attempt.Attempts++
+				attempt.LastError = err.Error()
+				attempt.NextRetry = time.Now().Add(uploader.backoff(attempt.Attempts))
+			})
+			continue
+		}
+		uploader.state.update(key, name, func(attempt *Attempt) {
+			*attempt = Attempt{Done: true}
+		})
+	}
+	if uploader.state.Uploaded(key, uploader.destinations) && !uploader.keep_local {
+		if err := os.Remove(file_path); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+			return
+		}
+		uploader.state.forget(key)
+	}
+}
+
+// uploadIndexes sends the indexes which grew since they were last sent to
+// every destination. Indexes are never removed locally, rolling files keep
+// appending to them.
+func (uploader *Uploader) uploadIndexes(ctx context.Context, indexes map[string]string) {
+	for key, file_path := range indexes {
+		info, err := os.Stat(file_path)
+		if err != nil || info.Size() == uploader.index_sizes[key] {
+			continue
+		}
+		sent := true
+		for _, destination := range uploader.destinations {
+			if err := destination.Upload(ctx, key, file_path); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Failed to upload %s to %s: %v\n", key, destination.Name(), err)
+				sent = false
+			}
+		}
+		if sent {
+			uploader.index_sizes[key] = info.Size()
+		}
+	}
+}
+
+// backoff doubles from min_backoff after each failure, up to max_backoff.
+func (uploader *Uploader) backoff(attempts int) time.Duration {
+	backoff := uploader.min_backoff
+	for i := 1; i < attempts && backoff < uploader.max_backoff; i++ {
+		backoff *= 2
+	}
+	if backoff > uploader.max_backoff {
+		backoff = uploader.max_backoff
+	}
+	return backoff
+}
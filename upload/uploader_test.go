@@ -0,0 +1,195 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soulmachine/coinsignal/testutil"
+	"github.com/soulmachine/coinsignal/utils"
+)
+
+func newS3Destination(t *testing.T, s3 *testutil.S3Server, dir_url string) *S3Destination {
+	t.Helper()
+	dest, err := NewS3Destination(s3.URL, "key", "secret", "us-east-1", dir_url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dest
+}
+
+func exists(file_path string) bool {
+	_, err := os.Stat(file_path)
+	return err == nil
+}
+
+func TestUploader(t *testing.T) {
+	data_dir := t.TempDir()
+	segment := filepath.Join(data_dir, "cmc.prices.2021-10-18-06-00.json.gz")
+	os.WriteFile(segment, []byte("segment"), 0644)
+	os.WriteFile(filepath.Join(data_dir, "cmc.prices.2021-10-18-06-00.manifest"), []byte(`{"segment":"cmc.prices.2021-10-18-06-00"}`), 0644)
+	// rotated by logrotate, old enough to be compressed
+	old := filepath.Join(data_dir, "trade.binance.json")
+	os.WriteFile(old, []byte("{}\n"), 0644)
+	os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	// maybe still written
+	fresh := filepath.Join(data_dir, "trade.okx.json")
+	os.WriteFile(fresh, []byte("{}\n"), 0644)
+	// the active file of a RollingFile
+	os.WriteFile(filepath.Join(data_dir, "cmc.prices"), []byte("{}\n"), 0644)
+
+	dest_dir := t.TempDir()
+	s3 := testutil.NewS3Server(t)
+	s3.FailPuts(1)
+	destinations := []Destination{NewDirDestination(dest_dir), newS3Destination(t, s3, "minio://bucket/path")}
+	uploader, err := NewUploader(data_dir, destinations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploader.SetTransfers(1)
+
+	ctx := context.Background()
+	if err := uploader.Scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the segment is kept until S3 has it, and its manifest waits for it
+	if !exists(segment) || !exists(filepath.Join(dest_dir, "cmc.prices.2021-10-18-06-00.json.gz")) {
+		t.Error("the segment should be in the directory only")
+	}
+	if exists(filepath.Join(dest_dir, "cmc.prices.2021-10-18-06-00.manifest")) {
+		t.Error("the manifest is uploaded before its segment")
+	}
+	if exists(old) || exists(old+".gz") {
+		t.Error("the compressed file should be uploaded and removed")
+	}
+	if keys := s3.Keys("bucket"); !reflect.DeepEqual(keys, []string{"path/trade.binance.json.gz"}) {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	// the retry state survives a restart, and the backoff is respected
+	uploader, _ = NewUploader(data_dir, destinations)
+	attempt := uploader.State().Attempt("cmc.prices.2021-10-18-06-00.json.gz", "minio://bucket/path")
+	if attempt.Attempts != 1 || !strings.Contains(attempt.LastError, "injected failure") || time.Until(attempt.NextRetry) <= 0 {
+		t.Fatalf("unexpected attempt %+v", attempt)
+	}
+	if done := uploader.State().Attempt("cmc.prices.2021-10-18-06-00.json.gz", dest_dir); !done.Done {
+		t.Errorf("unexpected attempt %+v", done)
+	}
+	uploader.Scan(ctx)
+	if !exists(segment) {
+		t.Fatal("retried before the backoff elapsed")
+	}
+
+	uploader.State().update("cmc.prices.2021-10-18-06-00.json.gz", "minio://bucket/path", func(attempt *Attempt) {
+		attempt.NextRetry = time.Time{}
+	})
+	uploader.Scan(ctx)
+	if exists(segment) || !exists(filepath.Join(dest_dir, "cmc.prices.2021-10-18-06-00.manifest")) {
+		t.Error("the segment and its manifest should be uploaded")
+	}
+	expected := []string{"path/cmc.prices.2021-10-18-06-00.json.gz", "path/cmc.prices.2021-10-18-06-00.manifest", "path/trade.binance.json.gz"}
+	if keys := s3.Keys("bucket"); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("unexpected keys %v", keys)
+	}
+	if data, _ := s3.Object("bucket", "path/cmc.prices.2021-10-18-06-00.json.gz"); string(data) != "segment" {
+		t.Errorf("unexpected object %q", data)
+	}
+	if !exists(fresh) || !exists(filepath.Join(data_dir, "cmc.prices")) {
+		t.Error("files not ready were removed")
+	}
+	if keys := uploader.State().keys(); len(keys) != 0 {
+		t.Errorf("unexpected state of %v", keys)
+	}
+}
+
+// Rolled segments are uploaded once listed in the index of their directory,
+// the index follows them.
+func TestUploaderIndex(t *testing.T) {
+	data_dir := t.TempDir()
+	dir := filepath.Join(data_dir, "cmc.prices/2021/10/18")
+	first := filepath.Join(dir, "cmc.prices.myhost.202110180600")
+	second := filepath.Join(dir, "cmc.prices.myhost.202110180615")
+	writeAged(t, first+".json.gz", 10, time.Hour)
+	writeAged(t, first+".manifest", 10, time.Hour)
+	writeAged(t, second+".json.gz", 10, time.Hour)
+	writeAged(t, filepath.Join(dir, "trade.binance.json"), 10, time.Hour)
+	index_path := filepath.Join(dir, utils.INDEX_FILENAME)
+	appendIndex := func(segment string) {
+		index, _ := os.OpenFile(index_path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		defer index.Close()
+		index.WriteString(`{"segment":"` + segment + `","name":"cmc.prices"}` + "\n")
+	}
+	appendIndex(filepath.Base(first))
+
+	dest_dir := t.TempDir()
+	uploader, err := NewUploader(data_dir, []Destination{NewDirDestination(dest_dir)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := uploader.Scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dest_dir, "cmc.prices/2021/10/18")
+	for _, name := range []string{"cmc.prices.myhost.202110180600.json.gz", "cmc.prices.myhost.202110180600.manifest", "trade.binance.json.gz", utils.INDEX_FILENAME} {
+		if !exists(filepath.Join(dest, name)) {
+			t.Errorf("%s should be uploaded", name)
+		}
+	}
+	// not listed yet, such as while its manifest is written
+	if exists(filepath.Join(dest, "cmc.prices.myhost.202110180615.json.gz")) || !exists(second+".json.gz") {
+		t.Error("the segment missing from the index should wait")
+	}
+	if exists(first+".json.gz") || !exists(index_path) {
+		t.Error("the index should be kept, unlike the segments uploaded")
+	}
+
+	appendIndex(filepath.Base(second))
+	uploader.Scan(ctx)
+	if exists(second+".json.gz") || !exists(filepath.Join(dest, "cmc.prices.myhost.202110180615.json.gz")) {
+		t.Error("the segment should be uploaded once listed")
+	}
+	local, _ := os.ReadFile(index_path)
+	if uploaded, _ := os.ReadFile(filepath.Join(dest, utils.INDEX_FILENAME)); !bytes.Equal(uploaded, local) {
+		t.Errorf("the index uploaded is %q", uploaded)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	s3 := testutil.NewS3Server(t)
+	dest := newS3Destination(t, s3, "s3://bucket")
+	dest.SetPartSize(5 * 1024 * 1024) // the minimum
+
+	data := bytes.Repeat([]byte("0123456789\n"), 1024*1024) // 11MiB
+	file_path := filepath.Join(t.TempDir(), "big.json.gz")
+	os.WriteFile(file_path, data, 0644)
+	if err := dest.Upload(context.Background(), "2021/big.json.gz", file_path); err != nil {
+		t.Fatal(err)
+	}
+	if object, _ := s3.Object("bucket", "2021/big.json.gz"); !bytes.Equal(object, data) || s3.Multiparts() != 1 {
+		t.Errorf("unexpected object of %d bytes, %d multipart uploads", len(object), s3.Multiparts())
+	}
+}
+
+func TestParseDirURL(t *testing.T) {
+	for _, tt := range []struct {
+		dir_url, bucket, prefix string
+		valid                   bool
+	}{
+		{"s3://bucket/path", "bucket", "path/", true},
+		{"minio://bucket/a/b/", "bucket", "a/b/", true},
+		{"s3://bucket", "bucket", "", true},
+		{"bucket/path", "", "", false},
+		{"s3:///path", "", "", false},
+	} {
+		bucket, prefix, err := ParseDirURL(tt.dir_url)
+		if (err == nil) != tt.valid || bucket != tt.bucket || prefix != tt.prefix {
+			t.Errorf("%s: got %q %q %v", tt.dir_url, bucket, prefix, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression of rolled segments
+const COMPRESSION_NONE = ""
+const COMPRESSION_GZIP = "gzip"
+const COMPRESSION_ZSTD = "zstd"
+
+// A rolled segment waiting to be compressed, must not end with .json,
+// otherwise the uploader picks it up
+const compressingSuffix = ".compressing"
+
+func compressionExt(compression string) string {
+	switch compression {
+	case COMPRESSION_GZIP:
+		return ".gz"
+	case COMPRESSION_ZSTD:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+func validCompression(compression string) bool {
+	return compression == COMPRESSION_NONE || compression == COMPRESSION_GZIP || compression == COMPRESSION_ZSTD
+}
+
+// compressSegment compresses src into dst, visible only once complete, and
+// removes src.
+func compressSegment(src, dst, compression string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp_path := dst + ".tmp"
+	out, err := os.Create(tmp_path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp_path) // no-op once renamed
+
+	var writer io.WriteCloser
+	switch compression {
+	case COMPRESSION_GZIP:
+		writer = gzip.NewWriter(out)
+	case COMPRESSION_ZSTD:
+		writer, err = zstd.NewWriter(out)
+		if err != nil {
+			out.Close()
+			return err
+		}
+	default:
+		out.Close()
+		return fmt.Errorf("unknown compression %s", compression)
+	}
+	if _, err := io.Copy(writer, in); err != nil {
+		writer.Close()
+		out.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp_path, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// finishSegment turns src, a rolled segment waiting for compression, into
+// its final .json, .json.gz or .json.zst file. If compression fails the
+// segment is kept uncompressed rather than lost.
+func finishSegment(src, compression string) {
+	json_path := strings.TrimSuffix(src, compressingSuffix)
+	if compression != COMPRESSION_NONE {
+		err := compressSegment(src, json_path+compressionExt(compression), compression)
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to compress %s: %v\n", src, err)
+	}
+	if err := os.Rename(src, json_path); err != nil {
+		log.Println(err)
+	}
+}
+
+// Segments of filename under dir, recursively, rolled but not compressed by
+// a previous process
+func leftoverSegments(dir, filename string) []string {
+	leftovers := make([]string, 0)
+	filepath.Walk(dir, func(file_path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		segment, ok := ParseSegmentName(strings.TrimSuffix(strings.TrimSuffix(name, compressingSuffix), ".tmp"))
+		if !ok || segment.Name != filename {
+			return nil
+		}
+		if strings.HasSuffix(name, compressingSuffix) {
+			leftovers = append(leftovers, file_path)
+		} else if strings.HasSuffix(name, ".tmp") {
+			os.Remove(file_path) // partially compressed
+		}
+		return nil
+	})
+	return leftovers
+}
+
+// CompressFile compresses src into src.gz or src.zst, visible only once
+// complete, removes src and returns the path of the compressed file.
+func CompressFile(src, compression string) (string, error) {
+	if compression == COMPRESSION_NONE {
+		return src, nil
+	}
+	dst := src + compressionExt(compression)
+	return dst, compressSegment(src, dst, compression)
+}
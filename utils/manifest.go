@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Sidecar of each segment, cmc.prices.myhost.202110180615.manifest for
+	// cmc.prices.myhost.202110180615.json.gz, not ending in .json so the uploader
+	// doesn't compress it
+	MANIFEST_SUFFIX = ".manifest"
+	// Manifests of all segments rolled in a directory, one per line, oldest first
+	INDEX_FILENAME = "segments.index"
+)
+
+// SegmentManifest describes the uncompressed content of a segment, so that
+// readers can check it is complete without decompressing it.
+type SegmentManifest struct {
+	Segment         string `json:"segment"`  // file name without .json and the compression extension
+	Name            string `json:"name"`     // the filename given to NewRollingFile
+	Producer        string `json:"producer"` // binary which wrote it
+	Lines           int64  `json:"lines"`
+	Bytes           int64  `json:"bytes"`
+	SHA256          string `json:"sha256"`                      // hex
+	FirstReceivedAt int64  `json:"first_received_at,omitempty"` // milliseconds, unknown for recovered segments
+	LastReceivedAt  int64  `json:"last_received_at"`            // milliseconds
+	Recovered       bool   `json:"recovered,omitempty"`         // left behind by a crashed process
+}
+
+// segmentStem strips .json and the compression extension from a segment name.
+func segmentStem(file_name string) string {
+	file_name = strings.TrimSuffix(file_name, compressingSuffix)
+	file_name = strings.TrimSuffix(strings.TrimSuffix(file_name, ".gz"), ".zst")
+	return strings.TrimSuffix(file_name, ".json")
+}
+
+// ManifestPath returns the path of the manifest of the segment at segment_path.
+func ManifestPath(segment_path string) string {
+	return filepath.Join(filepath.Dir(segment_path), segmentStem(filepath.Base(segment_path))+MANIFEST_SUFFIX)
+}
+
+func ReadManifest(manifest_path string) (*SegmentManifest, error) {
+	bytes, err := os.ReadFile(manifest_path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(bytes)
+}
+
+func ParseManifest(bytes []byte) (*SegmentManifest, error) {
+	manifest := &SegmentManifest{}
+	if err := json.Unmarshal(bytes, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// writeManifest writes the sidecar of a segment atomically.
+func writeManifest(dir string, manifest *SegmentManifest) error {
+	bytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifest_path := filepath.Join(dir, manifest.Segment+MANIFEST_SUFFIX)
+	if err := os.WriteFile(manifest_path+".tmp", bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(manifest_path+".tmp", manifest_path)
+}
+
+// appendIndex appends manifest to the index of dir in a single write with
+// O_APPEND, so that processes sharing the directory don't interleave lines.
+func appendIndex(dir string, manifest *SegmentManifest) error {
+	bytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	index, err := os.OpenFile(filepath.Join(dir, INDEX_FILENAME), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := index.Write(append(bytes, '\n')); err != nil {
+		index.Close()
+		return err
+	}
+	return index.Close()
+}
+
+// HasIndex tells whether segments were rolled in dir since indexes exist.
+func HasIndex(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, INDEX_FILENAME))
+	return err == nil
+}
+
+// SegmentPath returns the path of the segment of manifest, listed in the
+// index of dir, compressed or not, false while it is being compressed or
+// once removed.
+func SegmentPath(dir string, manifest *SegmentManifest) (string, bool) {
+	for _, suffix := range []string{".json.gz", ".json.zst", ".json"} {
+		segment_path := filepath.Join(dir, manifest.Segment+suffix)
+		if _, err := os.Stat(segment_path); err == nil {
+			return segment_path, true
+		}
+	}
+	return "", false
+}
+
+// ReadIndex returns the manifests listed in the index of dir, oldest first,
+// and the number of corrupt lines skipped. A missing index is empty.
+func ReadIndex(dir string) ([]SegmentManifest, int, error) {
+	file, err := os.Open(filepath.Join(dir, INDEX_FILENAME))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	return ParseIndex(file)
+}
+
+// ParseIndex reads the manifests of an index from r, see ReadIndex.
+func ParseIndex(r io.Reader) ([]SegmentManifest, int, error) {
+	manifests := make([]SegmentManifest, 0)
+	corrupt := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		manifest := SegmentManifest{}
+		if err := json.Unmarshal(scanner.Bytes(), &manifest); err != nil || len(manifest.Segment) == 0 {
+			corrupt++
+			continue
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, corrupt, scanner.Err()
+}
+
+// hashFile returns the size, number of lines and SHA-256 of file_path.
+func hashFile(file_path string) (int64, int64, string, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	var size, lines int64
+	buf := make([]byte, 1024*1024)
+	for {
+		n, err := file.Read(buf)
+		hash.Write(buf[:n])
+		size += int64(n)
+		lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, "", err
+		}
+	}
+	return size, lines, hex.EncodeToString(hash.Sum(nil)), nil
+}
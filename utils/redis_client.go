@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// NewRedisClient connects to a standalone Redis, a Sentinel-managed master or
+// a Cluster, depending on the scheme of redis_url:
+//
+//	redis://[user:password@]host:port[/db]
+//	redis+sentinel://[user:password@]host1:port1,host2:port2/master_name[/db]
+//	redis+cluster://[user:password@]host1:port1,host2:port2
+//
+// The rediss, rediss+sentinel and rediss+cluster schemes enable TLS, see
+// redisTLSConfig for the certificates. REDIS_USERNAME and REDIS_PASSWORD
+// override the ACL user in the URL, so that secrets can stay out of it.
+func NewRedisClient(redis_url string) redis.UniversalClient {
+	client, err := newRedisClient(redis_url)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return client
+}
+
+func newRedisClient(redis_url string) (redis.UniversalClient, error) {
+	scheme := strings.SplitN(redis_url, "://", 2)[0]
+	switch scheme {
+	case "redis", "rediss":
+		opt, err := redis.ParseURL(redis_url)
+		if err != nil {
+			return nil, err
+		}
+		opt.Username, opt.Password = redisCredentials(opt.Username, opt.Password)
+		if opt.TLSConfig != nil {
+			if opt.TLSConfig, err = redisTLSConfig(opt.TLSConfig.ServerName); err != nil {
+				return nil, err
+			}
+		}
+		return redis.NewClient(opt), nil
+	case "redis+sentinel", "rediss+sentinel":
+		opt, err := parseSentinelURL(redis_url)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewFailoverClient(opt), nil
+	case "redis+cluster", "rediss+cluster":
+		opt, err := parseClusterURL(redis_url)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClusterClient(opt), nil
+	default:
+		return nil, fmt.Errorf("unsupported Redis URL scheme %s", scheme)
+	}
+}
+
+func parseSentinelURL(redis_url string) (*redis.FailoverOptions, error) {
+	u, hosts, err := parseMultiHostURL(redis_url)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts[0]) == 0 || len(parts) > 2 {
+		return nil, fmt.Errorf("%s must have the master name in its path, optionally followed by the db", u.Redacted())
+	}
+	opt := &redis.FailoverOptions{
+		MasterName:    parts[0],
+		SentinelAddrs: splitAddrs(hosts, "26379"),
+	}
+	if len(parts) == 2 {
+		if opt.DB, err = strconv.Atoi(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid db %s in %s", parts[1], u.Redacted())
+		}
+	}
+	password, _ := u.User.Password()
+	opt.Username, opt.Password = redisCredentials(u.User.Username(), password)
+	// Sentinels may be protected by a password of their own
+	opt.SentinelUsername = os.Getenv("REDIS_SENTINEL_USERNAME")
+	opt.SentinelPassword = os.Getenv("REDIS_SENTINEL_PASSWORD")
+	if strings.HasPrefix(u.Scheme, "rediss") {
+		if opt.TLSConfig, err = redisTLSConfig(""); err != nil {
+			return nil, err
+		}
+	}
+	return opt, nil
+}
+
+func parseClusterURL(redis_url string) (*redis.ClusterOptions, error) {
+	u, hosts, err := parseMultiHostURL(redis_url)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.Trim(u.Path, "/")) > 0 {
+		return nil, fmt.Errorf("%s must not have a path, Redis Cluster has only db 0", u.Redacted())
+	}
+	opt := &redis.ClusterOptions{
+		Addrs: splitAddrs(hosts, "6379"),
+	}
+	password, _ := u.User.Password()
+	opt.Username, opt.Password = redisCredentials(u.User.Username(), password)
+	if strings.HasPrefix(u.Scheme, "rediss") {
+		if opt.TLSConfig, err = redisTLSConfig(""); err != nil {
+			return nil, err
+		}
+	}
+	return opt, nil
+}
+
+// url.Parse rejects host1:port1,host2:port2, so hosts are cut out before parsing.
+func parseMultiHostURL(redis_url string) (*url.URL, string, error) {
+	parts := strings.SplitN(redis_url, "://", 2)
+	if len(parts) != 2 {
+		return nil, "", fmt.Errorf("invalid Redis URL %s", redis_url)
+	}
+	authority, path := parts[1], ""
+	if i := strings.IndexAny(authority, "/?"); i >= 0 {
+		authority, path = authority[:i], authority[i:]
+	}
+	userinfo, hosts := "", authority
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		userinfo, hosts = authority[:i+1], authority[i+1:]
+	}
+	u, err := url.Parse(parts[0] + "://" + userinfo + "localhost" + path)
+	if err != nil {
+		return nil, "", err
+	}
+	u.Host = hosts
+	return u, hosts, nil
+}
+
+// Split host1:port1,host2 into addresses, adding the default port if missing.
+func splitAddrs(hosts, default_port string) []string {
+	addrs := make([]string, 0)
+	for _, addr := range strings.Split(hosts, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) == 0 {
+			continue
+		}
+		if !strings.Contains(addr, ":") {
+			addr = addr + ":" + default_port
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func redisCredentials(username, password string) (string, string) {
+	if value := os.Getenv("REDIS_USERNAME"); len(value) > 0 {
+		username = value
+	}
+	if value := os.Getenv("REDIS_PASSWORD"); len(value) > 0 {
+		password = value
+	}
+	return username, password
+}
+
+// redisTLSConfig builds the TLS config from the environment:
+//
+//	REDIS_TLS_CA_FILE               PEM file of a custom CA, the system CAs otherwise
+//	REDIS_TLS_CERT_FILE             PEM file of the client certificate
+//	REDIS_TLS_KEY_FILE              PEM file of the client private key
+//	REDIS_TLS_SERVER_NAME           to verify if it differs from the host name
+//	REDIS_TLS_INSECURE_SKIP_VERIFY  skip the server certificate verification if true
+func redisTLSConfig(server_name string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: server_name,
+	}
+	if value := os.Getenv("REDIS_TLS_SERVER_NAME"); len(value) > 0 {
+		config.ServerName = value
+	}
+
+	if ca_file := os.Getenv("REDIS_TLS_CA_FILE"); len(ca_file) > 0 {
+		pem, err := ioutil.ReadFile(ca_file)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", ca_file)
+		}
+		config.RootCAs = pool
+	}
+
+	cert_file := os.Getenv("REDIS_TLS_CERT_FILE")
+	key_file := os.Getenv("REDIS_TLS_KEY_FILE")
+	if len(cert_file) > 0 || len(key_file) > 0 {
+		cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if value := os.Getenv("REDIS_TLS_INSECURE_SKIP_VERIFY"); len(value) > 0 {
+		insecure, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_TLS_INSECURE_SKIP_VERIFY %s", value)
+		}
+		config.InsecureSkipVerify = insecure
+	}
+	return config, nil
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestParseSentinelURL(t *testing.T) {
+	opt, err := parseSentinelURL("redis+sentinel://app:secret@s1:26379,s2,s3:26380/mymaster/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt.MasterName != "mymaster" || opt.DB != 2 {
+		t.Errorf("unexpected master %s and db %d", opt.MasterName, opt.DB)
+	}
+	if !reflect.DeepEqual(opt.SentinelAddrs, []string{"s1:26379", "s2:26379", "s3:26380"}) {
+		t.Errorf("unexpected sentinels %v", opt.SentinelAddrs)
+	}
+	if opt.Username != "app" || opt.Password != "secret" {
+		t.Errorf("unexpected credentials %s:%s", opt.Username, opt.Password)
+	}
+	if opt.TLSConfig != nil {
+		t.Error("TLS should be disabled")
+	}
+
+	if _, err := parseSentinelURL("redis+sentinel://s1:26379"); err == nil {
+		t.Error("the master name is required")
+	}
+}
+
+func TestParseClusterURL(t *testing.T) {
+	t.Setenv("REDIS_PASSWORD", "from-env")
+	opt, err := parseClusterURL("rediss+cluster://app:secret@n1:7000,n2:7001,n3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(opt.Addrs, []string{"n1:7000", "n2:7001", "n3:6379"}) {
+		t.Errorf("unexpected addrs %v", opt.Addrs)
+	}
+	if opt.Username != "app" || opt.Password != "from-env" {
+		t.Errorf("unexpected credentials %s:%s", opt.Username, opt.Password)
+	}
+	if opt.TLSConfig == nil {
+		t.Error("TLS should be enabled")
+	}
+}
+
+func TestNewRedisClientKinds(t *testing.T) {
+	urls := map[string]interface{}{
+		"redis://localhost:6379/1":                &redis.Client{},
+		"rediss://localhost:6380":                 &redis.Client{},
+		"redis+sentinel://localhost:26379/master": &redis.Client{}, // failover clients are plain clients
+		"redis+cluster://localhost:7000":          &redis.ClusterClient{},
+	}
+	for redis_url, expected := range urls {
+		client, err := newRedisClient(redis_url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.TypeOf(client) != reflect.TypeOf(expected) {
+			t.Errorf("%s created a %T", redis_url, client)
+		}
+		client.Close()
+	}
+
+	if _, err := newRedisClient("http://localhost:6379"); err == nil {
+		t.Error("http should be rejected")
+	}
+	t.Setenv("REDIS_TLS_CA_FILE", "/nonexistent/ca.pem")
+	if _, err := newRedisClient("rediss://localhost:6380"); err == nil {
+		t.Error("a missing CA file should be reported")
+	}
+}
+
+func TestNewRedisClientACL(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireUserAuth("crawler", "secret")
+	ctx := context.Background()
+
+	client := NewRedisClient("redis://crawler:wrong@" + server.Addr())
+	if err := client.Ping(ctx).Err(); err == nil {
+		t.Error("wrong password should be rejected")
+	}
+	client.Close()
+
+	t.Setenv("REDIS_USERNAME", "crawler")
+	t.Setenv("REDIS_PASSWORD", "secret")
+	client = NewRedisClient("redis://" + server.Addr())
+	defer client.Close()
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Error(err)
+	}
+}
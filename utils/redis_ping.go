@@ -2,36 +2,121 @@ package utils
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
-func NewRedisClient(redis_url string) *redis.Client {
-	opt, err := redis.ParseURL(redis_url)
-	if err != nil {
-		log.Fatalln(err)
-	}
+// Causes of RedisNotReadyError, besides context.Canceled and context.DeadlineExceeded
+var ErrRedisWaitTimeout = errors.New("timed out waiting for Redis")
+var ErrRedisWaitInterrupted = errors.New("interrupted by a signal while waiting for Redis")
 
-	return redis.NewClient(opt)
+// RedisNotReadyError is returned when Redis didn't answer PING in time.
+type RedisNotReadyError struct {
+	Attempts int
+	Waited   time.Duration
+	Cause    error // why waiting stopped
+	LastErr  error // error of the last PING
 }
 
-func pingRedis(ctx context.Context, redis_url string) bool {
-	client := NewRedisClient(redis_url)
+func (e *RedisNotReadyError) Error() string {
+	return fmt.Sprintf("Redis not ready after %d attempts in %v: %v, last error: %v", e.Attempts, e.Waited.Round(time.Millisecond), e.Cause, e.LastErr)
+}
+
+func (e *RedisNotReadyError) Unwrap() error {
+	return e.Cause
+}
+
+type RedisWaitOptions struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxWait        time.Duration // 0 means forever
+}
+
+var DEFAULT_REDIS_WAIT_OPTIONS = RedisWaitOptions{
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// RedisWaitOptionsFromEnv returns the default options, with MaxWait taken
+// from REDIS_WAIT_TIMEOUT, such as 30s or 5m.
+func RedisWaitOptionsFromEnv() (RedisWaitOptions, error) {
+	opts := DEFAULT_REDIS_WAIT_OPTIONS
+	if value := os.Getenv("REDIS_WAIT_TIMEOUT"); len(value) > 0 {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid REDIS_WAIT_TIMEOUT %s", value)
+		}
+		opts.MaxWait = timeout
+	}
+	return opts, nil
+}
 
-	_, err := client.Ping(ctx).Result()
-	return err == nil
+// WaitRedis waits until the Redis at redis_url answers PING, see WaitRedisClient.
+func WaitRedis(ctx context.Context, redis_url string, opts RedisWaitOptions) error {
+	client := NewRedisClient(redis_url)
+	defer client.Close()
+	return WaitRedisClient(ctx, client, opts)
 }
 
-func WaitRedis(ctx context.Context, redis_url string) {
+// WaitRedisClient pings client with exponential backoff and jitter until it
+// answers. It gives up with a *RedisNotReadyError after opts.MaxWait, when
+// ctx is done, or on SIGINT or SIGTERM.
+func WaitRedisClient(ctx context.Context, client redis.UniversalClient, opts RedisWaitOptions) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	start := time.Now()
+	var deadline <-chan time.Time
+	if opts.MaxWait > 0 {
+		timer := time.NewTimer(opts.MaxWait)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = DEFAULT_REDIS_WAIT_OPTIONS.InitialBackoff
+	}
+	if opts.MaxBackoff < opts.InitialBackoff {
+		opts.MaxBackoff = opts.InitialBackoff
+	}
+	backoff := opts.InitialBackoff
+	not_ready := &RedisNotReadyError{}
 	for {
-		ok := pingRedis(ctx, redis_url)
-		if ok {
-			break
-		} else {
-			log.Println("Redis is not ready, sleeping for 1 second")
-			time.Sleep(1 * time.Second)
+		not_ready.Attempts++
+		not_ready.LastErr = client.Ping(ctx).Err()
+		if not_ready.LastErr == nil {
+			return nil
+		}
+
+		// sleep between backoff/2 and backoff
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Printf("Redis is not ready, sleeping for %v: %v\n", sleep.Round(time.Millisecond), not_ready.LastErr)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			not_ready.Cause = ctx.Err()
+		case <-deadline:
+			not_ready.Cause = ErrRedisWaitTimeout
+		case <-signals:
+			not_ready.Cause = ErrRedisWaitInterrupted
+		}
+		if not_ready.Cause != nil {
+			not_ready.Waited = time.Since(start)
+			return not_ready
+		}
+
+		backoff *= 2
+		if backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
 		}
 	}
 }
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+var fastWait = RedisWaitOptions{
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     50 * time.Millisecond,
+	MaxWait:        5 * time.Second,
+}
+
+func TestWaitRedisReady(t *testing.T) {
+	server := miniredis.RunT(t)
+	if err := WaitRedis(context.Background(), "redis://"+server.Addr(), fastWait); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitRedisStartsLate(t *testing.T) {
+	server := miniredis.NewMiniRedis()
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr := server.Addr()
+	server.Close()
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		server.StartAddr(addr)
+	}()
+	defer server.Close()
+	if err := WaitRedis(context.Background(), "redis://"+addr, fastWait); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitRedisTimeout(t *testing.T) {
+	server := miniredis.RunT(t)
+	addr := server.Addr()
+	server.Close()
+
+	opts := fastWait
+	opts.MaxWait = 200 * time.Millisecond
+	err := WaitRedis(context.Background(), "redis://"+addr, opts)
+	if !errors.Is(err, ErrRedisWaitTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	var not_ready *RedisNotReadyError
+	if !errors.As(err, &not_ready) || not_ready.Attempts < 2 || not_ready.LastErr == nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestWaitRedisCancelled(t *testing.T) {
+	server := miniredis.RunT(t)
+	addr := server.Addr()
+	server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	opts := fastWait
+	opts.MaxWait = 0 // forever
+	if err := WaitRedis(ctx, "redis://"+addr, opts); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context deadline, got %v", err)
+	}
+}
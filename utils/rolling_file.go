@@ -1,82 +1,759 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-const interval = 15 // roll every 15 minutes
+// Suffix of the file being written, not ending in .json so that the uploader
+// ignores it
+const ACTIVE_SUFFIX = ".active"
+
+const (
+	ROLLING_FILE_BLOCK = "block" // Write waits for room in the queue
+	ROLLING_FILE_DROP  = "drop"  // Write drops the line if the queue is full
+
+	DEFAULT_FLUSH_INTERVAL = time.Second
+	DEFAULT_FLUSH_BYTES    = 64 * 1024
+	DEFAULT_QUEUE_SIZE     = 1024
+)
+
+// RollingFileOptions decide when the active file is rolled into a segment,
+// zero values disable the corresponding trigger, and how lines are buffered,
+// zero values mean the defaults.
+type RollingFileOptions struct {
+	Interval    time.Duration // roll at every multiple of Interval, such as :00, :15, :30 and :45
+	MaxBytes    int64         // roll once the active file reaches MaxBytes
+	MaxLines    int64         // roll once the active file reaches MaxLines lines
+	IdleTimeout time.Duration // roll if nothing was written for IdleTimeout
+	Compression string        // COMPRESSION_NONE, COMPRESSION_GZIP or COMPRESSION_ZSTD
+
+	FlushInterval time.Duration // flush the buffer at least this often, DEFAULT_FLUSH_INTERVAL
+	FlushBytes    int           // flush once the buffer holds FlushBytes, DEFAULT_FLUSH_BYTES
+	QueueSize     int           // lines waiting to be written, DEFAULT_QUEUE_SIZE
+	OnFull        string        // ROLLING_FILE_BLOCK, the default, or ROLLING_FILE_DROP
+
+	Producer string // written into manifests, the name of the binary by default
+
+	PathTemplate string // where segments are rolled under dir, DEFAULT_PATH_TEMPLATE by default
+	Host         string // in segment names, Hostname() by default
+}
+
+var DEFAULT_ROLLING_FILE_OPTIONS = RollingFileOptions{Interval: 15 * time.Minute}
+
+func (opts RollingFileOptions) withDefaults() RollingFileOptions {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DEFAULT_FLUSH_INTERVAL
+	}
+	if opts.FlushBytes <= 0 {
+		opts.FlushBytes = DEFAULT_FLUSH_BYTES
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DEFAULT_QUEUE_SIZE
+	}
+	if len(opts.OnFull) == 0 {
+		opts.OnFull = ROLLING_FILE_BLOCK
+	}
+	if len(opts.Producer) == 0 {
+		opts.Producer = filepath.Base(os.Args[0])
+	}
+	if len(opts.PathTemplate) == 0 {
+		opts.PathTemplate = DEFAULT_PATH_TEMPLATE
+	}
+	if len(opts.Host) == 0 {
+		opts.Host = Hostname()
+	}
+	return opts
+}
+
+// RollingFileOptionsFromEnv overrides defaults with ROLL_INTERVAL,
+// ROLL_MAX_BYTES, ROLL_MAX_LINES, ROLL_IDLE_TIMEOUT, ROLL_COMPRESSION,
+// ROLL_FLUSH_INTERVAL, ROLL_FLUSH_BYTES, ROLL_QUEUE_SIZE, ROLL_ON_FULL and
+// ROLL_PATH_TEMPLATE,
+// and then with the same variables suffixed by the filename, such as
+// ROLL_MAX_BYTES_CMC_PRICES for cmc.prices. Durations are in the format of
+// time.ParseDuration, ROLL_COMPRESSION is none, gzip or zstd, ROLL_ON_FULL
+// is block or drop, see DEFAULT_PATH_TEMPLATE for ROLL_PATH_TEMPLATE.
+func RollingFileOptionsFromEnv(filename string, defaults RollingFileOptions) (RollingFileOptions, error) {
+	opts := defaults
+	suffixes := []string{""}
+	if len(filename) > 0 {
+		suffixes = append(suffixes, "_"+envSuffix(filename))
+	}
+	for _, suffix := range suffixes {
+		for _, item := range []struct {
+			name     string
+			duration *time.Duration
+			number   *int64
+			size     *int
+		}{
+			{"ROLL_INTERVAL", &opts.Interval, nil, nil},
+			{"ROLL_MAX_BYTES", nil, &opts.MaxBytes, nil},
+			{"ROLL_MAX_LINES", nil, &opts.MaxLines, nil},
+			{"ROLL_IDLE_TIMEOUT", &opts.IdleTimeout, nil, nil},
+			{"ROLL_FLUSH_INTERVAL", &opts.FlushInterval, nil, nil},
+			{"ROLL_FLUSH_BYTES", nil, nil, &opts.FlushBytes},
+			{"ROLL_QUEUE_SIZE", nil, nil, &opts.QueueSize},
+		} {
+			value := os.Getenv(item.name + suffix)
+			if len(value) == 0 {
+				continue
+			}
+			if item.duration != nil {
+				d, err := time.ParseDuration(value)
+				if err != nil || d < 0 {
+					return opts, fmt.Errorf("invalid %s %s", item.name+suffix, value)
+				}
+				*item.duration = d
+			} else {
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || n < 0 {
+					return opts, fmt.Errorf("invalid %s %s", item.name+suffix, value)
+				}
+				if item.number != nil {
+					*item.number = n
+				} else {
+					*item.size = int(n)
+				}
+			}
+		}
+		if value, ok := os.LookupEnv("ROLL_COMPRESSION" + suffix); ok {
+			if value == "none" {
+				value = COMPRESSION_NONE
+			}
+			if !validCompression(value) {
+				return opts, fmt.Errorf("invalid %s %s", "ROLL_COMPRESSION"+suffix, value)
+			}
+			opts.Compression = value
+		}
+		if value, ok := os.LookupEnv("ROLL_PATH_TEMPLATE" + suffix); ok {
+			if err := validPathTemplate(value); err != nil {
+				return opts, fmt.Errorf("invalid %s: %v", "ROLL_PATH_TEMPLATE"+suffix, err)
+			}
+			opts.PathTemplate = value
+		}
+		if value, ok := os.LookupEnv("ROLL_ON_FULL" + suffix); ok {
+			if value != ROLLING_FILE_BLOCK && value != ROLLING_FILE_DROP {
+				return opts, fmt.Errorf("invalid %s %s", "ROLL_ON_FULL"+suffix, value)
+			}
+			opts.OnFull = value
+		}
+	}
+	return opts, nil
+}
+
+// cmc.prices -> CMC_PRICES
+func envSuffix(filename string) string {
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(filename))
+}
+
+var (
+	ErrRollingFileClosed = errors.New("rolling file is closed")
+	ErrRollingFileFull   = errors.New("rolling file queue is full")
+)
 
 type RollingFile struct {
 	dir      string
 	filename string
-	file     *os.File
+	opts     RollingFileOptions
+	file     *os.File // nil if the active file couldn't be reopened
+	writer   *bufio.Writer
 	ch       chan string
 	ticker   *time.Ticker
 	signals  chan os.Signal
+	commands chan func() // run by the goroutine, see do
+	done     chan struct{}
+
+	mutex      sync.RWMutex // guards closed, never held while waiting for the goroutine
+	closed     bool
+	close_once sync.Once
+	sending    sync.WaitGroup // Write and do calls sending to the goroutine
+
+	error_mutex sync.Mutex // guards on_error, taken by the goroutine
+	on_error    func(error)
+
+	dropped        uint64 // lines dropped by Write, atomic
+	reported_drops uint64
+
+	bytes        int64     // written to the active file, including the buffer
+	lines        int64     // written to the active file, including the buffer
+	hash         hash.Hash // SHA-256 of the active file, including the buffer
+	rehash       bool      // if the active file differs from what was hashed
+	recovered    bool      // if the active file was left by a crashed process
+	first_write  time.Time // of the active file
+	last_write   time.Time // of the active file
+	last_flush   time.Time
+	next_roll    time.Time // by Interval, zero if disabled
+	last_roll    time.Time
+	last_segment string
+
+	compressing sync.WaitGroup // segments being compressed in the background
+}
+
+func NewRollingFile(dir string, filename string) (*RollingFile, error) {
+	return NewRollingFileWithOptions(dir, filename, DEFAULT_ROLLING_FILE_OPTIONS)
 }
 
-func NewRollingFile(dir string, filename string) *RollingFile {
-	file_path := path.Join(dir, filename)
+func NewRollingFileWithOptions(dir string, filename string, opts RollingFileOptions) (*RollingFile, error) {
+	opts = opts.withDefaults()
+	if opts.OnFull != ROLLING_FILE_BLOCK && opts.OnFull != ROLLING_FILE_DROP {
+		return nil, fmt.Errorf("invalid OnFull %s", opts.OnFull)
+	}
+	if !validCompression(opts.Compression) {
+		return nil, fmt.Errorf("invalid compression %s", opts.Compression)
+	}
+	if err := validPathTemplate(opts.PathTemplate); err != nil {
+		return nil, err
+	}
+	file_path := ActivePath(dir, filename)
+	migrateActiveFile(dir, filename)
 	file, err := os.OpenFile(file_path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	ch := make(chan string)
-	ticker := time.NewTicker(time.Minute) // check every minute
-	signals := make(chan os.Signal, 1)    // roll if SIGHUP received
-	rf := &RollingFile{dir, filename, file, ch, ticker, signals}
+	rf := &RollingFile{
+		dir:        dir,
+		filename:   filename,
+		opts:       opts,
+		file:       file,
+		writer:     bufio.NewWriterSize(file, opts.FlushBytes),
+		hash:       sha256.New(),
+		ch:         make(chan string, opts.QueueSize),
+		ticker:     time.NewTicker(checkPeriod(opts)),
+		signals:    make(chan os.Signal, 1), // roll if SIGHUP received
+		commands:   make(chan func()),
+		done:       make(chan struct{}),
+		last_flush: time.Now(),
+	}
+	rf.scheduleRoll(time.Now())
+	rf.recover()
 
-	go func() {
-		for {
-			select {
-			case text := <-ch:
-				if _, err = rf.file.WriteString(text); err != nil {
-					panic(err)
-				}
-			case <-ticker.C:
-				now := time.Now().Unix()
-				if now/60%interval == 0 {
-					rf.roll()
-				}
-			case <-signals:
+	// Compress segments rolled right before a previous process exited
+	for _, leftover := range leftoverSegments(dir, filename) {
+		log.Printf("Finishing %s rolled by a previous process\n", leftover)
+		rf.finish(leftover)
+	}
+
+	signal.Notify(rf.signals, syscall.SIGHUP)
+	go rf.run()
+	return rf, nil
+}
+
+// run owns the active file, it writes queued lines and rolls until the
+// queue is closed.
+func (rf *RollingFile) run() {
+	defer close(rf.done)
+	for {
+		select {
+		case text, ok := <-rf.ch:
+			if !ok {
+				rf.shutdown()
+				return
+			}
+			rf.write(text)
+		case now := <-rf.ticker.C:
+			rf.reportDrops()
+			if !rf.next_roll.IsZero() && !now.Before(rf.next_roll) {
 				rf.roll()
+			} else if rf.opts.IdleTimeout > 0 && rf.bytes > 0 && now.Sub(rf.last_write) >= rf.opts.IdleTimeout {
+				rf.roll()
+			} else if now.Sub(rf.last_flush) >= rf.opts.FlushInterval {
+				rf.flush()
 			}
+		case <-rf.signals:
+			rf.drain()
+			rf.roll()
+		case fn := <-rf.commands:
+			rf.drain()
+			fn()
 		}
-	}()
-	return rf
+	}
+}
+
+func (rf *RollingFile) write(text string) {
+	if rf.file == nil && !rf.reopen() {
+		atomic.AddUint64(&rf.dropped, 1)
+		return
+	}
+	if rf.writer.Available() < len(text) && rf.writer.Buffered() > 0 {
+		rf.flush() // keep lines whole on disk
+	}
+	if _, err := rf.writer.WriteString(text); err != nil {
+		rf.fail(err)
+		return
+	}
+	io.WriteString(rf.hash, text)
+	rf.bytes += int64(len(text))
+	rf.lines += int64(strings.Count(text, "\n"))
+	rf.last_write = time.Now()
+	if rf.first_write.IsZero() {
+		rf.first_write = rf.last_write
+	}
+	if (rf.opts.MaxBytes > 0 && rf.bytes >= rf.opts.MaxBytes) || (rf.opts.MaxLines > 0 && rf.lines >= rf.opts.MaxLines) {
+		rf.roll()
+	}
+}
+
+// flush writes the buffer to the active file, the buffer is also flushed
+// whenever it reaches FlushBytes.
+func (rf *RollingFile) flush() {
+	rf.last_flush = time.Now()
+	if rf.file == nil || rf.writer.Buffered() == 0 {
+		return
+	}
+	if err := rf.writer.Flush(); err != nil {
+		rf.fail(err)
+	}
+}
+
+// fail reports err and discards the buffer, bufio.Writer refuses any write
+// after an error.
+func (rf *RollingFile) fail(err error) {
+	if lost := rf.writer.Buffered(); lost > 0 {
+		err = fmt.Errorf("%w, lost %d buffered bytes", err, lost)
+	}
+	rf.report(err)
+	rf.writer.Reset(rf.file)
+	rf.rehash = true
+}
+
+func (rf *RollingFile) reopen() bool {
+	file, err := os.OpenFile(ActivePath(rf.dir, rf.filename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		rf.report(err)
+		return false
+	}
+	rf.file = file
+	rf.writer.Reset(file)
+	return true
+}
+
+func (rf *RollingFile) closeFile() {
+	if rf.file == nil {
+		return
+	}
+	rf.flush()
+	if err := rf.file.Sync(); err != nil {
+		rf.report(err)
+	}
+	if err := rf.file.Close(); err != nil {
+		rf.report(err)
+	}
+	rf.file = nil
+}
+
+// drain writes the lines queued so far, so that a roll or flush requested
+// after them includes them.
+func (rf *RollingFile) drain() {
+	for n := len(rf.ch); n > 0; n-- {
+		text, ok := <-rf.ch
+		if !ok {
+			return
+		}
+		rf.write(text)
+	}
+}
+
+func (rf *RollingFile) shutdown() {
+	signal.Stop(rf.signals)
+	rf.ticker.Stop()
+	rf.closeFile()
+	rf.reportDrops()
+	rf.compressing.Wait()
+}
+
+func (rf *RollingFile) report(err error) {
+	rf.error_mutex.Lock()
+	on_error := rf.on_error
+	rf.error_mutex.Unlock()
+	err = fmt.Errorf("%s: %w", ActivePath(rf.dir, rf.filename), err)
+	if on_error == nil {
+		log.Println(err)
+		return
+	}
+	on_error(err)
+}
+
+func (rf *RollingFile) reportDrops() {
+	dropped := atomic.LoadUint64(&rf.dropped)
+	if dropped > rf.reported_drops {
+		rf.report(fmt.Errorf("%w, dropped %d lines", ErrRollingFileFull, dropped-rf.reported_drops))
+		rf.reported_drops = dropped
+	}
+}
+
+// OnError sets the callback receiving write, flush and roll failures as well
+// as dropped lines, instead of logging them. It is called from the goroutine
+// of rf and must not block.
+func (rf *RollingFile) OnError(fn func(error)) {
+	rf.error_mutex.Lock()
+	defer rf.error_mutex.Unlock()
+	rf.on_error = fn
+}
+
+// Dropped returns the number of lines dropped because the queue was full.
+func (rf *RollingFile) Dropped() uint64 {
+	return atomic.LoadUint64(&rf.dropped)
+}
+
+// ActivePath returns the path of the file being written, segments are
+// rolled from it.
+func ActivePath(dir, filename string) string {
+	return path.Join(dir, filename+ACTIVE_SUFFIX)
+}
+
+// migrateActiveFile renames the active file of versions which wrote to
+// dir/filename, where the path template now puts a directory, so that it is
+// recovered.
+func migrateActiveFile(dir, filename string) {
+	legacy_path := path.Join(dir, filename)
+	info, err := os.Stat(legacy_path)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	if _, err := os.Stat(ActivePath(dir, filename)); !os.IsNotExist(err) {
+		log.Printf("Both %s and %s exist, leaving %s alone\n", legacy_path, ActivePath(dir, filename), legacy_path)
+		return
+	}
+	if err := os.Rename(legacy_path, ActivePath(dir, filename)); err != nil {
+		log.Println(err)
+	}
+}
+
+// How often time-based triggers are checked, every minute unless they need
+// a finer resolution.
+func checkPeriod(opts RollingFileOptions) time.Duration {
+	period := time.Minute
+	for _, d := range []time.Duration{opts.Interval / 4, opts.IdleTimeout / 4, opts.FlushInterval} {
+		if d > 0 && d < period {
+			period = d
+		}
+	}
+	if period < 10*time.Millisecond {
+		period = 10 * time.Millisecond
+	}
+	return period
+}
+
+func (rf *RollingFile) scheduleRoll(now time.Time) {
+	if rf.opts.Interval > 0 {
+		rf.next_roll = now.Truncate(rf.opts.Interval).Add(rf.opts.Interval)
+	}
 }
 
 func (rf *RollingFile) roll() {
-	rf.file.Sync()
-	rf.file.Close()
-	minute := time.Now().Format(time.RFC3339)[:16]
-	minute = strings.ReplaceAll(minute, "T", "-")
-	minute = strings.ReplaceAll(minute, ":", "-")
-	file_path := path.Join(rf.dir, rf.filename)
-	new_file_path := path.Join(rf.dir, rf.filename+"."+minute+".json")
-	err := os.Rename(file_path, new_file_path)
+	now := time.Now()
+	rf.scheduleRoll(now)
+	rf.rollAt(now)
+}
+
+// rollAt rolls the active file into a segment named after t, in UTC, with
+// its manifest. Failures are reported and the active file is kept, so nothing
+// is lost.
+func (rf *RollingFile) rollAt(t time.Time) {
+	if rf.bytes == 0 {
+		return // no empty segments
+	}
+
+	rf.closeFile()
+	file_path := ActivePath(rf.dir, rf.filename)
+	new_file_path := uniqueSegmentPath(path.Join(rf.dir, segmentPrefix(rf.opts.PathTemplate, rf.filename, rf.opts.Host, t)))
+	segment_dir := path.Dir(new_file_path)
+	if err := os.MkdirAll(segment_dir, 0755); err != nil {
+		rf.report(err)
+		rf.reopen()
+		return
+	}
+	if rf.opts.Compression != COMPRESSION_NONE {
+		// Hidden from the uploader until compressed
+		new_file_path += compressingSuffix
+	}
+
+	// The manifest comes first, a segment without one is incomplete
+	manifest, err := rf.manifest(file_path, segmentStem(path.Base(new_file_path)))
+	if err == nil {
+		err = writeManifest(segment_dir, manifest)
+	}
 	if err != nil {
-		panic(err)
+		rf.report(err)
+		manifest = nil
 	}
-	file, err := os.OpenFile(file_path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err := os.Rename(file_path, new_file_path); err != nil {
+		rf.report(err)
+		if manifest != nil {
+			os.Remove(path.Join(segment_dir, manifest.Segment+MANIFEST_SUFFIX))
+		}
+		rf.reopen()
+		return
+	}
+	if manifest != nil {
+		if err := appendIndex(segment_dir, manifest); err != nil {
+			rf.report(err)
+		}
+	}
+	if rf.opts.Compression != COMPRESSION_NONE {
+		rf.finish(new_file_path)
+	}
+	rf.last_roll = t
+	rf.last_segment = strings.TrimSuffix(new_file_path, compressingSuffix) + compressionExt(rf.opts.Compression)
+	rf.bytes = 0
+	rf.lines = 0
+	rf.hash.Reset()
+	rf.rehash = false
+	rf.recovered = false
+	rf.first_write = time.Time{}
+	rf.reopen()
+}
+
+// manifest describes the closed active file at file_path, hashing it again
+// if what was written differs from what was hashed.
+func (rf *RollingFile) manifest(file_path, segment string) (*SegmentManifest, error) {
+	manifest := &SegmentManifest{
+		Segment:        segment,
+		Name:           rf.filename,
+		Producer:       rf.opts.Producer,
+		Lines:          rf.lines,
+		Bytes:          rf.bytes,
+		LastReceivedAt: rf.last_write.UnixMilli(),
+		Recovered:      rf.recovered,
+	}
+	if !rf.first_write.IsZero() && !rf.recovered {
+		manifest.FirstReceivedAt = rf.first_write.UnixMilli()
+	}
+	if !rf.rehash {
+		manifest.SHA256 = hex.EncodeToString(rf.hash.Sum(nil))
+		return manifest, nil
+	}
+	size, lines, sum, err := hashFile(file_path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	rf.file = file
+	manifest.Bytes = size
+	manifest.Lines = lines
+	manifest.SHA256 = sum
+	return manifest, nil
 }
 
-func (rf *RollingFile) Write(line string) {
+// recover rolls an active file left behind by a crashed process, so that
+// its lines don't mix with the new ones. The segment is named after the last
+// write, and a partial last line is truncated.
+func (rf *RollingFile) recover() {
+	info, err := rf.file.Stat()
+	if err != nil || info.Size() == 0 {
+		return
+	}
+	file_path := ActivePath(rf.dir, rf.filename)
+	size, lines, err := lastCompleteLine(file_path, info.Size())
+	if err != nil {
+		log.Printf("Failed to recover %s: %v\n", file_path, err)
+		rf.bytes = info.Size()
+		rf.rehash = true
+		rf.recovered = true
+		return
+	}
+	if size < info.Size() {
+		if err := rf.file.Truncate(size); err != nil {
+			log.Printf("Failed to recover %s: %v\n", file_path, err)
+			rf.bytes = info.Size()
+			rf.rehash = true
+			rf.recovered = true
+			return
+		}
+		log.Printf("Truncated a partial line of %d bytes at the end of %s\n", info.Size()-size, file_path)
+	}
+	rf.bytes = size
+	rf.lines = lines
+	rf.rehash = true
+	rf.recovered = true
+	rf.last_write = info.ModTime()
+	if size > 0 {
+		log.Printf("Recovered %d lines, %d bytes, left in %s by a previous process\n", lines, size, file_path)
+		rf.rollAt(info.ModTime())
+	}
+}
+
+// lastCompleteLine returns the size of file_path up to its last newline and
+// the number of lines until there.
+func lastCompleteLine(file_path string, size int64) (int64, int64, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	var end, lines int64
+	buf := make([]byte, 1024*1024)
+	for offset := int64(0); offset < size; {
+		n, err := file.ReadAt(buf, offset)
+		if n == 0 && err != nil {
+			return 0, 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = offset + int64(i) + 1
+		}
+		lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+		offset += int64(n)
+	}
+	return end, lines, nil
+}
+
+func (rf *RollingFile) finish(segment_path string) {
+	rf.compressing.Add(1)
+	go func() {
+		defer rf.compressing.Done()
+		finishSegment(segment_path, rf.opts.Compression)
+	}()
+}
+
+// Segments rolled by size within the same minute get a counter,
+// name.host.202110180615.json, then name.host.202110180615.1.json and so on.
+func uniqueSegmentPath(prefix string) string {
+	candidate := prefix + ".json"
+	for i := 1; ; i++ {
+		if !segmentExists(candidate) {
+			return candidate
+		}
+		candidate = prefix + "." + strconv.Itoa(i) + ".json"
+	}
+}
+
+// segmentExists is false if json_path can't exist either, such as when a
+// file is in the way of its directory, then rolling fails and is reported.
+func segmentExists(json_path string) bool {
+	for _, suffix := range []string{"", ".gz", ".zst", compressingSuffix} {
+		if _, err := os.Stat(json_path + suffix); !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write queues line, it blocks while the queue is full unless OnFull is
+// ROLLING_FILE_DROP, in which case it returns ErrRollingFileFull.
+func (rf *RollingFile) Write(line string) error {
+	if !rf.startSending() {
+		return ErrRollingFileClosed
+	}
+	defer rf.sending.Done()
+	if rf.opts.OnFull == ROLLING_FILE_DROP {
+		select {
+		case rf.ch <- line:
+			return nil
+		default:
+			atomic.AddUint64(&rf.dropped, 1)
+			return ErrRollingFileFull
+		}
+	}
 	rf.ch <- line
+	return nil
 }
 
+// RollingFileStatus describes the active file of a RollingFile.
+type RollingFileStatus struct {
+	Filename    string    `json:"filename"`
+	ActivePath  string    `json:"active_path"`
+	Bytes       int64     `json:"bytes"` // written to the active file
+	Lines       int64     `json:"lines"`
+	FirstWrite  time.Time `json:"first_write"`
+	LastWrite   time.Time `json:"last_write"`
+	NextRoll    time.Time `json:"next_roll"` // by Interval, zero if disabled
+	LastRoll    time.Time `json:"last_roll"`
+	LastSegment string    `json:"last_segment,omitempty"` // path of the last one rolled
+	Queued      int       `json:"queued"`
+	Dropped     uint64    `json:"dropped"`
+}
+
+// startSending registers a call about to send to the goroutine, Close waits
+// for it before closing the queue. It returns false if rf is closed.
+func (rf *RollingFile) startSending() bool {
+	rf.mutex.RLock()
+	defer rf.mutex.RUnlock()
+	if rf.closed {
+		return false
+	}
+	rf.sending.Add(1)
+	return true
+}
+
+// do runs fn in the goroutine of rf, after the lines queued so far are
+// written, and waits for it.
+func (rf *RollingFile) do(fn func()) error {
+	if !rf.startSending() {
+		return ErrRollingFileClosed
+	}
+	done := make(chan struct{})
+	rf.commands <- func() {
+		fn()
+		close(done)
+	}
+	rf.sending.Done()
+	<-done
+	return nil
+}
+
+// Roll rolls the active file now unless it is empty, like SIGHUP does.
+func (rf *RollingFile) Roll() error {
+	return rf.do(rf.roll)
+}
+
+// Flush writes the lines queued and buffered so far to the active file.
+func (rf *RollingFile) Flush() error {
+	return rf.do(rf.flush)
+}
+
+func (rf *RollingFile) Status() (RollingFileStatus, error) {
+	status := RollingFileStatus{}
+	err := rf.do(func() {
+		status = RollingFileStatus{
+			Filename:    rf.filename,
+			ActivePath:  ActivePath(rf.dir, rf.filename),
+			Bytes:       rf.bytes,
+			Lines:       rf.lines,
+			FirstWrite:  rf.first_write,
+			LastWrite:   rf.last_write,
+			NextRoll:    rf.next_roll,
+			LastRoll:    rf.last_roll,
+			LastSegment: rf.last_segment,
+			Queued:      len(rf.ch),
+			Dropped:     rf.Dropped(),
+		}
+	})
+	return status, err
+}
+
+// Close writes the queued lines, flushes and closes the active file, and
+// waits for segments being compressed. It is safe to call more than once.
 func (rf *RollingFile) Close() {
-	close(rf.ch)
-	close(rf.signals)
-	rf.ticker.Stop()
-	rf.file.Sync()
-	rf.file.Close()
+	rf.close_once.Do(func() {
+		rf.mutex.Lock()
+		rf.closed = true
+		rf.mutex.Unlock()
+		// the goroutine keeps reading until the calls in flight are done
+		rf.sending.Wait()
+		close(rf.ch)
+	})
+	<-rf.done
 }
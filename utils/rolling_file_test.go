@@ -0,0 +1,411 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Rolled segments of filename in dir, oldest first
+func rolled(t *testing.T, dir, filename string) []string {
+	t.Helper()
+	segments, err := ListSegments(dir, filename, time.Time{}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		bytes, _ := os.ReadFile(segment.Path)
+		contents = append(contents, string(bytes))
+	}
+	return contents
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newRollingFile(t *testing.T, dir, filename string, opts RollingFileOptions) *RollingFile {
+	t.Helper()
+	rf, err := NewRollingFileWithOptions(dir, filename, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rf.Close)
+	return rf
+}
+
+func TestRollingFileMaxLines(t *testing.T) {
+	dir := t.TempDir()
+	rf := newRollingFile(t, dir, "test", RollingFileOptions{MaxLines: 2, FlushInterval: 10 * time.Millisecond})
+	for _, line := range []string{"1\n", "2\n", "3\n", "4\n", "5\n"} {
+		rf.Write(line)
+	}
+	// segments rolled within the same minute don't overwrite each other
+	waitFor(t, func() bool { return len(rolled(t, dir, "test")) == 2 })
+	if segments := rolled(t, dir, "test"); segments[0] != "1\n2\n" || segments[1] != "3\n4\n" {
+		t.Errorf("unexpected segments %q", segments)
+	}
+	waitFor(t, func() bool {
+		bytes, _ := os.ReadFile(ActivePath(dir, "test"))
+		return string(bytes) == "5\n"
+	})
+}
+
+func TestRollingFileIdleTimeout(t *testing.T) {
+	dir := t.TempDir()
+	rf := newRollingFile(t, dir, "test", RollingFileOptions{IdleTimeout: 50 * time.Millisecond})
+	rf.Write("1\n")
+	waitFor(t, func() bool { return len(rolled(t, dir, "test")) == 1 })
+
+	// nothing more to roll while idle
+	time.Sleep(200 * time.Millisecond)
+	if segments := rolled(t, dir, "test"); len(segments) != 1 || segments[0] != "1\n" {
+		t.Errorf("unexpected segments %q", segments)
+	}
+}
+
+func TestRollingFileOptionsFromEnv(t *testing.T) {
+	t.Setenv("ROLL_INTERVAL", "1h")
+	t.Setenv("ROLL_MAX_BYTES", "1000")
+	t.Setenv("ROLL_MAX_BYTES_CMC_PRICES", "2000")
+	t.Setenv("ROLL_QUEUE_SIZE", "10")
+	t.Setenv("ROLL_ON_FULL_CMC_PRICES", ROLLING_FILE_DROP)
+
+	opts, err := RollingFileOptionsFromEnv("cmc.prices", RollingFileOptions{Interval: time.Minute, MaxLines: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RollingFileOptions{Interval: time.Hour, MaxBytes: 2000, MaxLines: 10, QueueSize: 10, OnFull: ROLLING_FILE_DROP}
+	if opts != expected {
+		t.Errorf("got %+v, expected %+v", opts, expected)
+	}
+
+	t.Setenv("ROLL_IDLE_TIMEOUT_CMC_PRICES", "soon")
+	if _, err := RollingFileOptionsFromEnv("cmc.prices", DEFAULT_ROLLING_FILE_OPTIONS); err == nil || !strings.Contains(err.Error(), "ROLL_IDLE_TIMEOUT_CMC_PRICES") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRollingFileCompression(t *testing.T) {
+	for _, compression := range []string{COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+		dir := t.TempDir()
+		// left behind by a process which exited while compressing
+		leftover := path.Join(dir, "test.2021-10-18-06-00.json"+compressingSuffix)
+		os.WriteFile(leftover, []byte("0\n"), 0644)
+		os.WriteFile(path.Join(dir, "test.2021-10-18-06-00.json"+compressionExt(compression)+".tmp"), []byte("garbage"), 0644)
+
+		rf := newRollingFile(t, dir, "test", RollingFileOptions{MaxLines: 2, Compression: compression})
+		rf.Write("1\n")
+		rf.Write("2\n")
+
+		waitFor(t, func() bool { return len(rolled(t, dir, "test")) == 2 })
+		segments, _ := ListSegments(dir, "test", time.Time{}, time.Now().Add(time.Hour))
+		for i, expected := range []string{"0\n", "1\n2\n"} {
+			if !strings.HasSuffix(segments[i].Path, ".json"+compressionExt(compression)) {
+				t.Errorf("%s isn't compressed with %s", segments[i].Path, compression)
+			}
+			waitFor(t, func() bool {
+				reader, err := OpenSegment(segments[i].Path)
+				if err != nil {
+					return false
+				}
+				defer reader.Close()
+				bytes, err := io.ReadAll(reader)
+				return err == nil && string(bytes) == expected
+			})
+		}
+		files := make([]string, 0)
+		filepath.Walk(dir, func(file_path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files = append(files, info.Name())
+			}
+			return nil
+		})
+		if len(files) != 5 { // the active file, two segments, a manifest and the index
+			t.Errorf("unexpected files %v", files)
+		}
+	}
+}
+
+func TestRollingFileRecovery(t *testing.T) {
+	dir := t.TempDir()
+	// left behind by a crash in the middle of a line
+	active := ActivePath(dir, "test")
+	os.WriteFile(active, []byte("1\n2\n{\"partial"), 0644)
+	crashed_at := time.Date(2021, 10, 18, 6, 7, 30, 0, time.Local)
+	os.Chtimes(active, crashed_at, crashed_at)
+
+	rf := newRollingFile(t, dir, "test", RollingFileOptions{FlushInterval: 10 * time.Millisecond})
+	segments, _ := ListSegments(dir, "test", time.Time{}, time.Now())
+	if len(segments) != 1 || !segments[0].Time.Equal(crashed_at.Truncate(time.Minute)) {
+		t.Fatalf("unexpected segments %+v", segments)
+	}
+	if bytes, _ := os.ReadFile(segments[0].Path); string(bytes) != "1\n2\n" {
+		t.Errorf("unexpected segment %q", bytes)
+	}
+	manifest, err := ReadManifest(ManifestPath(segments[0].Path))
+	if err != nil || !manifest.Recovered || manifest.Lines != 2 || manifest.Bytes != 4 || manifest.LastReceivedAt != crashed_at.UnixMilli() {
+		t.Errorf("unexpected manifest %+v, %v", manifest, err)
+	}
+
+	// new lines don't mix with the recovered ones
+	rf.Write("3\n")
+	waitFor(t, func() bool {
+		bytes, _ := os.ReadFile(active)
+		return string(bytes) == "3\n"
+	})
+
+	// nothing but a partial line
+	dir = t.TempDir()
+	os.WriteFile(ActivePath(dir, "test"), []byte("{\"partial"), 0644)
+	newRollingFile(t, dir, "test", RollingFileOptions{})
+	if segments := rolled(t, dir, "test"); len(segments) != 0 {
+		t.Errorf("unexpected segments %q", segments)
+	}
+	if info, _ := os.Stat(ActivePath(dir, "test")); info.Size() != 0 {
+		t.Errorf("the partial line is still there")
+	}
+}
+
+func TestRollingFileFlush(t *testing.T) {
+	dir := t.TempDir()
+	active := ActivePath(dir, "test")
+	rf, err := NewRollingFileWithOptions(dir, "test", RollingFileOptions{FlushBytes: 4, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.Write("12\n")
+	rf.Write("34\n") // doesn't fit, so the buffer is flushed first
+	waitFor(t, func() bool {
+		bytes, _ := os.ReadFile(active)
+		return string(bytes) == "12\n"
+	})
+
+	// Close writes everything queued
+	for i := 0; i < 100; i++ {
+		rf.Write("5\n")
+	}
+	rf.Close()
+	rf.Close()
+	if bytes, _ := os.ReadFile(active); string(bytes) != "12\n34\n"+strings.Repeat("5\n", 100) {
+		t.Errorf("unexpected %q", bytes)
+	}
+	if err := rf.Write("6\n"); err != ErrRollingFileClosed {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRollingFileErrors(t *testing.T) {
+	dir := path.Join(t.TempDir(), "data")
+	os.Mkdir(dir, 0755)
+	rf := newRollingFile(t, dir, "test", RollingFileOptions{FlushInterval: 10 * time.Millisecond, QueueSize: 1, OnFull: ROLLING_FILE_DROP})
+	errs := make(chan error)
+	release := make(chan struct{})
+	rf.OnError(func(err error) {
+		errs <- err
+		<-release // rf is stuck until released
+	})
+	rf.Write("1\n")
+	waitFor(t, func() bool {
+		bytes, _ := os.ReadFile(ActivePath(dir, "test"))
+		return string(bytes) == "1\n"
+	})
+
+	// rolling fails instead of panicking
+	os.RemoveAll(dir)
+	rf.signals <- syscall.SIGHUP
+	if err := <-errs; !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// the queue is full while rf is stuck
+	if err := rf.Write("2\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.Write("3\n"); err != ErrRollingFileFull || rf.Dropped() != 1 {
+		t.Errorf("unexpected error %v, %d dropped", err, rf.Dropped())
+	}
+	os.Mkdir(dir, 0755)
+	release <- struct{}{}
+
+	// the manifest and rename failures come first
+	err := <-errs
+	for errors.Is(err, os.ErrNotExist) {
+		release <- struct{}{}
+		err = <-errs
+	}
+	if !errors.Is(err, ErrRollingFileFull) || !strings.Contains(err.Error(), "dropped 1 lines") {
+		t.Errorf("unexpected error %v", err)
+	}
+	rf.OnError(func(err error) { t.Error(err) })
+	release <- struct{}{}
+	rf.Close()
+	if bytes, _ := os.ReadFile(ActivePath(dir, "test")); string(bytes) != "2\n" {
+		t.Errorf("unexpected %q", bytes)
+	}
+}
+
+// A roll failing while Write waits for room in the queue and Close waits for
+// Write doesn't deadlock.
+func TestRollingFileCloseWhileBlocked(t *testing.T) {
+	dir := t.TempDir()
+	rf := newRollingFile(t, dir, "test", RollingFileOptions{MaxLines: 1, QueueSize: 1})
+	// where the path template puts the directory of segments
+	os.WriteFile(path.Join(dir, "test"), nil, 0644)
+	failed := make(chan struct{}, 1)
+	release := make(chan struct{})
+	rf.OnError(func(err error) {
+		select {
+		case failed <- struct{}{}:
+		default:
+		}
+		<-release
+	})
+	rf.Write("1\n")
+	<-failed // rf is stuck reporting the failed roll
+	rf.Write("2\n")
+	go rf.Write("3\n") // the queue is full
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		rf.Close()
+		close(closed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close is deadlocked")
+	}
+	// kept in the active file
+	if bytes, _ := os.ReadFile(ActivePath(dir, "test")); string(bytes) != "1\n2\n3\n" {
+		t.Errorf("unexpected active file %q", bytes)
+	}
+}
+
+func TestRollingFileManifest(t *testing.T) {
+	dir := t.TempDir()
+	before := time.Now().UnixMilli()
+	rf := newRollingFile(t, dir, "test", RollingFileOptions{MaxLines: 2, Producer: "crawler"})
+	for _, line := range []string{"1\n", "2\n", "3\n", "4\n"} {
+		rf.Write(line)
+	}
+	waitFor(t, func() bool { return len(rolled(t, dir, "test")) == 2 })
+
+	segments, _ := ListSegments(dir, "test", time.Time{}, time.Now().Add(time.Hour))
+	manifest, err := ReadManifest(ManifestPath(segments[0].Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("1\n2\n"))
+	if manifest.Name != "test" || manifest.Producer != "crawler" || manifest.Lines != 2 || manifest.Bytes != 4 || manifest.SHA256 != hex.EncodeToString(sum[:]) || manifest.Recovered {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+	if manifest.FirstReceivedAt < before || manifest.LastReceivedAt < manifest.FirstReceivedAt {
+		t.Errorf("unexpected time bounds %+v", manifest)
+	}
+
+	// a corrupt line, such as a partial write, is skipped
+	segment_dir := path.Dir(segments[0].Path)
+	index, _ := os.OpenFile(path.Join(segment_dir, INDEX_FILENAME), os.O_APPEND|os.O_WRONLY, 0644)
+	index.WriteString("{\"segment\":\n")
+	index.Close()
+	manifests, corrupt, err := ReadIndex(segment_dir)
+	if err != nil || corrupt != 1 || len(manifests) != 2 {
+		t.Fatalf("unexpected index %+v, %d corrupt, %v", manifests, corrupt, err)
+	}
+	if manifests[0] != *manifest || manifests[1].Segment != segmentStem(path.Base(segments[1].Path)) {
+		t.Errorf("unexpected index %+v", manifests)
+	}
+}
+
+func TestRollingFilePathTemplate(t *testing.T) {
+	dir := t.TempDir()
+	// written by a version without path templates
+	os.WriteFile(path.Join(dir, "test"), []byte("0\n"), 0644)
+
+	rf := newRollingFile(t, dir, "test", RollingFileOptions{MaxLines: 1, Host: "myhost"})
+	rf.Write("1\n")
+	waitFor(t, func() bool { return len(rolled(t, dir, "test")) == 2 })
+
+	segments, _ := ListSegments(dir, "test", time.Time{}, time.Now().Add(time.Hour))
+	now := time.Now().UTC()
+	expected_dir := path.Join(dir, "test", now.Format("2006"), now.Format("01"), now.Format("02"))
+	for _, segment := range segments {
+		if path.Dir(segment.Path) != expected_dir || segment.Host != "myhost" || !strings.HasPrefix(path.Base(segment.Path), "test.myhost.") {
+			t.Errorf("unexpected segment %+v", segment)
+		}
+	}
+	if bytes, _ := os.ReadFile(segments[0].Path); string(bytes) != "0\n" {
+		t.Errorf("the legacy active file isn't recovered, got %q", bytes)
+	}
+
+	for _, template := range []string{"/abs/" + SEGMENT_FILE_TEMPLATE, "../" + SEGMENT_FILE_TEMPLATE, "{producer}/{producer}.{yyyyMMddHHmm}.json"} {
+		if _, err := NewRollingFileWithOptions(dir, "other", RollingFileOptions{PathTemplate: template}); err == nil {
+			t.Errorf("%s should be invalid", template)
+		}
+	}
+}
+
+func TestRollingFileControl(t *testing.T) {
+	dir := t.TempDir()
+	rf := newRollingFile(t, dir, "test", RollingFileOptions{FlushInterval: time.Hour, Compression: COMPRESSION_GZIP})
+	rf.Write("1\n")
+	rf.Write("2\n")
+	if err := rf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes, _ := os.ReadFile(ActivePath(dir, "test")); string(bytes) != "1\n2\n" {
+		t.Errorf("unexpected active file %q", bytes)
+	}
+	status, err := rf.Status()
+	if err != nil || status.Bytes != 4 || status.Lines != 2 || !status.LastRoll.IsZero() || status.ActivePath != ActivePath(dir, "test") {
+		t.Errorf("unexpected status %+v, %v", status, err)
+	}
+
+	if err := rf.Roll(); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = rf.Status()
+	if status.Bytes != 0 || status.LastRoll.IsZero() || !strings.HasSuffix(status.LastSegment, ".json.gz") {
+		t.Errorf("unexpected status %+v", status)
+	}
+	waitFor(t, func() bool { _, err := os.Stat(status.LastSegment); return err == nil })
+	// nothing to roll
+	rf.Roll()
+	if again, _ := rf.Status(); again.LastSegment != status.LastSegment {
+		t.Errorf("an empty file was rolled into %s", again.LastSegment)
+	}
+
+	// SIGHUP rolls as well
+	rf.Write("3\n")
+	rf.Flush()
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitFor(t, func() bool {
+		again, _ := rf.Status()
+		return again.LastSegment != status.LastSegment
+	})
+
+	rf.Close()
+	if _, err := rf.Status(); !errors.Is(err, ErrRollingFileClosed) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
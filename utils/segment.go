@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Layout of the timestamp in the names of segments, in UTC
+const SEGMENT_TIME_LAYOUT = "200601021504"
+
+// Layout of the timestamp in the names of segments rolled before path
+// templates, such as cmc.prices.2021-10-18-06-15.json, in local time
+const LEGACY_SEGMENT_TIME_LAYOUT = "2006-01-02-15-04"
+
+const (
+	// File name of segments, the directories above are configurable
+	SEGMENT_FILE_TEMPLATE = "{producer}.{host}.{yyyyMMddHHmm}.json"
+	// Where segments are rolled under the directory of the RollingFile
+	DEFAULT_PATH_TEMPLATE = "{producer}/{yyyy}/{mm}/{dd}/" + SEGMENT_FILE_TEMPLATE
+)
+
+// Segment is a file rolled by RollingFile, possibly compressed.
+type Segment struct {
+	Path string
+	Name string    // the filename given to NewRollingFile
+	Host string    // empty for legacy segments
+	Time time.Time // when the file was rolled
+	Seq  int       // counter of segments rolled within the same minute
+}
+
+// validPathTemplate checks that template is relative, has no .. and ends
+// with SEGMENT_FILE_TEMPLATE, so that segments can be parsed back.
+func validPathTemplate(template string) error {
+	if path.IsAbs(template) || path.Clean(template) != template || strings.HasPrefix(template, "..") {
+		return fmt.Errorf("invalid path template %s, expected a clean relative path", template)
+	}
+	if template != SEGMENT_FILE_TEMPLATE && !strings.HasSuffix(template, "/"+SEGMENT_FILE_TEMPLATE) {
+		return fmt.Errorf("invalid path template %s, expected to end with %s", template, SEGMENT_FILE_TEMPLATE)
+	}
+	return nil
+}
+
+// segmentPrefix renders template for a segment of producer rolled at t,
+// without the .json suffix. Placeholders are {producer}, {host}, {yyyy},
+// {mm}, {dd}, {HH} and {yyyyMMddHHmm}, all in UTC.
+func segmentPrefix(template, producer, host string, t time.Time) string {
+	t = t.UTC()
+	return strings.TrimSuffix(strings.NewReplacer(
+		"{producer}", producer,
+		"{host}", host,
+		"{yyyyMMddHHmm}", t.Format(SEGMENT_TIME_LAYOUT),
+		"{yyyy}", t.Format("2006"),
+		"{mm}", t.Format("01"),
+		"{dd}", t.Format("02"),
+		"{HH}", t.Format("15"),
+	).Replace(template), ".json")
+}
+
+// Hostname returns the short host name, without domain, safe in segment
+// names.
+func Hostname() string {
+	host, err := os.Hostname()
+	if err != nil || len(host) == 0 {
+		return "localhost"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, host)
+}
+
+// ParseSegmentName parses names like cmc.prices.myhost.202110180615.json.gz
+// or cmc.prices.myhost.202110180615.1.json, and legacy names like
+// cmc.prices.2021-10-18-06-15.json, Path is left empty.
+func ParseSegmentName(file_name string) (Segment, bool) {
+	base := strings.TrimSuffix(strings.TrimSuffix(file_name, ".gz"), ".zst")
+	if !strings.HasSuffix(base, ".json") {
+		return Segment{}, false
+	}
+	base = strings.TrimSuffix(base, ".json")
+
+	if i := strings.LastIndexByte(base, '.'); i > 0 {
+		if n, err := strconv.Atoi(base[i+1:]); err == nil && n > 0 {
+			if segment, ok := parseSegmentBase(base[:i]); ok {
+				segment.Seq = n
+				return segment, true
+			}
+		}
+	}
+	return parseSegmentBase(base)
+}
+
+func parseSegmentBase(base string) (Segment, bool) {
+	i := strings.LastIndexByte(base, '.')
+	if i <= 0 {
+		return Segment{}, false
+	}
+	if len(base)-i-1 == len(SEGMENT_TIME_LAYOUT) {
+		t, err := time.ParseInLocation(SEGMENT_TIME_LAYOUT, base[i+1:], time.UTC)
+		j := strings.LastIndexByte(base[:i], '.')
+		if err != nil || j <= 0 || j == i-1 {
+			return Segment{}, false
+		}
+		return Segment{Name: base[:j], Host: base[j+1 : i], Time: t}, true
+	}
+	if len(base)-i-1 == len(LEGACY_SEGMENT_TIME_LAYOUT) {
+		t, err := time.ParseInLocation(LEGACY_SEGMENT_TIME_LAYOUT, base[i+1:], time.Local)
+		if err != nil {
+			return Segment{}, false
+		}
+		return Segment{Name: base[:i], Time: t}, true
+	}
+	return Segment{}, false
+}
+
+// ListSegments finds the rolled files of name under dir, recursively,
+// which may contain data between from and to, oldest first. Segments are
+// found through the index of their directory, directories without one,
+// written before indexes existed, are listed instead.
+func ListSegments(dir, name string, from, to time.Time) ([]Segment, error) {
+	all := make([]Segment, 0)
+	err := filepath.Walk(dir, func(file_path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		segments, err := dirSegments(file_path, name)
+		all = append(all, segments...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return SelectSegments(all, from, to), nil
+}
+
+// dirSegments returns the segments of name right in dir.
+func dirSegments(dir, name string) ([]Segment, error) {
+	segments := make([]Segment, 0)
+	if !HasIndex(dir) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			segment, ok := ParseSegmentName(entry.Name())
+			if ok && !entry.IsDir() && segment.Name == name {
+				segment.Path = filepath.Join(dir, entry.Name())
+				segments = append(segments, segment)
+			}
+		}
+		return segments, nil
+	}
+	manifests, corrupt, err := ReadIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	if corrupt > 0 {
+		log.Printf("Skipped %d corrupt lines of %s\n", corrupt, filepath.Join(dir, INDEX_FILENAME))
+	}
+	for i := range manifests {
+		segment_path, ok := SegmentPath(dir, &manifests[i])
+		if !ok {
+			continue
+		}
+		segment, ok := ParseSegmentName(filepath.Base(segment_path))
+		if ok && segment.Name == name {
+			segment.Path = segment_path
+			segments = append(segments, segment)
+		}
+	}
+	return segments, nil
+}
+
+// SelectSegments sorts segments of the same name, oldest first, and keeps
+// those which may contain data between from and to.
+func SelectSegments(all []Segment, from, to time.Time) []Segment {
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].Time.Equal(all[j].Time) {
+			if all[i].Host != all[j].Host {
+				return all[i].Host < all[j].Host
+			}
+			return all[i].Seq < all[j].Seq
+		}
+		return all[i].Time.Before(all[j].Time)
+	})
+
+	// A segment holds the data written since the previous one was rolled, up
+	// to the end of the minute in its name
+	segments := make([]Segment, 0)
+	for i, segment := range all {
+		if segment.Time.Add(time.Minute).Before(from) {
+			continue
+		}
+		if i > 0 && !all[i-1].Time.Before(to) {
+			break
+		}
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+type compressedFile struct {
+	io.ReadCloser // decompressor
+	file          io.Closer
+}
+
+func (f *compressedFile) Close() error {
+	f.ReadCloser.Close()
+	return f.file.Close()
+}
+
+// OpenSegment opens a rolled file, decompressing it if needed.
+func OpenSegment(file_path string) (io.ReadCloser, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return nil, err
+	}
+	return DecompressSegment(file, file_path)
+}
+
+// DecompressSegment decompresses file according to the suffix of name, and
+// closes it with the returned reader.
+func DecompressSegment(file io.ReadCloser, name string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &compressedFile{reader, file}, nil
+	case strings.HasSuffix(name, ".zst"):
+		decoder, err := zstd.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &compressedFile{decoder.IOReadCloser(), file}, nil
+	default:
+		return file, nil
+	}
+}
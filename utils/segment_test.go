@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSegmentName(t *testing.T) {
+	for _, tt := range []struct {
+		file_name string
+		valid     bool
+		expected  Segment
+	}{
+		{"cmc.prices.myhost.202110180615.json.gz", true, Segment{Name: "cmc.prices", Host: "myhost", Time: time.Date(2021, 10, 18, 6, 15, 0, 0, time.UTC)}},
+		{"cmc.prices.myhost.202110180615.2.json", true, Segment{Name: "cmc.prices", Host: "myhost", Time: time.Date(2021, 10, 18, 6, 15, 0, 0, time.UTC), Seq: 2}},
+		{"cmc.prices.2021-10-18-06-15.1.json.zst", true, Segment{Name: "cmc.prices", Time: time.Date(2021, 10, 18, 6, 15, 0, 0, time.Local), Seq: 1}},
+		{"prices.202110180615.json", false, Segment{}}, // no host
+		{"cmc.prices.myhost.202110180615.manifest", false, Segment{}},
+		{"cmc.prices.active", false, Segment{}},
+	} {
+		segment, ok := ParseSegmentName(tt.file_name)
+		if ok != tt.valid || segment.Name != tt.expected.Name || segment.Host != tt.expected.Host || !segment.Time.Equal(tt.expected.Time) || segment.Seq != tt.expected.Seq {
+			t.Errorf("%s: got %+v, %v", tt.file_name, segment, ok)
+		}
+	}
+}
+
+func TestSegmentPrefix(t *testing.T) {
+	rolled := time.Date(2021, 10, 18, 23, 15, 0, 0, time.FixedZone("UTC+8", 8*3600))
+	if prefix := segmentPrefix(DEFAULT_PATH_TEMPLATE, "cmc.prices", "myhost", rolled); prefix != "cmc.prices/2021/10/18/cmc.prices.myhost.202110181515" {
+		t.Errorf("unexpected %s", prefix)
+	}
+}
+
+func TestSelectSegments(t *testing.T) {
+	base := time.Date(2021, 10, 18, 6, 0, 0, 0, time.UTC)
+	all := []Segment{
+		{Name: "test", Host: "myhost", Time: base.Add(30 * time.Minute)},
+		{Name: "test", Host: "myhost", Time: base},
+		{Name: "test", Host: "myhost", Time: base.Add(15 * time.Minute)},
+		{Name: "test", Host: "myhost", Time: base.Add(15 * time.Minute), Seq: 1},
+	}
+	for _, tt := range []struct {
+		from, to time.Time
+		expected []time.Time
+	}{
+		{base, base.Add(time.Hour), []time.Time{base, base.Add(15 * time.Minute), base.Add(15 * time.Minute), base.Add(30 * time.Minute)}},
+		// the segments named 06:15 may be rolled as late as 06:15:59
+		{base.Add(15*time.Minute + 30*time.Second), base.Add(time.Hour), []time.Time{base.Add(15 * time.Minute), base.Add(15 * time.Minute), base.Add(30 * time.Minute)}},
+		{base.Add(17 * time.Minute), base.Add(20 * time.Minute), []time.Time{base.Add(30 * time.Minute)}},
+		{base.Add(-time.Hour), base.Add(time.Minute), []time.Time{base, base.Add(15 * time.Minute)}},
+	} {
+		segments := SelectSegments(append([]Segment{}, all...), tt.from, tt.to)
+		times := make([]time.Time, 0, len(segments))
+		for _, segment := range segments {
+			times = append(times, segment.Time)
+		}
+		if !reflect.DeepEqual(times, tt.expected) {
+			t.Errorf("%s to %s: selected %v", tt.from.Format("15:04:05"), tt.to.Format("15:04:05"), times)
+		}
+	}
+}
+
+// Segments are found through the index of their directory, if any.
+func TestListSegments(t *testing.T) {
+	dir := t.TempDir()
+	indexed := filepath.Join(dir, "cmc.prices/2021/10/18")
+	legacy := filepath.Join(dir, "legacy")
+	for _, file_path := range []string{
+		filepath.Join(indexed, "cmc.prices.myhost.202110180600.json.gz"),
+		filepath.Join(indexed, "cmc.prices.myhost.202110180615.json"),
+		filepath.Join(indexed, "cmc.prices.myhost.202110180630.json.gz"), // missing from the index
+		filepath.Join(legacy, "cmc.prices.2021-10-17-05-00.json.gz"),
+	} {
+		os.MkdirAll(filepath.Dir(file_path), 0755)
+		os.WriteFile(file_path, nil, 0644)
+	}
+	for _, segment := range []string{"cmc.prices.myhost.202110180600", "cmc.prices.myhost.202110180615", "cmc.prices.myhost.202110180645"} {
+		if err := appendIndex(indexed, &SegmentManifest{Segment: segment, Name: "cmc.prices"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments, err := ListSegments(dir, "cmc.prices", time.Time{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, 0)
+	for _, segment := range segments {
+		rel, _ := filepath.Rel(dir, segment.Path)
+		paths = append(paths, rel)
+	}
+	expected := []string{
+		"legacy/cmc.prices.2021-10-17-05-00.json.gz",
+		"cmc.prices/2021/10/18/cmc.prices.myhost.202110180600.json.gz",
+		"cmc.prices/2021/10/18/cmc.prices.myhost.202110180615.json",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected segments %v", paths)
+	}
+}